@@ -0,0 +1,376 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMECertificatesMetric is the name of the counter of retrieved ACME certificates, by event.
+const ACMECertificatesMetric = "sonicred.acme.certificates"
+
+// ACMERequestTimeout is the timeout of the requests to the ACME endpoint using custom root certificates.
+const ACMERequestTimeout = 30 * time.Second
+
+// Key types of the certificates retrieved using ACME.
+const (
+	ACMEKeyTypeECDSA = "ecdsa"
+	ACMEKeyTypeRSA   = "rsa"
+)
+
+// Events of the certificate retrieval, reported in the log and the metric.
+const (
+	ACMEEventIssued  = "issued"
+	ACMEEventRenewed = "renewed"
+	ACMEEventFailed  = "failed"
+)
+
+// ErrInvalidACMEKeyType indicates an unknown key type for the certificates retrieved using ACME.
+var ErrInvalidACMEKeyType = errors.New("invalid ACME key type")
+
+// ErrInvalidACMERenewal indicates a negative renewal lead time.
+var ErrInvalidACMERenewal = errors.New("ACME renewal lead time must not be negative")
+
+// ErrIncompleteEAB indicates an external account binding missing either the key ID or the key.
+var ErrIncompleteEAB = errors.New("external account binding requires key ID and key")
+
+// ErrConflictingEABKey indicates an external account binding key given both directly and as file.
+var ErrConflictingEABKey = errors.New("external account binding key given both directly and as file")
+
+// ErrInvalidEABKey indicates an external account binding key that is not base64url encoded.
+var ErrInvalidEABKey = errors.New("invalid external account binding key")
+
+// ErrNoACMERootCertificates indicates an ACME root bundle without any certificate.
+var ErrNoACMERootCertificates = errors.New("no certificate in ACME root bundle")
+
+// acmeSettings holds the automatic certificate retrieval.
+type acmeSettings struct {
+	domains     []string
+	certCache   string
+	endpoint    string
+	eabKID      string
+	eabKey      string
+	eabKeyFile  string
+	roots       string
+	email       string
+	keyType     string
+	renewBefore time.Duration
+}
+
+// acmeSettings gives the automatic certificate retrieval configuration.
+func (c ServerConfig) acmeSettings() acmeSettings {
+	return acmeSettings{
+		domains:     *c.AcmeDomains,
+		certCache:   c.CertCache,
+		endpoint:    c.AcmeEndpoint,
+		eabKID:      c.AcmeEABKID,
+		eabKey:      c.AcmeEABKey,
+		eabKeyFile:  c.AcmeEABKeyFile,
+		roots:       c.AcmeRoots,
+		email:       c.AcmeEmail,
+		keyType:     c.AcmeKeyType,
+		renewBefore: c.AcmeRenewBefore,
+	}
+}
+
+// decodeEABKey decodes the external account binding key, given base64url encoded as by the ACME providers.
+func decodeEABKey(key string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+
+	if err != nil || len(decoded) == 0 {
+		return nil, ErrInvalidEABKey
+	}
+
+	return decoded, nil
+}
+
+// eabKeyBytes gives the decoded external account binding key, read from the key file if given. Missing key IDs
+// or keys and keys given twice are reported as errors. Without external account binding, the key is nil.
+func (s acmeSettings) eabKeyBytes() ([]byte, error) {
+	hasKey := len(s.eabKey) > 0 || len(s.eabKeyFile) > 0
+
+	switch {
+	case len(s.eabKey) > 0 && len(s.eabKeyFile) > 0:
+		return nil, ErrConflictingEABKey
+	case (len(s.eabKID) > 0) != hasKey:
+		return nil, ErrIncompleteEAB
+	case !hasKey:
+		return nil, nil
+	case len(s.eabKey) > 0:
+		return decodeEABKey(s.eabKey)
+	}
+
+	key, err := readSecretFile(s.eabKeyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read external account binding key: %w", err)
+	}
+
+	return decodeEABKey(string(key))
+}
+
+// checkEABConsistency checks the external account binding options, giving the errors together with their sources.
+func checkEABConsistency(config ServerConfig) error {
+	settings := config.acmeSettings()
+
+	if _, err := settings.eabKeyBytes(); err != nil {
+		keySource := config.source("acmeeabkey")
+
+		if len(settings.eabKeyFile) > 0 {
+			keySource = config.source("acmeeabkeyfile")
+		}
+
+		if errors.Is(err, ErrIncompleteEAB) {
+			return fmt.Errorf("%w (%v, %v)", err, config.source("acmeeabkid"), keySource)
+		}
+
+		return fmt.Errorf("%w (%v)", err, keySource)
+	}
+
+	return nil
+}
+
+// newACMEHTTPClient creates the client for the requests to the ACME endpoint, trusting only the certificates of
+// the roots file.
+func newACMEHTTPClient(roots string) (*http.Client, error) {
+	data, err := os.ReadFile(filepath.Clean(roots))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read ACME root bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: %v", ErrNoACMERootCertificates, roots)
+	}
+
+	transport, _ := http.DefaultTransport.(*http.Transport)
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	return &http.Client{Transport: transport, Timeout: ACMERequestTimeout}, nil
+}
+
+// newACMEManager creates the manager retrieving the certificates of the ACME domains, see createACMEConfig. The
+// account key is generated on first use and kept in the certificate cache, just as the certificates.
+func newACMEManager(settings acmeSettings) (*autocert.Manager, error) {
+	var acmeClient *acme.Client
+
+	if len(settings.endpoint) > 0 || len(settings.roots) > 0 {
+		acmeClient = &acme.Client{
+			DirectoryURL: settings.endpoint,
+		}
+	}
+
+	if len(settings.roots) > 0 {
+		httpClient, err := newACMEHTTPClient(settings.roots)
+
+		if err != nil {
+			return nil, err
+		}
+
+		acmeClient.HTTPClient = httpClient
+	}
+
+	certManager := &autocert.Manager{
+		Cache:       newACMECache(autocert.DirCache(settings.certCache)),
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(settings.domains...),
+		Client:      acmeClient,
+		Email:       settings.email,
+		RenewBefore: settings.renewBefore,
+	}
+
+	key, err := settings.eabKeyBytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key != nil {
+		certManager.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: settings.eabKID, Key: key}
+	}
+
+	return certManager, nil
+}
+
+// newSharedACMEManager creates the manager shared by the TLS configuration and the plain HTTP server, so that
+// the HTTP-01 challenges are answered by the manager requesting them, see httpRedirectHandler. It is also kept
+// across reloads with unchanged settings, as every manager renews its certificates in the background. There is
+// none if no certificates are retrieved.
+func newSharedACMEManager(settings acmeSettings) (*autocert.Manager, error) {
+	if len(settings.domains) == 0 {
+		return nil, nil
+	}
+
+	return newACMEManager(settings)
+}
+
+// createACMEConfig initializes and returns a TLS configuration for handling ACME-based certificate management,
+// see acmeSettings. The certificates are retrieved using certManager, a new one if it is nil. If the manager is
+// shared with the plain HTTP server, see newSharedACMEManager, the HTTP-01 challenges are used additionally to the
+// TLS-ALPN-01 ones. Failed retrievals are logged and counted.
+func createACMEConfig(settings acmeSettings, certManager *autocert.Manager) (*tls.Config, error) {
+	if !slices.Contains([]string{"", ACMEKeyTypeECDSA, ACMEKeyTypeRSA}, settings.keyType) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidACMEKeyType, settings.keyType)
+	}
+
+	if certManager == nil {
+		var err error
+
+		if certManager, err = newACMEManager(settings); err != nil {
+			return nil, err
+		}
+	}
+
+	config := certManager.TLSConfig()
+	getCertificate := config.GetCertificate
+	counter := newACMECertificatesCounter()
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if settings.keyType == ACMEKeyTypeRSA {
+			hello = withoutECDSA(hello)
+		}
+
+		cert, err := getCertificate(hello)
+
+		// errors for other names stem from the host policy, e.g., for clients connecting by IP address
+		if err != nil && slices.ContainsFunc(settings.domains, func(domain string) bool {
+			return normalizeHostName(domain) == normalizeHostName(hello.ServerName)
+		}) {
+			slog.Error("could not retrieve ACME certificate",
+				slog.String("domain", hello.ServerName),
+				slog.String("error", err.Error()))
+
+			countACMECertificate(counter, ACMEEventFailed)
+		}
+
+		return cert, err
+	}
+
+	return config, nil
+}
+
+// withoutECDSA gives a copy of the hello not supporting ECDSA certificates, so that the RSA certificate is
+// selected, and retrieved if needed.
+func withoutECDSA(hello *tls.ClientHelloInfo) *tls.ClientHelloInfo {
+	result := *hello
+	result.SignatureSchemes = make([]tls.SignatureScheme, 0, len(hello.SignatureSchemes))
+
+	for _, scheme := range hello.SignatureSchemes {
+		switch scheme {
+		case tls.ECDSAWithSHA1, tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+			continue
+		default:
+			result.SignatureSchemes = append(result.SignatureSchemes, scheme)
+		}
+	}
+
+	return &result
+}
+
+// newACMECertificatesCounter creates the counter of retrieved certificates. Failing this, nil is returned.
+func newACMECertificatesCounter() metric.Int64Counter {
+	counter, err := otel.Meter(ServerName).Int64Counter(ACMECertificatesMetric,
+		metric.WithDescription("Number of certificates retrieved using ACME, by event."),
+		metric.WithUnit("{certificate}"))
+
+	if err != nil {
+		slog.Warn("could not create ACME certificates metric", slog.String("error", err.Error()))
+		return nil
+	}
+
+	return counter
+}
+
+// countACMECertificate adds the event to the metric.
+func countACMECertificate(counter metric.Int64Counter, event string) {
+	if counter != nil {
+		counter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("event", event)))
+	}
+}
+
+// acmeCache is the certificate cache of the ACME manager, reporting every certificate stored as issued or, if
+// it replaces a previous one, as renewed.
+type acmeCache struct {
+	autocert.Cache
+
+	counter metric.Int64Counter
+}
+
+// newACMECache wraps the cache to report stored certificates.
+func newACMECache(cache autocert.Cache) *acmeCache {
+	return &acmeCache{Cache: cache, counter: newACMECertificatesCounter()}
+}
+
+// Put stores the data, reporting it if it is a certificate.
+func (c *acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	// certificates are stored by domain, with a suffix for RSA keys; the account key and the challenge tokens
+	// have other suffixes
+	name, rsa := strings.CutSuffix(key, "+rsa")
+
+	if strings.Contains(name, "+") {
+		return c.Cache.Put(ctx, key, data)
+	}
+
+	event := ACMEEventRenewed
+
+	if _, err := c.Get(ctx, key); errors.Is(err, autocert.ErrCacheMiss) {
+		event = ACMEEventIssued
+	}
+
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+
+	attrs := []any{slog.String("domain", name), slog.String("event", event), slog.Bool("rsa", rsa)}
+
+	if cert := firstCertificate(data); cert != nil {
+		attrs = append(attrs, slog.Time("expiry", cert.NotAfter))
+	}
+
+	slog.Info("retrieved ACME certificate", attrs...)
+	countACMECertificate(c.counter, event)
+
+	return nil
+}
+
+// firstCertificate parses the first certificate of the PEM data, nil if there is none.
+func firstCertificate(data []byte) *x509.Certificate {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil
+		}
+
+		return cert
+	}
+
+	return nil
+}
@@ -0,0 +1,455 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEManager(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	writeTestFile(t, roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		time.Now())
+
+	certManager, err := newACMEManager(acmeSettings{
+		domains:     []string{"shop.example.com"},
+		certCache:   t.TempDir(),
+		endpoint:    server.URL + "/directory",
+		eabKID:      "kid-1",
+		eabKey:      "c2VjcmV0LWhtYWMta2V5",
+		roots:       roots,
+		email:       "admin@example.com",
+		renewBefore: 48 * time.Hour,
+	})
+
+	if !assert.NoError(t, err, "manager should be created") {
+		return
+	}
+
+	assert.Equal(t, server.URL+"/directory", certManager.Client.DirectoryURL, "directory of the ACME endpoint")
+	assert.Equal(t, "admin@example.com", certManager.Email, "contact email")
+	assert.Equal(t, 48*time.Hour, certManager.RenewBefore, "renewal lead time")
+
+	if assert.NotNil(t, certManager.ExternalAccountBinding, "external account binding") {
+		assert.Equal(t, "kid-1", certManager.ExternalAccountBinding.KID, "key id")
+		assert.Equal(t, []byte("secret-hmac-key"), certManager.ExternalAccountBinding.Key, "decoded key")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "eab.key")
+	writeTestFile(t, keyFile, []byte("c2VjcmV0LWhtYWMta2V5\n"), time.Now())
+
+	fileManager, err := newACMEManager(acmeSettings{eabKID: "kid-1", eabKeyFile: keyFile})
+
+	if assert.NoError(t, err, "manager with key file should be created") &&
+		assert.NotNil(t, fileManager.ExternalAccountBinding, "external account binding from key file") {
+
+		assert.Equal(t, []byte("secret-hmac-key"), fileManager.ExternalAccountBinding.Key, "key read from file")
+	}
+
+	request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+
+	if !assert.NoError(t, err, "request should be created") {
+		return
+	}
+
+	response, err := certManager.Client.HTTPClient.Do(request)
+
+	if assert.NoError(t, err, "ACME endpoint should be trusted using the root bundle") {
+		_ = response.Body.Close()
+	}
+
+	response, err = http.DefaultClient.Do(request)
+
+	if err == nil {
+		_ = response.Body.Close()
+	}
+
+	assert.Error(t, err, "ACME endpoint should not be trusted by default")
+}
+
+func TestACMEManagerErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := newACMEManager(acmeSettings{eabKID: "kid-1"})
+	assert.ErrorIs(t, err, ErrIncompleteEAB, "key id without key")
+
+	_, err = newACMEManager(acmeSettings{eabKID: "kid-1", eabKey: "not base64!"})
+	assert.ErrorIs(t, err, ErrInvalidEABKey, "invalid key")
+
+	keyFile := filepath.Join(t.TempDir(), "eab.key")
+	writeTestFile(t, keyFile, []byte("c2VjcmV0LWhtYWMta2V5\n"), time.Now())
+
+	_, err = newACMEManager(acmeSettings{eabKID: "kid-1", eabKey: "c2VjcmV0LWhtYWMta2V5", eabKeyFile: keyFile})
+	assert.ErrorIs(t, err, ErrConflictingEABKey, "key given twice")
+
+	_, err = newACMEManager(acmeSettings{eabKID: "kid-1", eabKeyFile: filepath.Join(t.TempDir(), "missing.key")})
+	assert.Error(t, err, "missing key file")
+
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	writeTestFile(t, roots, []byte("no certificates"), time.Now())
+
+	_, err = newACMEManager(acmeSettings{roots: roots})
+	assert.ErrorIs(t, err, ErrNoACMERootCertificates, "root bundle without certificates")
+
+	_, err = newACMEManager(acmeSettings{roots: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err, "missing root bundle")
+
+	_, err = createACMEConfig(acmeSettings{keyType: "dsa"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidACMEKeyType, "invalid key type")
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nacmekeytype: dsa\nacmerenewbefore: -1h\n"+
+		"acmeeabkid: kid-1\n")
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrInvalidACMEKeyType, "expected invalid key type")
+	assert.ErrorIs(t, checkErr, ErrInvalidACMERenewal, "expected negative renewal lead time")
+	assert.ErrorIs(t, checkErr, ErrIncompleteEAB, "expected incomplete external account binding")
+	assert.ErrorContains(t, checkErr, fileName+":3", "expected location of key type")
+	assert.ErrorContains(t, checkErr, fileName+":5", "expected location of key id")
+}
+
+func TestWithoutECDSA(t *testing.T) {
+	t.Parallel()
+
+	hello := &tls.ClientHelloInfo{
+		ServerName: "shop.example.com",
+		SignatureSchemes: []tls.SignatureScheme{
+			tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256, tls.ECDSAWithP384AndSHA384, tls.PKCS1WithSHA256,
+		},
+	}
+
+	result := withoutECDSA(hello)
+
+	assert.Equal(t, []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}, result.SignatureSchemes,
+		"signature schemes without ECDSA")
+	assert.Equal(t, "shop.example.com", result.ServerName, "server name kept")
+	assert.Len(t, hello.SignatureSchemes, 4, "original hello unchanged")
+	assert.Empty(t, withoutECDSA(&tls.ClientHelloInfo{}).SignatureSchemes, "no signature schemes")
+	assert.NotNil(t, withoutECDSA(&tls.ClientHelloInfo{}).SignatureSchemes, "no signature schemes given as empty")
+}
+
+func TestACMECertificateMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	cache := newACMECache(autocert.DirCache(t.TempDir()))
+	cert := newTestServerCertificate(t, time.Now().Add(time.Hour), "shop.example.com")
+	data := append(append([]byte{}, cert.key...), cert.cert...)
+
+	for _, key := range []string{"acme_account+key", "shop.example.com+token", "token+http-01",
+		"shop.example.com", "shop.example.com", "shop.example.com+rsa"} {
+
+		if !assert.NoError(t, cache.Put(t.Context(), key, data), "cache entry %v should be stored", key) {
+			return
+		}
+	}
+
+	var metrics metricdata.ResourceMetrics
+
+	if !assert.NoError(t, reader.Collect(t.Context(), &metrics), "metrics should be collected") {
+		return
+	}
+
+	counts := make(map[string]int64)
+
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if sum, isSum := m.Data.(metricdata.Sum[int64]); isSum && m.Name == ACMECertificatesMetric {
+				for _, point := range sum.DataPoints {
+					event, _ := point.Attributes.Value(attribute.Key("event"))
+					counts[event.AsString()] += point.Value
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]int64{ACMEEventIssued: 2, ACMEEventRenewed: 1}, counts, "certificate events")
+}
+
+// testACMEServer is a minimal ACME server, see RFC 8555, for a single domain. It only offers HTTP-01 challenges,
+// validated by requesting the key authorization from the plain HTTP server at httpAddress, and issues the
+// certificates using its authority. The signatures of the requests are not verified.
+type testACMEServer struct {
+	*httptest.Server
+
+	authority   testCertAuthority
+	domain      string
+	httpAddress string
+
+	lock        sync.Mutex
+	nonce       int
+	thumbprint  string
+	token       string
+	authzStatus string
+	chain       []byte
+	validations int
+}
+
+// newTestACMEServer starts an ACME server for the domain, its directory is found at /directory.
+func newTestACMEServer(t *testing.T, domain, httpAddress string) *testACMEServer {
+	t.Helper()
+
+	server := &testACMEServer{
+		authority:   newTestCertAuthority(t, "Test ACME CA"),
+		domain:      domain,
+		httpAddress: httpAddress,
+	}
+	server.Server = httptest.NewServer(server)
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// validated gives the number of challenge validations done.
+func (s *testACMEServer) validated() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.validations
+}
+
+func (s *testACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+
+	if r.URL.Path == "/directory" {
+		s.reply(w, http.StatusOK, map[string]any{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	var request struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+
+	var header struct {
+		JWK *struct{ Crv, X, Y string } `json:"jwk"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	protected, protectedErr := base64.RawURLEncoding.DecodeString(request.Protected)
+	payload, payloadErr := base64.RawURLEncoding.DecodeString(request.Payload)
+
+	if err := errors.Join(protectedErr, payloadErr, json.Unmarshal(protected, &header)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		if header.JWK == nil {
+			http.Error(w, "missing account key", http.StatusBadRequest)
+			return
+		}
+
+		sum := sha256.Sum256(fmt.Appendf(nil, `{"crv":%q,"kty":"EC","x":%q,"y":%q}`,
+			header.JWK.Crv, header.JWK.X, header.JWK.Y))
+		s.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+
+		w.Header().Set("Location", s.URL+"/account/1")
+		s.reply(w, http.StatusCreated, map[string]any{"status": acme.StatusValid})
+	case "/order":
+		s.token, s.authzStatus, s.chain = rand.Text(), acme.StatusPending, nil
+
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusCreated, s.order())
+	case "/order/1":
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusOK, s.order())
+	case "/authz":
+		s.reply(w, http.StatusOK, s.authorization())
+	case "/challenge":
+		if len(payload) > 0 {
+			s.validate(r.Context())
+		}
+
+		s.reply(w, http.StatusOK, s.authorization()["challenges"].([]any)[0])
+	case "/finalize":
+		if err := s.issue(payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusOK, s.order())
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reply writes the object as JSON.
+func (s *testACMEServer) reply(w http.ResponseWriter, status int, object any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(object)
+}
+
+// order gives the current order, its status follows the one of its authorization.
+func (s *testACMEServer) order() map[string]any {
+	order := map[string]any{
+		"status":         s.authzStatus,
+		"identifiers":    []any{map[string]any{"type": "dns", "value": s.domain}},
+		"authorizations": []any{s.URL + "/authz"},
+		"finalize":       s.URL + "/finalize",
+	}
+
+	switch {
+	case s.chain != nil:
+		order["status"] = acme.StatusValid
+		order["certificate"] = s.URL + "/cert"
+	case s.authzStatus == acme.StatusValid:
+		order["status"] = acme.StatusReady
+	}
+
+	return order
+}
+
+// authorization gives the authorization of the current order with its HTTP-01 challenge.
+func (s *testACMEServer) authorization() map[string]any {
+	return map[string]any{
+		"status":     s.authzStatus,
+		"identifier": map[string]any{"type": "dns", "value": s.domain},
+		"challenges": []any{map[string]any{
+			"type":   "http-01",
+			"url":    s.URL + "/challenge",
+			"token":  s.token,
+			"status": s.authzStatus,
+		}},
+	}
+}
+
+// validate requests the key authorization of the challenge from the plain HTTP server.
+func (s *testACMEServer) validate(ctx context.Context) {
+	s.validations++
+	s.authzStatus = acme.StatusInvalid
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+s.httpAddress+"/.well-known/acme-challenge/"+s.token, nil)
+
+	if err != nil {
+		return
+	}
+
+	request.Host = s.domain
+
+	response, err := http.DefaultTransport.RoundTrip(request)
+
+	if err != nil {
+		return
+	}
+
+	defer func() { _ = response.Body.Close() }()
+
+	body, err := io.ReadAll(response.Body)
+
+	if err == nil && response.StatusCode == http.StatusOK && string(body) == s.token+"."+s.thumbprint {
+		s.authzStatus = acme.StatusValid
+	}
+}
+
+// issue creates the certificate of the request given in the payload of the finalization.
+func (s *testACMEServer) issue(payload []byte) error {
+	var finalization struct {
+		CSR string `json:"csr"`
+	}
+
+	if err := json.Unmarshal(payload, &finalization); err != nil {
+		return err
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(finalization.CSR)
+
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+
+	if err != nil {
+		return err
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, s.authority.cert, csr.PublicKey, s.authority.key)
+
+	if err != nil {
+		return err
+	}
+
+	s.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.authority.cert.Raw})...)
+
+	return nil
+}
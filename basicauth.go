@@ -0,0 +1,295 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/AlphaOne1/midgard"
+	"github.com/AlphaOne1/midgard/defs"
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.yaml.in/yaml/v3"
+)
+
+// configBasicAuthKey is the key in the configuration file holding the list of basic authentication rules.
+const configBasicAuthKey = "basicauth"
+
+// AuthFailuresMetric is the name of the counter of failed authentications, by method and reason.
+const AuthFailuresMetric = "sonicred.auth.failures"
+
+// DefaultAuthRealm is the realm reported to clients, if none is configured.
+const DefaultAuthRealm = "Restricted"
+
+// Reasons of failed authentications, reported in the log and the metric.
+const (
+	AuthFailureMissing   = "missing"
+	AuthFailureInvalid   = "invalid"
+	AuthFailureForbidden = "forbidden"
+)
+
+// ErrInvalidBasicAuth indicates that a basic authentication rule could not be parsed.
+var ErrInvalidBasicAuth = errors.New("invalid basic authentication rule")
+
+// requestedPathKey is the context key of the path as requested by the client, before rewrites and try-files.
+type requestedPathKey struct{}
+
+// resolvedRequestKey is the context key of the request, whose resolved path is checked by the authorizations.
+type resolvedRequestKey struct{}
+
+// basicAuthRule requires the credentials of a user of the htpasswd file for the paths it matches.
+type basicAuthRule struct {
+	matcher  pathMatcher
+	realm    string
+	htpasswd string
+}
+
+// parseBasicAuthConfigs reads the basic authentication rules of the configuration file.
+func parseBasicAuthConfigs(node *yaml.Node, fileName string) ([]basicAuthRule, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a list of basic authentication rules",
+			ErrConfigFile, fileName, node.Line)
+	}
+
+	rules := make([]basicAuthRule, 0, len(node.Content))
+
+	var errs []error
+
+	for _, entry := range node.Content {
+		rule, err := parseBasicAuthConfig(entry)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, entry.Line, err))
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// parseBasicAuthConfig reads a single basic authentication rule of the configuration file. Each rule is a mapping
+// with one path matcher, path or regex, the htpasswd file and optionally the realm.
+func parseBasicAuthConfig(entry *yaml.Node) (basicAuthRule, error) {
+	if entry.Kind != yaml.MappingNode {
+		return basicAuthRule{}, fmt.Errorf("%w: expected a mapping of matcher and htpasswd file", ErrInvalidBasicAuth)
+	}
+
+	rule := basicAuthRule{realm: DefaultAuthRealm}
+
+	var kind, pattern string
+
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		key, value := entry.Content[i], entry.Content[i+1]
+
+		if value.Kind != yaml.ScalarNode {
+			return basicAuthRule{}, fmt.Errorf("%w: expected a single value for %q", ErrInvalidBasicAuth, key.Value)
+		}
+
+		switch key.Value {
+		case HeaderRulePath, HeaderRuleRegex:
+			if len(kind) > 0 {
+				return basicAuthRule{}, fmt.Errorf("%w: expected exactly one matcher of %v or %v",
+					ErrInvalidBasicAuth, HeaderRulePath, HeaderRuleRegex)
+			}
+
+			kind, pattern = key.Value, value.Value
+		case "realm":
+			if strings.ContainsAny(value.Value, "\"\\") || strings.ContainsFunc(value.Value, isControl) {
+				return basicAuthRule{}, fmt.Errorf("%w: realm %q contains quotes or control characters",
+					ErrInvalidBasicAuth, value.Value)
+			}
+
+			rule.realm = value.Value
+		case "htpasswd":
+			rule.htpasswd = value.Value
+		default:
+			return basicAuthRule{}, fmt.Errorf("%w: unknown key %q", ErrInvalidBasicAuth, key.Value)
+		}
+	}
+
+	if len(kind) == 0 || len(rule.htpasswd) == 0 {
+		return basicAuthRule{}, fmt.Errorf("%w: expected one matcher of %v or %v and a htpasswd file",
+			ErrInvalidBasicAuth, HeaderRulePath, HeaderRuleRegex)
+	}
+
+	matcher, err := newPathMatcher(kind, pattern)
+
+	if err != nil {
+		return basicAuthRule{}, fmt.Errorf("%w: %w", ErrInvalidBasicAuth, err)
+	}
+
+	rule.matcher = matcher
+
+	return rule, nil
+}
+
+// isControl checks if the rune is an ASCII control character.
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// authFailureCounter creates the counter of failed authentications. Failures are reported as warning, the
+// counter is then nil.
+func authFailureCounter() metric.Int64Counter {
+	counter, err := otel.Meter(ServerName).Int64Counter(AuthFailuresMetric,
+		metric.WithDescription("Number of failed authentications, by method and reason."),
+		metric.WithUnit("{failure}"))
+
+	if err != nil {
+		slog.Warn("could not create authentication failures metric", slog.String("error", err.Error()))
+		return nil
+	}
+
+	return counter
+}
+
+// reportAuthFailure adds the authentication method and the reason of the failure to the access log and counts
+// it. The details, e.g., the rejected user, are only logged at debug level.
+func reportAuthFailure(ctx context.Context, counter metric.Int64Counter, r *http.Request, method, reason string,
+	attrs ...slog.Attr) {
+
+	ctx = withLogAttrs(ctx, slog.String("auth", method), slog.String("reason", reason))
+
+	attrs = append([]slog.Attr{
+		slog.String("client", r.RemoteAddr),
+		slog.String("target", utils.CutLog(r.URL.Path)),
+	}, attrs...)
+
+	slog.LogAttrs(ctx, slog.LevelDebug, "authentication failed", attrs...)
+
+	if counter != nil {
+		counter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("method", method),
+			attribute.String("reason", reason)))
+	}
+}
+
+// basicAuthentication generates the middleware requiring the credentials of a user of the htpasswd file of the
+// first rule matching the request path. The htpasswd files are read again when they change. The rules match the
+// path as requested by the client and, using pathAuthorization, the one it is resolved to.
+func basicAuthentication(rules []basicAuthRule) (func(http.Handler) http.Handler, error) {
+	files := make(map[string]*htpasswdFile)
+
+	for _, rule := range rules {
+		if _, loaded := files[rule.htpasswd]; loaded {
+			continue
+		}
+
+		file, err := loadHtpasswdFile(rule.htpasswd)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not load htpasswd file %v: %w", rule.htpasswd, err)
+		}
+
+		files[rule.htpasswd] = file
+
+		slog.Info("adding basic authentication",
+			slog.String("matcher", rule.matcher.kind),
+			slog.String("pattern", rule.matcher.pattern),
+			slog.String("realm", rule.realm),
+			slog.Int("users", len(file.users)))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+
+		counter := authFailureCounter()
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var rule *basicAuthRule
+
+			for i := range rules {
+				if rules[i].matcher.matches(r.URL.Path) {
+					rule = &rules[i]
+					break
+				}
+			}
+
+			if rule == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			user, password, found := r.BasicAuth()
+
+			if found && files[rule.htpasswd].authenticate(user, password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reason := AuthFailureMissing
+
+			if found {
+				reason = AuthFailureInvalid
+			}
+
+			reportAuthFailure(r.Context(), counter, r, "basic", reason,
+				slog.String("user", utils.CutLog(user)),
+				slog.String("realm", rule.realm))
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+rule.realm+`", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}, nil
+}
+
+// withBasePath gives the path below the base path as seen by the client, i.e. with the stripped base path added.
+func withBasePath(basePath, urlPath string) string {
+	if strings.HasSuffix(basePath, "/") {
+		return basePath + strings.TrimPrefix(urlPath, "/")
+	}
+
+	return basePath + urlPath
+}
+
+// pathAuthorization stacks the path based authorizations twice. The first middleware checks the path as requested
+// by the client. The second one, placed behind the rewrites and try-files, checks the path they resolved the
+// request to, if it differs, so that rewrites and try-files cannot serve protected paths without credentials. As
+// the base path is stripped at that point, it is added again, so that the rules see the same kind of paths.
+func pathAuthorization(basePath string, authorizations ...defs.Middleware) (defs.Middleware, defs.Middleware) {
+	requested := func(next http.Handler) http.Handler {
+		authorized := midgard.StackMiddlewareHandler(authorizations, next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorized.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestedPathKey{}, r.URL.Path)))
+		})
+	}
+
+	resolved := func(next http.Handler) http.Handler {
+		authorized := midgard.StackMiddlewareHandler(authorizations,
+			http.HandlerFunc(func(w http.ResponseWriter, checked *http.Request) {
+				original, _ := checked.Context().Value(resolvedRequestKey{}).(*http.Request)
+				next.ServeHTTP(w, original.WithContext(checked.Context()))
+			}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestedPath, _ := r.Context().Value(requestedPathKey{}).(string)
+			resolvedPath := withBasePath(basePath, r.URL.Path)
+
+			if resolvedPath == requestedPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			checked := r.Clone(context.WithValue(r.Context(), resolvedRequestKey{}, r))
+			checked.URL.Path, checked.URL.RawPath = resolvedPath, ""
+
+			authorized.ServeHTTP(w, checked)
+		})
+	}
+
+	return requested, resolved
+}
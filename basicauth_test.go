@@ -0,0 +1,275 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestBasicAuthentication(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	var logs bytes.Buffer
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(contextAttrsHandler{slog.NewTextHandler(&logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "internal/build.tar", "team/notes.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	htpasswdDir := t.TempDir()
+	internalFile := filepath.Join(htpasswdDir, "internal")
+	teamFile := filepath.Join(htpasswdDir, "team")
+
+	if err := os.WriteFile(internalFile, []byte("ci:"+testBcryptHash+"\nops:"+testSha512Hash+"\n"),
+		0o600); err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	if err := os.WriteFile(teamFile, []byte("dev:"+testArgon2idHash+"\n"), 0o600); err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+basicauth:
+  - path: /internal/
+    realm: Internal Artefacts
+    htpasswd: %s
+  - regex: ^/team/
+    htpasswd: %s
+`, root, internalFile, teamFile))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	tests := []struct {
+		uri      string
+		user     string
+		password string
+		status   int
+		realm    string
+	}{
+		{uri: "/", status: http.StatusOK},
+		{uri: "/internal/build.tar", status: http.StatusUnauthorized, realm: "Internal Artefacts"},
+		{uri: "/internal/build.tar", user: "ci", password: "secret", status: http.StatusOK},
+		{uri: "/internal/build.tar", user: "ops", password: "secret", status: http.StatusOK},
+		{uri: "/internal/build.tar", user: "ci", password: "wrong", status: http.StatusUnauthorized,
+			realm: "Internal Artefacts"},
+		{uri: "/internal/build.tar", user: "dev", password: testArgon2idValue, status: http.StatusUnauthorized,
+			realm: "Internal Artefacts"},
+		{uri: "/team/notes.txt", user: "dev", password: testArgon2idValue, status: http.StatusOK},
+		{uri: "/team/notes.txt", user: "nobody", password: "secret", status: http.StatusUnauthorized,
+			realm: DefaultAuthRealm},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+
+		if len(test.user) > 0 {
+			req.SetBasicAuth(test.user, test.password)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, test.status, rec.Code, "status of %v for %v", test.uri, test.user)
+
+		if len(test.realm) > 0 {
+			assert.Equal(t, `Basic realm="`+test.realm+`", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"),
+				"challenge of %v for %v", test.uri, test.user)
+		}
+	}
+
+	var data metricdata.ResourceMetrics
+
+	if !assert.NoError(t, reader.Collect(t.Context(), &data), "metrics should be collected") {
+		return
+	}
+
+	counts := make(map[string]int64)
+
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if sum, isSum := m.Data.(metricdata.Sum[int64]); isSum && m.Name == AuthFailuresMetric {
+				for _, point := range sum.DataPoints {
+					reason, _ := point.Attributes.Value(attribute.Key("reason"))
+					counts[reason.AsString()] += point.Value
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]int64{AuthFailureMissing: 1, AuthFailureInvalid: 3}, counts, "failure reasons")
+
+	assert.Contains(t, logs.String(), "user=ci status=401 auth=basic reason=invalid\n", "failure in the access log")
+	assert.Contains(t, logs.String(), "status=401 auth=basic reason=missing\n", "missing credentials in the access log")
+	assert.Contains(t, logs.String(), "user=ci status=200\n", "no failure in the access log of a successful request")
+	assert.NotContains(t, logs.String(), "authentication failed", "details only at debug level")
+}
+
+func TestAuthorizationResolvedPath(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "private/secret.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+
+	if err := os.WriteFile(htpasswd, []byte("ci:"+testBcryptHash+"\n"), 0o600); err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	tests := []struct {
+		stage    string
+		rewrite  string
+		uri      string
+		password string
+		status   int
+	}{
+		{stage: RewriteStageBefore, rewrite: "/site/public/* /site/private/$1", uri: "/site/public/secret.txt",
+			status: http.StatusUnauthorized},
+		{stage: RewriteStageBefore, rewrite: "/site/public/* /site/private/$1", uri: "/site/public/secret.txt",
+			password: "secret", status: http.StatusOK},
+		{stage: RewriteStageAfter, rewrite: "/public/* /private/$1", uri: "/site/public/secret.txt",
+			status: http.StatusUnauthorized},
+		{stage: RewriteStageAfter, rewrite: "/public/* /private/$1", uri: "/site/public/secret.txt",
+			password: "secret", status: http.StatusOK},
+		{stage: RewriteStageAfter, rewrite: "/public/* /private/$1", uri: "/site/secret.txt",
+			status: http.StatusUnauthorized},
+		{stage: RewriteStageAfter, rewrite: "/public/* /private/$1", uri: "/site/secret.txt",
+			password: "secret", status: http.StatusOK},
+		{stage: RewriteStageAfter, rewrite: "/public/* /private/$1", uri: "/site/",
+			status: http.StatusOK},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestAuthorizationResolvedPath-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+base: /site/
+rewritefile: %s
+rewritestage: %s
+tryfile:
+  - $uri
+  - /private$uri
+basicauth:
+  - path: /site/private/
+    htpasswd: %s
+`, root, writeRewriteFile(t, "rewrite path "+test.rewrite+"\n"), test.stage, htpasswd))
+
+			config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+				[]string{"-config", fileName}, nil)
+
+			if !assert.NoError(t, configErr, "configuration should be valid") {
+				return
+			}
+
+			handler, cleanup, handlerErr := generateServerHandler(config)
+
+			if !assert.NoError(t, handlerErr, "handler should be generated") {
+				return
+			}
+
+			defer cleanup()
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+
+			if len(test.password) > 0 {
+				req.SetBasicAuth("ci", test.password)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.status, rec.Code, "status of %v", test.uri)
+		})
+	}
+}
+
+func TestBasicAuthConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rules string
+		line  int
+	}{
+		{rules: "  - path: /a\n", line: 3},
+		{rules: "  - htpasswd: /etc/htpasswd\n", line: 3},
+		{rules: "  - path: /a\n    regex: ^/b\n    htpasswd: /etc/htpasswd\n", line: 3},
+		{rules: "  - regex: \"(\"\n    htpasswd: /etc/htpasswd\n", line: 3},
+		{rules: "  - path: /a\n    htpasswd: /etc/htpasswd\n    realm: 'say \"hi\"'\n", line: 3},
+		{rules: "  - path: /a\n    htpasswd: [/etc/htpasswd]\n", line: 3},
+		{rules: "  - path: /a\n    htpasswd: /etc/htpasswd\n  - path: /b\n    other: x\n", line: 5},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestBasicAuthConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\nbasicauth:\n"+test.rules)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+
+	_, _, err := generateFileHandler(fileHandlerSettings{
+		basePath:  "/",
+		rootPath:  t.TempDir(),
+		basicAuth: []basicAuthRule{{htpasswd: filepath.Join(t.TempDir(), "missing")}},
+	})
+
+	assert.ErrorContains(t, err, "htpasswd", "missing htpasswd file")
+}
@@ -0,0 +1,341 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.yaml.in/yaml/v3"
+)
+
+// configBearerKey is the key in the configuration file holding the bearer token settings.
+const configBearerKey = "bearer"
+
+// BearerClaimAttributePrefix is the prefix of the span attributes holding the logged claims of a bearer token.
+const BearerClaimAttributePrefix = "sonicred.jwt.claim."
+
+// ErrInvalidBearer indicates that the bearer token settings could not be parsed.
+var ErrInvalidBearer = errors.New("invalid bearer settings")
+
+// bearerConfig holds the bearer token settings of a host.
+type bearerConfig struct {
+	validation    jwtValidation
+	jwksFile      string
+	jwksURL       string
+	publicKeyFile string
+	realm         string
+	logClaims     []string
+	allow         []claimProtection
+}
+
+// parseBearerConfig reads the bearer token settings of the configuration file.
+func parseBearerConfig(node *yaml.Node, fileName string) (*bearerConfig, error) {
+	config, err := parseBearerSettings(node)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, node.Line, err)
+	}
+
+	return config, nil
+}
+
+// parseBearerSettings reads the mapping of the bearer token settings.
+func parseBearerSettings(node *yaml.Node) (*bearerConfig, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%w: expected a mapping of settings", ErrInvalidBearer)
+	}
+
+	config := bearerConfig{realm: DefaultAuthRealm}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		var err error
+
+		switch key.Value {
+		case "issuer":
+			config.validation.issuer = value.Value
+		case "audience":
+			config.validation.audiences, err = decodeStringList(value)
+		case "jwksfile":
+			config.jwksFile = value.Value
+		case "jwksurl":
+			config.jwksURL = value.Value
+		case "publickey":
+			config.publicKeyFile = value.Value
+		case "realm":
+			if strings.ContainsAny(value.Value, "\"\\") || strings.ContainsFunc(value.Value, isControl) {
+				err = errors.New("contains quotes or control characters")
+			}
+
+			config.realm = value.Value
+		case "logclaims":
+			config.logClaims, err = decodeStringList(value)
+		case "allow":
+			config.allow, err = parseClaimProtections(value)
+		default:
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidBearer, key.Value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %v: %w", ErrInvalidBearer, key.Value, err)
+		}
+	}
+
+	sources := 0
+
+	for _, source := range []string{config.jwksFile, config.jwksURL, config.publicKeyFile} {
+		if len(source) > 0 {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one of jwksfile, jwksurl or publickey", ErrInvalidBearer)
+	}
+
+	if len(config.allow) == 0 {
+		return nil, fmt.Errorf("%w: expected allowed paths", ErrInvalidBearer)
+	}
+
+	return &config, nil
+}
+
+// readPublicKeyFile reads the public keys of a PEM file, given as public keys or certificates.
+func readPublicKeyFile(name string) (staticKeys, error) {
+	data, err := os.ReadFile(filepath.Clean(name))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key file: %w", err)
+	}
+
+	var keys staticKeys
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key in %v: %w", name, err)
+			}
+
+			keys = append(keys, jwtKey{key: key})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate in %v: %w", name, err)
+			}
+
+			keys = append(keys, jwtKey{key: cert.PublicKey})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key found in %v", name)
+	}
+
+	return keys, nil
+}
+
+// keySource creates the source of the keys verifying the tokens.
+func (c bearerConfig) keySource() (jwtKeySource, error) {
+	switch {
+	case len(c.jwksURL) > 0:
+		return &remoteKeys{url: c.jwksURL, client: &http.Client{Timeout: JWKSRequestTimeout}}, nil
+	case len(c.jwksFile) > 0:
+		data, err := os.ReadFile(filepath.Clean(c.jwksFile))
+
+		if err != nil {
+			return nil, fmt.Errorf("could not read key set file: %w", err)
+		}
+
+		return parseJWKS(data)
+	default:
+		return readPublicKeyFile(c.publicKeyFile)
+	}
+}
+
+// bearerToken gives the token of the Authorization header, if it uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+
+	return token, len(token) > 0
+}
+
+// bearerIdentity is the outcome of the verification of the bearer token of a request.
+type bearerIdentity struct {
+	claims jwtClaims
+	err    error
+}
+
+// bearerIdentityKey is the context key of the function giving the bearer identity of a request. The token is only
+// verified on the first call.
+type bearerIdentityKey struct{}
+
+// protects checks if any of the rules matches the path.
+func (c *bearerConfig) protects(urlPath string) bool {
+	return slices.ContainsFunc(c.allow, func(rule claimProtection) bool { return rule.matcher.matches(urlPath) })
+}
+
+// bearerAuthentication generates the middlewares verifying bearer tokens. The first one verifies the token of the
+// request, if there are claims to log or a rule matches its path, and adds its subject and logged claims to the log
+// records of the request, including the access log, and to its span. Other tokens are only verified if a rule
+// matches the path a request is resolved to. The second one requires a valid token for the allowed paths.
+// A request is accepted, if the claims of the token satisfy one of the rules matching its path. The rules match the
+// path as requested by the client and, using pathAuthorization, the one it is resolved to.
+func bearerAuthentication(config *bearerConfig) (func(http.Handler) http.Handler, func(http.Handler) http.Handler,
+	error) {
+
+	if config == nil {
+		return func(next http.Handler) http.Handler { return next },
+			func(next http.Handler) http.Handler { return next },
+			nil
+	}
+
+	source, err := config.keySource()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidBearer, err)
+	}
+
+	for _, rule := range config.allow {
+		slog.Info("adding bearer token rule",
+			slog.String("matcher", rule.matcher.kind),
+			slog.String("pattern", rule.matcher.pattern),
+			slog.Int("claims", len(rule.claims)))
+	}
+
+	identify := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := bearerToken(r)
+
+			if !found {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			verify := sync.OnceValue(func() bearerIdentity {
+				claims, err := verifyJWT(r.Context(), token, source)
+
+				if err == nil {
+					err = config.validation.check(claims, time.Now())
+				}
+
+				return bearerIdentity{claims: claims, err: err}
+			})
+
+			ctx := context.WithValue(r.Context(), bearerIdentityKey{}, verify)
+
+			// tokens sent to unprotected paths are not verified, so that they cannot be used to load the key source
+			if len(config.logClaims) == 0 && !config.protects(r.URL.Path) {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			identity := verify()
+
+			if identity.err != nil {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			claims := identity.claims
+			attrs := []slog.Attr{slog.String("subject", utils.CutLog(claims.subject()))}
+			spanAttrs := []attribute.KeyValue{attribute.String("enduser.id", claims.subject())}
+
+			for _, name := range config.logClaims {
+				if values := claims.strings(name); len(values) > 0 {
+					attrs = append(attrs, slog.String("claim_"+name, utils.CutLog(strings.Join(values, ","))))
+					spanAttrs = append(spanAttrs, attribute.StringSlice(BearerClaimAttributePrefix+name, values))
+				}
+			}
+
+			trace.SpanFromContext(r.Context()).SetAttributes(spanAttrs...)
+
+			next.ServeHTTP(w, r.WithContext(withLogAttrs(ctx, attrs...)))
+		})
+	}
+
+	authorize := func(next http.Handler) http.Handler {
+		counter := authFailureCounter()
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var rules []claimProtection
+
+			for _, rule := range config.allow {
+				if rule.matcher.matches(r.URL.Path) {
+					rules = append(rules, rule)
+				}
+			}
+
+			if len(rules) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			verify, found := r.Context().Value(bearerIdentityKey{}).(func() bearerIdentity)
+
+			if !found {
+				reportAuthFailure(r.Context(), counter, r, "bearer", AuthFailureMissing)
+
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+config.realm+`"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+				return
+			}
+
+			identity := verify()
+
+			if identity.err != nil {
+				reportAuthFailure(r.Context(), counter, r, "bearer", AuthFailureInvalid,
+					slog.String("error", identity.err.Error()))
+
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+config.realm+`", error="invalid_token"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+				return
+			}
+
+			if !slices.ContainsFunc(rules, func(rule claimProtection) bool {
+				return rule.claims.matches(identity.claims)
+			}) {
+				reportAuthFailure(r.Context(), counter, r, "bearer", AuthFailureForbidden,
+					slog.String("subject", utils.CutLog(identity.claims.subject())))
+
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+config.realm+`", error="insufficient_scope"`)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	return identify, authorize, nil
+}
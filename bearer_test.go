@@ -0,0 +1,296 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestBearerAuthentication(t *testing.T) {
+	t.Parallel()
+
+	keys := testKeys(t)
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "artefacts/web/build.tar", "artefacts/api/build.tar"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+
+	if err := os.WriteFile(jwksFile, testJWKS(t, keys), 0o600); err != nil {
+		t.Fatalf("could not write key set file: %v", err)
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+bearer:
+  issuer: https://tokens.example.com
+  audience: sonicred
+  jwksfile: %s
+  realm: Artefacts
+  allow:
+    - path: /artefacts/web/
+      claims:
+        project: web
+    - path: /artefacts/
+      claims:
+        role: [admin, release]
+`, root, jwksFile))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	token := func(key string, claims map[string]any) string {
+		all := map[string]any{
+			"iss": "https://tokens.example.com",
+			"aud": "sonicred",
+			"sub": "ci",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+
+		for name, value := range claims {
+			all[name] = value
+		}
+
+		return signTestJWT(t, keys[key], key, all)
+	}
+
+	tests := []struct {
+		uri       string
+		token     string
+		status    int
+		challenge string
+	}{
+		{uri: "/", status: http.StatusOK},
+		{uri: "/artefacts/web/build.tar", status: http.StatusUnauthorized, challenge: `Bearer realm="Artefacts"`},
+		{uri: "/artefacts/web/build.tar", token: token("rsa", map[string]any{"project": "web"}),
+			status: http.StatusOK},
+		{uri: "/artefacts/web/build.tar", token: token("ed", map[string]any{"role": "release"}),
+			status: http.StatusOK},
+		{uri: "/artefacts/api/build.tar", token: token("ec", map[string]any{"project": "web"}),
+			status: http.StatusForbidden, challenge: `Bearer realm="Artefacts", error="insufficient_scope"`},
+		{uri: "/artefacts/api/build.tar", token: token("ec", map[string]any{"role": []string{"dev", "admin"}}),
+			status: http.StatusOK},
+		{uri: "/artefacts/web/build.tar", token: token("rsa", map[string]any{"project": "web",
+			"exp": time.Now().Add(-time.Hour).Unix()}), status: http.StatusUnauthorized,
+			challenge: `Bearer realm="Artefacts", error="invalid_token"`},
+		{uri: "/artefacts/web/build.tar", token: token("rsa", map[string]any{"project": "web",
+			"nbf": time.Now().Add(time.Hour).Unix()}), status: http.StatusUnauthorized},
+		{uri: "/artefacts/web/build.tar", token: token("rsa", map[string]any{"project": "web", "aud": "other"}),
+			status: http.StatusUnauthorized},
+		{uri: "/artefacts/web/build.tar", token: token("rsa", map[string]any{"project": "web",
+			"iss": "https://evil.example.com"}), status: http.StatusUnauthorized},
+		{uri: "/artefacts/web/build.tar", token: "not-a-token", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+
+		if len(test.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, test.status, rec.Code, "status of %v with token %v", test.uri, test.token)
+
+		if len(test.challenge) > 0 {
+			assert.Equal(t, test.challenge, rec.Header().Get("WWW-Authenticate"), "challenge of %v", test.uri)
+		}
+	}
+}
+
+func TestBearerIdentity(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(key.Public())
+	keyFile := filepath.Join(t.TempDir(), "token.pem")
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		0o600); err != nil {
+
+		t.Fatalf("could not write public key file: %v", err)
+	}
+
+	allow, _ := newPathMatcher(HeaderRulePath, "/")
+
+	identify, authorize, err := bearerAuthentication(&bearerConfig{
+		publicKeyFile: keyFile,
+		realm:         DefaultAuthRealm,
+		logClaims:     []string{"job", "missing"},
+		allow:         []claimProtection{{matcher: allow}},
+	})
+
+	if !assert.NoError(t, err, "middleware should be created") {
+		return
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	var logAttrs []slog.Attr
+
+	handler := identify(authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logAttrs, _ = r.Context().Value(logAttrsKey{}).([]slog.Attr)
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	ctx, span := tracer.Start(t.Context(), "request")
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/build.tar", nil)
+	req.Header.Set("Authorization", "bearer "+signTestJWT(t, key, "", map[string]any{
+		"sub": "ci",
+		"job": []string{"build", "1234"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	span.End()
+
+	assert.Equal(t, http.StatusNoContent, rec.Code, "status with valid token")
+	assert.Equal(t, []slog.Attr{slog.String("subject", "ci"), slog.String("claim_job", "build,1234")}, logAttrs,
+		"log attributes")
+
+	if !assert.Len(t, recorder.Ended(), 1, "recorded spans") {
+		return
+	}
+
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("enduser.id", "ci"),
+		attribute.StringSlice(BearerClaimAttributePrefix+"job", []string{"build", "1234"}),
+	}, recorder.Ended()[0].Attributes(), "span attributes")
+}
+
+func TestBearerUnprotectedPaths(t *testing.T) {
+	t.Parallel()
+
+	keys := testKeys(t)
+
+	var fetches atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		_, _ = w.Write(testJWKS(t, keys))
+	}))
+	defer server.Close()
+
+	allow, _ := newPathMatcher(HeaderRulePath, "/private/")
+
+	identify, authorize, err := bearerAuthentication(&bearerConfig{
+		jwksURL: server.URL,
+		realm:   DefaultAuthRealm,
+		allow:   []claimProtection{{matcher: allow}},
+	})
+
+	if !assert.NoError(t, err, "middleware should be created") {
+		return
+	}
+
+	handler := identify(authorize(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	request := func(target, kid string) int {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer "+signTestJWT(t, keys["ec"], kid, map[string]any{
+			"sub": "ci",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, request("/public/index.html", "unknown"), "unprotected path")
+	assert.Zero(t, fetches.Load(), "token of unprotected path not verified")
+
+	assert.Equal(t, http.StatusNoContent, request("/private/index.html", "ec"), "protected path")
+	assert.Equal(t, int32(1), fetches.Load(), "token of protected path verified")
+}
+
+func TestBearerConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		settings string
+		line     int
+	}{
+		{settings: "  - jwksfile: /etc/jwks.json\n", line: 3},
+		{settings: "  issuer: https://tokens.example.com\n  allow:\n    - path: /a/\n", line: 3},
+		{settings: "  jwksfile: /etc/jwks.json\n  jwksurl: https://tokens.example.com/jwks\n" +
+			"  allow:\n    - path: /a/\n", line: 3},
+		{settings: "  jwksfile: /etc/jwks.json\n", line: 3},
+		{settings: "  jwksfile: /etc/jwks.json\n  allow:\n    - regex: \"(\"\n", line: 3},
+		{settings: "  jwksfile: /etc/jwks.json\n  realm: 'say \"hi\"'\n  allow:\n    - path: /a/\n", line: 3},
+		{settings: "  jwksfile: /etc/jwks.json\n  other: x\n", line: 3},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestBearerConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\nbearer:\n"+test.settings)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+
+	missingKey := filepath.Join(t.TempDir(), "missing.pem")
+	allow, _ := newPathMatcher(HeaderRulePath, "/")
+
+	_, _, err := bearerAuthentication(&bearerConfig{publicKeyFile: missingKey, allow: []claimProtection{{matcher: allow}}})
+
+	assert.ErrorIs(t, err, ErrInvalidBearer, "missing public key file")
+}
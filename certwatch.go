@@ -0,0 +1,272 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificateCheckInterval is the minimum time between two checks of the certificate, key and client certificate
+// authority files for changes.
+const CertificateCheckInterval = 10 * time.Second
+
+// ErrCertificateExpired indicates a certificate whose validity period has ended.
+var ErrCertificateExpired = errors.New("certificate expired")
+
+// ErrNoCACertificates indicates a client certificate authority file without any certificate.
+var ErrNoCACertificates = errors.New("no certificate in client certificate authority file")
+
+// fileVersion identifies the contents of a file by its size and modification time.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// equal checks if both versions are the same.
+func (v fileVersion) equal(other fileVersion) bool {
+	return v.size == other.size && v.modTime.Equal(other.modTime)
+}
+
+// fileVersions gives the versions of the files.
+func fileVersions(names ...string) ([]fileVersion, error) {
+	versions := make([]fileVersion, 0, len(names))
+
+	for _, name := range names {
+		info, err := os.Stat(name)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not stat %v: %w", name, err)
+		}
+
+		versions = append(versions, fileVersion{size: info.Size(), modTime: info.ModTime()})
+	}
+
+	return versions, nil
+}
+
+// changedFileVersions gives the current versions of the files, if they differ from the known ones.
+func changedFileVersions(known []fileVersion, names ...string) ([]fileVersion, bool) {
+	versions, err := fileVersions(names...)
+
+	if err != nil || slices.EqualFunc(versions, known, fileVersion.equal) {
+		return nil, false
+	}
+
+	return versions, true
+}
+
+// watchedCertificate is a certificate with its key. It is loaded again when one of the files changes, checked at
+// most every CertificateCheckInterval. Invalid or expired replacements are reported, keeping the previous
+// certificate.
+type watchedCertificate struct {
+	pair certKeyPair
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	versions []fileVersion
+	checked  time.Time
+}
+
+// loadWatchedCertificate loads the certificate and key files.
+func loadWatchedCertificate(pair certKeyPair, now time.Time) (*watchedCertificate, error) {
+	c := &watchedCertificate{pair: pair, checked: now}
+
+	versions, err := fileVersions(pair.cert, pair.key)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate %v: %w", pair.cert, err)
+	}
+
+	if err := c.load(versions, now); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads the certificate and key, replacing the current certificate only if the key matches and the
+// replacement is not expired.
+func (c *watchedCertificate) load(versions []fileVersion, now time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.pair.cert, c.pair.key)
+
+	if err != nil {
+		return fmt.Errorf("could not load certificate %v: %w", c.pair.cert, err)
+	}
+
+	// expired certificates are only warned about when starting, see warnCertificateCoverage
+	if c.cert != nil && now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("%w: %v expired at %v", ErrCertificateExpired, c.pair.cert, cert.Leaf.NotAfter)
+	}
+
+	c.cert, c.versions = &cert, versions
+
+	slog.Info("loaded TLS certificate",
+		slog.String("file", c.pair.cert),
+		slog.String("subject", cert.Leaf.Subject.String()),
+		slog.Time("expiry", cert.Leaf.NotAfter))
+
+	return nil
+}
+
+// current gives the current certificate, loading it again if the files changed.
+func (c *watchedCertificate) current(now time.Time) *tls.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now.Sub(c.checked) < CertificateCheckInterval {
+		return c.cert
+	}
+
+	c.checked = now
+
+	if versions, changed := changedFileVersions(c.versions, c.pair.cert, c.pair.key); changed {
+		if err := c.load(versions, now); err != nil {
+			slog.Error("could not reload TLS certificate, keeping previous certificate",
+				slog.String("file", c.pair.cert),
+				slog.String("error", err.Error()))
+		}
+	}
+
+	return c.cert
+}
+
+// certificateStore holds the watched certificates of the server. The first one is the default certificate, used
+// for clients not sending a server name matching any of the certificates.
+type certificateStore []*watchedCertificate
+
+// loadCertificateStore loads the certificate and key files, the first pair giving the default certificate.
+func loadCertificateStore(certs []certKeyPair) (certificateStore, error) {
+	store := make(certificateStore, 0, len(certs))
+	now := time.Now()
+
+	for _, pair := range certs {
+		cert, err := loadWatchedCertificate(pair, now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		store = append(store, cert)
+	}
+
+	return store, nil
+}
+
+// getCertificate selects the certificate for the handshake, to be used as tls.Config.GetCertificate. Certificates
+// naming the server name exactly take precedence over the ones matching it by a wildcard name.
+func (s certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now()
+
+	var fallback, wildcard *tls.Certificate
+
+	for i, watched := range s {
+		cert := watched.current(now)
+
+		if i == 0 {
+			fallback = cert
+		}
+
+		if hello.SupportsCertificate(cert) != nil {
+			continue
+		}
+
+		if len(hello.ServerName) == 0 || slices.ContainsFunc(cert.Leaf.DNSNames, func(name string) bool {
+			return strings.EqualFold(name, hello.ServerName)
+		}) {
+			return cert, nil
+		}
+
+		if wildcard == nil {
+			wildcard = cert
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard, nil
+	}
+
+	return fallback, nil
+}
+
+// loadCertPool reads the client certificate authority files into a new pool.
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Clean(name))
+
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA file: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: %v", ErrNoCACertificates, name)
+		}
+	}
+
+	return pool, nil
+}
+
+// watchedCertPool is the pool of client certificate authorities of a TLS configuration. It is loaded again when
+// one of the files changes, checked at most every CertificateCheckInterval. As the pool of a configuration
+// cannot be changed while it is in use, changed pools are handed out in a copy of the configuration.
+type watchedCertPool struct {
+	files []string
+	base  *tls.Config
+
+	lock     sync.Mutex
+	derived  *tls.Config
+	versions []fileVersion
+	checked  time.Time
+}
+
+// getConfigForClient gives the configuration with the current pool, to be used as tls.Config.GetConfigForClient.
+// As long as the files did not change, no configuration is given, so the base configuration is used.
+func (p *watchedCertPool) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(p.checked) < CertificateCheckInterval {
+		return p.derived, nil
+	}
+
+	p.checked = now
+
+	versions, changed := changedFileVersions(p.versions, p.files...)
+
+	if !changed {
+		return p.derived, nil
+	}
+
+	pool, err := loadCertPool(p.files)
+
+	if err != nil {
+		slog.Error("could not reload client certificate authorities, keeping previous ones",
+			slog.String("error", err.Error()))
+
+		return p.derived, nil
+	}
+
+	derived := p.base.Clone()
+	derived.ClientCAs = pool
+	derived.GetConfigForClient = nil
+
+	p.derived, p.versions = derived, versions
+
+	slog.Info("reloaded client certificate authorities", slog.Any("files", p.files))
+
+	return p.derived, nil
+}
@@ -0,0 +1,230 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testServerCertificate is the PEM encoded certificate and key of a server.
+type testServerCertificate struct {
+	cert []byte
+	key  []byte
+}
+
+// newTestServerCertificate creates a self-signed certificate for the DNS names, valid until notAfter.
+func newTestServerCertificate(t *testing.T, notAfter time.Time, dnsNames ...string) testServerCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	return testServerCertificate{
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestFile writes the file with the given modification time.
+func writeTestFile(t *testing.T, fileName string, data []byte, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(fileName, data, 0o600); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+		t.Fatalf("could not change file time: %v", err)
+	}
+}
+
+func TestWatchedCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	pair := certKeyPair{cert: filepath.Join(dir, "cert.pem"), key: filepath.Join(dir, "key.pem")}
+	otherPair := certKeyPair{cert: filepath.Join(dir, "other.pem"), key: filepath.Join(dir, "otherkey.pem")}
+
+	first := newTestServerCertificate(t, time.Now().Add(time.Hour), "www.example.com")
+	other := newTestServerCertificate(t, time.Now().Add(time.Hour), "api.example.com")
+
+	writeTestFile(t, pair.cert, first.cert, time.Now())
+	writeTestFile(t, pair.key, first.key, time.Now())
+	writeTestFile(t, otherPair.cert, other.cert, time.Now())
+	writeTestFile(t, otherPair.key, other.key, time.Now())
+
+	defaultStore, err := loadCertificateStore([]certKeyPair{pair, otherPair})
+
+	if !assert.NoError(t, err, "certificates should be loaded") {
+		return
+	}
+
+	fallback, err := createCertificateConfig(defaultStore).GetCertificate(
+		&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+
+	if assert.NoError(t, err, "certificate should be selected") {
+		assert.Equal(t, "www.example.com", fallback.Leaf.Subject.CommonName, "first certificate as fallback")
+	}
+
+	var store certificateStore
+
+	for _, p := range []certKeyPair{pair, otherPair} {
+		watched, err := loadWatchedCertificate(p, time.Now())
+
+		if !assert.NoError(t, err, "certificate should be loaded") {
+			return
+		}
+
+		store = append(store, watched)
+	}
+
+	namesOf := func(serverName string) []string {
+		cert, err := store.getCertificate(&tls.ClientHelloInfo{
+			ServerName:        serverName,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+
+		if err != nil || cert == nil {
+			return nil
+		}
+
+		return cert.Leaf.DNSNames
+	}
+
+	assert.Equal(t, []string{"www.example.com"}, namesOf("www.example.com"), "certificate of matching server name")
+	assert.Equal(t, []string{"api.example.com"}, namesOf("api.example.com"), "certificate of matching server name")
+
+	changeFiles := func(cert, key []byte, modTime time.Time) {
+		writeTestFile(t, pair.cert, cert, modTime)
+		writeTestFile(t, pair.key, key, modTime)
+
+		// force the check of the next handshake
+		store[0].checked = time.Time{}
+	}
+
+	renewed := newTestServerCertificate(t, time.Now().Add(2*time.Hour), "www.example.com", "example.com")
+	changeFiles(renewed.cert, renewed.key, time.Now().Add(time.Minute))
+
+	assert.Equal(t, []string{"www.example.com", "example.com"}, namesOf("example.com"),
+		"renewed certificate with added name")
+
+	changeFiles(first.cert, renewed.key, time.Now().Add(2*time.Minute))
+
+	assert.Equal(t, []string{"www.example.com", "example.com"}, namesOf("example.com"),
+		"renewed certificate kept for mismatching key")
+
+	expired := newTestServerCertificate(t, time.Now().Add(-time.Minute), "www.example.com")
+	changeFiles(expired.cert, expired.key, time.Now().Add(3*time.Minute))
+
+	assert.Equal(t, []string{"www.example.com", "example.com"}, namesOf("example.com"),
+		"renewed certificate kept for expired certificate")
+
+	_, err = loadCertificateStore([]certKeyPair{{cert: pair.cert, key: otherPair.key}})
+	assert.Error(t, err, "mismatching key should be rejected")
+}
+
+func TestWatchedCertPool(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+	newAuthority := newTestCertAuthority(t, "New Client CA")
+
+	caFile := authority.writePEM(t)
+	oldCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "old"}})
+	newCert := newAuthority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "new"}})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+
+	if !assert.NoError(t, configureClientCAs(server.TLS, []string{caFile}, ClientAuthRequire),
+		"client certificate authorities should be configured") {
+
+		return
+	}
+
+	watched := &watchedCertPool{files: []string{caFile}}
+	server.TLS.GetConfigForClient = watched.getConfigForClient
+
+	server.StartTLS()
+	defer server.Close()
+
+	// the server uses a copy of the configuration holding its certificate
+	watched.base = server.TLS
+
+	accepted := func(cert tls.Certificate) bool {
+		transport, _ := server.Client().Transport.(*http.Transport)
+		transport = transport.Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		req, _ := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+
+		if err != nil {
+			return false
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.StatusCode == http.StatusNoContent
+	}
+
+	assert.True(t, accepted(oldCert), "certificate of the initial authority")
+	assert.False(t, accepted(newCert), "certificate of the new authority before the change")
+
+	data, _ := os.ReadFile(newAuthority.writePEM(t))
+	writeTestFile(t, caFile, data, time.Now().Add(time.Minute))
+	watched.checked = time.Time{}
+
+	assert.False(t, accepted(oldCert), "certificate of the replaced authority")
+	assert.True(t, accepted(newCert), "certificate of the new authority after the change")
+
+	writeTestFile(t, caFile, []byte("invalid"), time.Now().Add(2*time.Minute))
+	watched.checked = time.Time{}
+
+	assert.True(t, accepted(newCert), "previous authorities kept for invalid file")
+
+	_, err := loadCertPool([]string{caFile})
+	assert.ErrorIs(t, err, ErrNoCACertificates, "file without certificates")
+}
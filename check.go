@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// CheckCommand is the subcommand that checks the configuration and exits, an alternative to -checkconfig.
+const CheckCommand = "check"
+
+// configReportOption is the effective value of a single option together with its source.
+type configReportOption struct {
+	Value  any         `json:"value"`
+	Source ValueSource `json:"source"`
+}
+
+// configReport is the result of the configuration check, as printed in check mode.
+type configReport struct {
+	Valid    bool                          `json:"valid"`
+	Errors   []string                      `json:"errors,omitempty"`
+	Options  map[string]configReportOption `json:"options"`
+	Sections map[string]any                `json:"sections,omitempty"`
+}
+
+// reportSection converts a section of the configuration file into plain values for the report. The values of
+// secret options, also inside of virtual hosts, are redacted.
+func reportSection(node *yaml.Node) any {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+
+		return reportSection(node.Content[0])
+	case yaml.AliasNode:
+		return reportSection(node.Alias)
+	case yaml.MappingNode:
+		result := make(map[string]any, len(node.Content)/2)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+
+			if slices.Contains(secretOptions, key) && len(value.Value) > 0 {
+				result[key] = RedactedValue
+				continue
+			}
+
+			result[key] = reportSection(value)
+		}
+
+		return result
+	case yaml.SequenceNode:
+		result := make([]any, 0, len(node.Content))
+
+		for _, item := range node.Content {
+			result = append(result, reportSection(item))
+		}
+
+		return result
+	}
+
+	var value any
+
+	if err := node.Decode(&value); err != nil {
+		return node.Value
+	}
+
+	return value
+}
+
+// flattenErrors splits joined errors into their single messages.
+func flattenErrors(err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	if joined, isJoined := err.(interface{ Unwrap() []error }); isJoined { //nolint:errorlint // just unpacking
+		var result []string
+
+		for _, e := range joined.Unwrap() {
+			result = append(result, flattenErrors(e)...)
+		}
+
+		return result
+	}
+
+	return []string{err.Error()}
+}
+
+// checkConfig performs all preparations that run does up to binding the sockets. This includes the consistency
+// check, loading of the TLS certificates, keys and client CAs, parsing the header files, compiling the WAF
+// directives and opening the root directory. The report, containing all found errors and the effective
+// configuration including the sections of the configuration file, is written to out as JSON. It returns the
+// desired process exit code.
+func checkConfig(config ServerConfig, out io.Writer) int {
+	var errs []error
+
+	// the check report goes to out, so the log must not
+	if err := setupLogging(os.Stderr, config.LogLevel, config.LogStyle); err != nil {
+		slog.Warn("could not set up logging, using defaults", slog.String("error", err.Error()))
+	}
+
+	errs = append(errs, checkConfigConsistency(config))
+
+	if config.usesMainHost() {
+		if _, statErr := os.Stat(config.RootPath); statErr != nil {
+			errs = append(errs, fmt.Errorf("could not get info of root path (%v): %w", config.source("root"), statErr))
+		}
+	}
+
+	if _, tlsErr := generateServerTLSConfig(config, nil); tlsErr != nil {
+		errs = append(errs, fmt.Errorf("invalid TLS configuration: %w", tlsErr))
+	}
+
+	_, handlerCleanup, handlerErr := generateServerHandler(config)
+	handlerCleanup()
+
+	if handlerErr != nil {
+		errs = append(errs, fmt.Errorf("could not generate file handlers: %w", handlerErr))
+	}
+
+	report := configReport{
+		Errors:  flattenErrors(errors.Join(errs...)),
+		Options: make(map[string]configReportOption, len(config.Values)),
+	}
+	report.Valid = len(report.Errors) == 0
+
+	for name := range config.Values {
+		report.Options[name] = configReportOption{Value: config.reportedValue(name), Source: config.source(name)}
+	}
+
+	if len(config.Sections) > 0 {
+		report.Sections = make(map[string]any, len(config.Sections))
+
+		for name, section := range config.Sections {
+			report.Sections[name] = reportSection(section)
+		}
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(report); err != nil {
+		slog.Error("could not write configuration report", slog.String("error", err.Error()))
+		return 1
+	}
+
+	if !report.Valid {
+		slog.Error("configuration is invalid", slog.Int("errors", len(report.Errors)))
+		return 1
+	}
+
+	slog.Info("configuration is valid")
+
+	return 0
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		args     []string
+		exitCode int
+		errors   int
+	}{
+		{args: []string{"-root", "testroot", "-header", "X-Test: 1"}, exitCode: 0, errors: 0},
+		{args: []string{"-root", "/noexist", "-wafcfg", "/noexist", "-base", "x"}, exitCode: 1, errors: 3},
+		{args: []string{"-root", "testroot", "-tlscert", "/noexist", "-tlskey", "/noexist"}, exitCode: 1, errors: 1},
+		{args: []string{"-root", "testroot", "-headerfile", "/noexist"}, exitCode: 1, errors: 1},
+	}
+
+	for _, test := range tests {
+		config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), test.args, nil)
+
+		if !assert.NoError(t, err, "arguments should be parsable") {
+			continue
+		}
+
+		out := bytes.Buffer{}
+
+		assert.Equal(t, test.exitCode, checkConfig(config, &out), "exit code for %v", test.args)
+
+		var report configReport
+
+		if !assert.NoError(t, json.Unmarshal(out.Bytes(), &report), "report should be JSON") {
+			continue
+		}
+
+		assert.Equal(t, test.exitCode == 0, report.Valid, "validity for %v", test.args)
+		assert.Len(t, report.Errors, test.errors, "errors for %v: %v", test.args, report.Errors)
+		assert.Equal(t, "flag", report.Options["root"].Source.Kind, "source of root")
+		assert.Equal(t, true, report.Options["index"].Value, "value of index for %v", test.args)
+	}
+}
+
+func TestCheckConfigSecrets(t *testing.T) {
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-root", "testroot", "-acmeeabkid", "kid-1", "-acmeeabkey", "c2VjcmV0LWhtYWMta2V5"}, nil)
+
+	if !assert.NoError(t, err, "arguments should be parsable") {
+		return
+	}
+
+	out := bytes.Buffer{}
+	checkConfig(config, &out)
+
+	assert.NotContains(t, out.String(), "c2VjcmV0LWhtYWMta2V5", "secret in report")
+
+	var report configReport
+
+	if assert.NoError(t, json.Unmarshal(out.Bytes(), &report), "report should be JSON") {
+		assert.Equal(t, RedactedValue, report.Options["acmeeabkey"].Value, "value of secret option")
+		assert.Equal(t, "kid-1", report.Options["acmeeabkid"].Value, "value of other option")
+		assert.Empty(t, report.Options["acmeeabkeyfile"].Value, "unset option")
+	}
+}
+
+func TestCheckConfigSections(t *testing.T) {
+	fileName := writeConfigFile(t, `version: 1
+root: testroot
+acmeeabkid: kid-1
+acmeeabkey: c2VjcmV0LWhtYWMta2V5
+hosts:
+  - names: [a.example.com, www.a.example.com]
+    root: testroot
+    index: false
+headerrules:
+  - path: /assets/
+    header:
+      - "Cache-Control: max-age=3600"
+`)
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	out := bytes.Buffer{}
+	checkConfig(config, &out)
+
+	assert.NotContains(t, out.String(), "c2VjcmV0LWhtYWMta2V5", "secret in report")
+
+	var report configReport
+
+	if !assert.NoError(t, json.Unmarshal(out.Bytes(), &report), "report should be JSON") {
+		return
+	}
+
+	assert.Equal(t, []any{map[string]any{
+		"names": []any{"a.example.com", "www.a.example.com"},
+		"root":  "testroot",
+		"index": false,
+	}}, report.Sections[configHostsKey], "hosts section")
+	assert.Equal(t, []any{map[string]any{
+		"path":   "/assets/",
+		"header": []any{"Cache-Control: max-age=3600"},
+	}}, report.Sections[configHeaderRulesKey], "header rules section")
+	assert.NotContains(t, report.Sections, "acmeeabkey", "options not reported as sections")
+	assert.Equal(t, RedactedValue, reportSection(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "acmeeabkey"},
+		{Kind: yaml.ScalarNode, Value: "c2VjcmV0LWhtYWMta2V5"},
+	}}).(map[string]any)["acmeeabkey"], "secret option in section redacted")
+}
@@ -0,0 +1,329 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.yaml.in/yaml/v3"
+)
+
+// configClientCertsKey is the key in the configuration file holding the list of client certificate rules.
+const configClientCertsKey = "clientcerts"
+
+// Modes of requesting client certificates, selected by the -clientauth option.
+const (
+	ClientAuthRequest       = "request"
+	ClientAuthVerifyIfGiven = "verify-if-given"
+	ClientAuthRequire       = "require"
+)
+
+// clientAuthModes maps the client authentication modes to their TLS counterparts. Only in the request mode,
+// certificates are accepted without verification.
+var clientAuthModes = map[string]tls.ClientAuthType{
+	ClientAuthRequest:       tls.RequestClientCert,
+	ClientAuthVerifyIfGiven: tls.VerifyClientCertIfGiven,
+	ClientAuthRequire:       tls.RequireAndVerifyClientCert,
+}
+
+// ErrInvalidClientAuth indicates an unknown client authentication mode.
+var ErrInvalidClientAuth = errors.New("invalid client authentication mode")
+
+// ErrClientCertsWithoutCA indicates that client certificate rules are configured, but no client certificate
+// authority to verify the certificates.
+var ErrClientCertsWithoutCA = errors.New("client certificate rules require a client certificate authority")
+
+// ErrInvalidClientCertRule indicates that a client certificate rule could not be parsed.
+var ErrInvalidClientCertRule = errors.New("invalid client certificate rule")
+
+// clientIdentity is the identity given by the certificate of a client.
+type clientIdentity struct {
+	subject  string
+	sans     []string
+	spiffeID string
+	verified bool
+}
+
+// name gives the identity for the log and the response header, that is the SPIFFE ID, if given, or the subject.
+func (c clientIdentity) name() string {
+	if len(c.spiffeID) > 0 {
+		return c.spiffeID
+	}
+
+	return c.subject
+}
+
+// clientIdentityOf gives the identity of the client certificate of the connection, if the client sent one. The
+// identity is only verified, if the certificate chains to one of the client certificate authorities.
+func clientIdentityOf(state *tls.ConnectionState) (clientIdentity, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return clientIdentity{}, false
+	}
+
+	cert := state.PeerCertificates[0]
+
+	identity := clientIdentity{
+		subject:  cert.Subject.String(),
+		verified: len(state.VerifiedChains) > 0,
+	}
+
+	identity.sans = append(identity.sans, cert.DNSNames...)
+	identity.sans = append(identity.sans, cert.EmailAddresses...)
+
+	for _, ip := range cert.IPAddresses {
+		identity.sans = append(identity.sans, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		identity.sans = append(identity.sans, uri.String())
+
+		if uri.Scheme == "spiffe" && len(identity.spiffeID) == 0 {
+			identity.spiffeID = uri.String()
+		}
+	}
+
+	return identity, true
+}
+
+// clientCertRule allows clients whose certificate matches one of the subjects, SANs or SPIFFE IDs to access the
+// paths it matches. The identities are given as glob patterns.
+type clientCertRule struct {
+	matcher   pathMatcher
+	subjects  []string
+	sans      []string
+	spiffeIDs []string
+}
+
+// parseClientCertRuleConfigs reads the client certificate rules of the configuration file.
+func parseClientCertRuleConfigs(node *yaml.Node, fileName string) ([]clientCertRule, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a list of client certificate rules",
+			ErrConfigFile, fileName, node.Line)
+	}
+
+	rules := make([]clientCertRule, 0, len(node.Content))
+
+	var errs []error
+
+	for _, entry := range node.Content {
+		rule, err := parseClientCertRuleConfig(entry)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, entry.Line, err))
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// parseClientCertRuleConfig reads a single client certificate rule of the configuration file. Each rule is a
+// mapping with one path matcher, path or regex, and at least one of subject, san or spiffe, each a single
+// pattern or a list of patterns.
+func parseClientCertRuleConfig(entry *yaml.Node) (clientCertRule, error) {
+	if entry.Kind != yaml.MappingNode {
+		return clientCertRule{}, fmt.Errorf("%w: expected a mapping of matcher and identities",
+			ErrInvalidClientCertRule)
+	}
+
+	var rule clientCertRule
+	var kind, pattern string
+
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		key, value := entry.Content[i], entry.Content[i+1]
+
+		var err error
+
+		switch key.Value {
+		case HeaderRulePath, HeaderRuleRegex:
+			if len(kind) > 0 || value.Kind != yaml.ScalarNode {
+				return clientCertRule{}, fmt.Errorf("%w: expected exactly one matcher of %v or %v",
+					ErrInvalidClientCertRule, HeaderRulePath, HeaderRuleRegex)
+			}
+
+			kind, pattern = key.Value, value.Value
+		case "subject":
+			rule.subjects, err = decodeStringList(value)
+		case "san":
+			rule.sans, err = decodeStringList(value)
+		case "spiffe":
+			rule.spiffeIDs, err = decodeStringList(value)
+		default:
+			return clientCertRule{}, fmt.Errorf("%w: unknown key %q", ErrInvalidClientCertRule, key.Value)
+		}
+
+		if err != nil {
+			return clientCertRule{}, fmt.Errorf("%w: invalid %v: %w", ErrInvalidClientCertRule, key.Value, err)
+		}
+	}
+
+	if len(kind) == 0 || len(rule.subjects)+len(rule.sans)+len(rule.spiffeIDs) == 0 {
+		return clientCertRule{}, fmt.Errorf("%w: expected one matcher of %v or %v and a subject, san or spiffe",
+			ErrInvalidClientCertRule, HeaderRulePath, HeaderRuleRegex)
+	}
+
+	for _, identityPattern := range slices.Concat(rule.subjects, rule.sans, rule.spiffeIDs) {
+		if _, err := path.Match(identityPattern, ""); err != nil {
+			return clientCertRule{}, fmt.Errorf("%w: invalid pattern %q: %w",
+				ErrInvalidClientCertRule, identityPattern, err)
+		}
+	}
+
+	matcher, err := newPathMatcher(kind, pattern)
+
+	if err != nil {
+		return clientCertRule{}, fmt.Errorf("%w: %w", ErrInvalidClientCertRule, err)
+	}
+
+	rule.matcher = matcher
+
+	return rule, nil
+}
+
+// matchesAny checks if one of the values matches one of the glob patterns.
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matchIdentity(pattern, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchIdentity checks if the value matches the glob pattern. A `*` does not match a slash, it stands for a part
+// of one path segment. A pattern ending in `/**` matches all values with at least one further segment, e.g.,
+// nested SPIFFE IDs.
+func matchIdentity(pattern, value string) bool {
+	prefix, nested := strings.CutSuffix(pattern, "/**")
+
+	if !nested {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	}
+
+	segments := strings.Count(prefix, "/") + 1
+	parts := strings.SplitN(value, "/", segments+1)
+
+	if len(parts) <= segments || len(parts[segments]) == 0 {
+		return false
+	}
+
+	matched, _ := path.Match(prefix, strings.Join(parts[:segments], "/"))
+
+	return matched
+}
+
+// allows checks if the rule allows the client identity. Unverified identities are never allowed.
+func (c clientCertRule) allows(identity clientIdentity) bool {
+	return identity.verified &&
+		(matchesAny(c.subjects, identity.subject) ||
+			matchesAny(c.sans, identity.sans...) ||
+			(len(identity.spiffeID) > 0 && matchesAny(c.spiffeIDs, identity.spiffeID)))
+}
+
+// exposeClientIdentity generates the middleware adding the identity of the client certificate to the log records
+// of the request, including the access log, and to its span. If the header is given, verified identities are
+// also sent in this response header.
+func exposeClientIdentity(header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, found := clientIdentityOf(r.TLS)
+
+			if !found {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			spanAttrs := []attribute.KeyValue{
+				attribute.String("tls.client.subject", identity.subject),
+				attribute.Bool("sonicred.client.verified", identity.verified),
+			}
+
+			if identity.verified {
+				spanAttrs = append(spanAttrs, attribute.String("enduser.id", identity.name()))
+
+				if len(header) > 0 {
+					w.Header().Set(header, identity.name())
+				}
+			}
+
+			trace.SpanFromContext(r.Context()).SetAttributes(spanAttrs...)
+
+			next.ServeHTTP(w, r.WithContext(withLogAttrs(r.Context(),
+				slog.String("client_cert", utils.CutLog(identity.name())),
+				slog.Bool("client_cert_verified", identity.verified))))
+		})
+	}
+}
+
+// clientCertAuthorization generates the middleware requiring a verified client certificate allowed by one of the
+// rules matching the request path. The rules match the path as requested by the client and, using
+// pathAuthorization, the one it is resolved to.
+func clientCertAuthorization(rules []clientCertRule) func(http.Handler) http.Handler {
+	for _, rule := range rules {
+		slog.Info("adding client certificate rule",
+			slog.String("matcher", rule.matcher.kind),
+			slog.String("pattern", rule.matcher.pattern),
+			slog.Int("identities", len(rule.subjects)+len(rule.sans)+len(rule.spiffeIDs)))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+
+		counter := authFailureCounter()
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			matched := false
+
+			for _, rule := range rules {
+				if !rule.matcher.matches(r.URL.Path) {
+					continue
+				}
+
+				matched = true
+
+				if identity, found := clientIdentityOf(r.TLS); found && rule.allows(identity) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if !matched {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, found := clientIdentityOf(r.TLS)
+
+			switch {
+			case !found:
+				reportAuthFailure(r.Context(), counter, r, "mtls", AuthFailureMissing)
+			case !identity.verified:
+				reportAuthFailure(r.Context(), counter, r, "mtls", AuthFailureInvalid)
+			default:
+				reportAuthFailure(r.Context(), counter, r, "mtls", AuthFailureForbidden)
+			}
+
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+}
@@ -0,0 +1,323 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertAuthority is a certificate authority issuing client certificates for tests.
+type testCertAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertAuthority creates a new self-signed certificate authority.
+func newTestCertAuthority(t *testing.T, name string) testCertAuthority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return testCertAuthority{cert: cert, key: key}
+}
+
+// writePEM writes the certificate of the authority to a file and gives its name.
+func (a testCertAuthority) writePEM(t *testing.T) string {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), "ca.pem")
+
+	if err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw}),
+		0o600); err != nil {
+
+		t.Fatalf("could not write certificate: %v", err)
+	}
+
+	return fileName
+}
+
+// issue creates a client certificate using the template for the subject and the SANs.
+func (a testCertAuthority) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, key.Public(), a.key)
+
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificates(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+	otherAuthority := newTestCertAuthority(t, "Other CA")
+	caFile := authority.writePEM(t)
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "internal/build.tar", "mesh/status.json"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	spiffeID, _ := url.Parse("spiffe://example.com/ci/build")
+
+	ciCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ci",
+		Organization: []string{"Example"}}})
+	meshCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mesh"},
+		URIs: []*url.URL{spiffeID}})
+	hostCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "runner"},
+		DNSNames: []string{"runner1.build.example.com"}})
+	otherCert := otherAuthority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ci",
+		Organization: []string{"Example"}}})
+
+	tests := []struct {
+		mode   string
+		cert   *tls.Certificate
+		uri    string
+		status int
+		header string
+	}{
+		{mode: ClientAuthVerifyIfGiven, uri: "/", status: http.StatusOK},
+		{mode: ClientAuthVerifyIfGiven, uri: "/internal/build.tar", status: http.StatusForbidden},
+		{mode: ClientAuthVerifyIfGiven, cert: &ciCert, uri: "/internal/build.tar", status: http.StatusOK,
+			header: "CN=ci,O=Example"},
+		{mode: ClientAuthVerifyIfGiven, cert: &hostCert, uri: "/internal/build.tar", status: http.StatusOK,
+			header: "CN=runner"},
+		{mode: ClientAuthVerifyIfGiven, cert: &meshCert, uri: "/internal/build.tar", status: http.StatusForbidden,
+			header: "spiffe://example.com/ci/build"},
+		{mode: ClientAuthVerifyIfGiven, cert: &meshCert, uri: "/mesh/status.json", status: http.StatusOK,
+			header: "spiffe://example.com/ci/build"},
+		{mode: ClientAuthRequest, cert: &otherCert, uri: "/", status: http.StatusOK},
+		{mode: ClientAuthRequest, cert: &otherCert, uri: "/internal/build.tar", status: http.StatusForbidden},
+		{mode: ClientAuthRequest, cert: &ciCert, uri: "/internal/build.tar", status: http.StatusForbidden},
+		{mode: ClientAuthRequire, uri: "/"},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestClientCertificates-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+clientca: %s
+clientauth: %s
+clientidheader: X-Client-Identity
+clientcerts:
+  - path: /internal/
+    subject: CN=ci,O=Example
+    san: "*.build.example.com"
+  - path: /mesh/
+    spiffe: spiffe://example.com/ci/*
+`, root, caFile, test.mode))
+
+			config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+				[]string{"-config", fileName}, nil)
+
+			if !assert.NoError(t, err, "configuration should be valid") ||
+				!assert.NoError(t, checkConfigConsistency(config), "configuration should be consistent") {
+
+				return
+			}
+
+			handler, cleanup, err := generateServerHandler(config)
+
+			if !assert.NoError(t, err, "handler should be generated") {
+				return
+			}
+
+			defer cleanup()
+
+			server := httptest.NewUnstartedServer(handler)
+			server.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+
+			if !assert.NoError(t, configureClientCAs(server.TLS, *config.ClientCAs, config.ClientAuth),
+				"client certificate authorities should be configured") {
+
+				return
+			}
+
+			server.StartTLS()
+			defer server.Close()
+
+			client := server.Client()
+			transport, _ := client.Transport.(*http.Transport)
+
+			if test.cert != nil {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{*test.cert}
+			}
+
+			req, _ := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL+test.uri, nil)
+			resp, err := client.Do(req)
+
+			if test.status == 0 {
+				assert.Error(t, err, "handshake without certificate should fail")
+				return
+			}
+
+			if !assert.NoError(t, err, "request should succeed") {
+				return
+			}
+
+			_ = resp.Body.Close()
+
+			assert.Equal(t, test.status, resp.StatusCode, "status of %v", test.uri)
+			assert.Equal(t, test.header, resp.Header.Get("X-Client-Identity"), "identity header of %v", test.uri)
+		})
+	}
+}
+
+func TestMatchIdentity(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{pattern: "spiffe://example.com/ci/*", value: "spiffe://example.com/ci/build", want: true},
+		{pattern: "spiffe://example.com/ci/*", value: "spiffe://example.com/ci/build/linux", want: false},
+		{pattern: "spiffe://example.com/ci/**", value: "spiffe://example.com/ci/build", want: true},
+		{pattern: "spiffe://example.com/ci/**", value: "spiffe://example.com/ci/build/linux", want: true},
+		{pattern: "spiffe://example.com/ci/**", value: "spiffe://example.com/ci", want: false},
+		{pattern: "spiffe://example.com/ci/**", value: "spiffe://example.com/ci/", want: false},
+		{pattern: "spiffe://example.com/ci/**", value: "spiffe://example.com/cd/build/linux", want: false},
+		{pattern: "spiffe://*.example.com/**", value: "spiffe://mesh.example.com/ci/build", want: true},
+		{pattern: "*.build.example.com", value: "runner1.build.example.com", want: true},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestMatchIdentity-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, matchIdentity(test.pattern, test.value),
+				"match of %v against %v", test.value, test.pattern)
+		})
+	}
+}
+
+func TestClientCertificatesConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rules string
+		line  int
+	}{
+		{rules: "  - path: /a/\n", line: 3},
+		{rules: "  - subject: CN=ci\n", line: 3},
+		{rules: "  - path: /a/\n    regex: ^/b\n    subject: CN=ci\n", line: 3},
+		{rules: "  - regex: \"(\"\n    subject: CN=ci\n", line: 3},
+		{rules: "  - path: /a/\n    san: \"[\"\n", line: 3},
+		{rules: "  - path: /a/\n    subject: CN=ci\n  - path: /b/\n    other: x\n", line: 5},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestClientCertificatesConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\nclientcerts:\n"+test.rules)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nclientauth: always\n"+
+		"clientcerts:\n  - path: /a/\n    subject: CN=ci\n")
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrInvalidClientAuth, "expected invalid client authentication mode")
+	assert.ErrorIs(t, checkErr, ErrClientCertsWithoutCA, "expected missing client certificate authority")
+	assert.ErrorContains(t, checkErr, fileName+":3", "expected location of client authentication mode")
+}
+
+func TestContextLogAttrs(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	logger := slog.New(contextAttrsHandler{slog.NewTextHandler(&buf, nil)}).With(slog.String("component", "test"))
+
+	ctx := withLogAttrs(t.Context(), slog.String("client_cert", "CN=ci"))
+	ctx = withLogAttrs(ctx, slog.Bool("client_cert_verified", true))
+
+	logger.InfoContext(ctx, "access")
+	logger.InfoContext(t.Context(), "other")
+
+	assert.Contains(t, buf.String(), `msg=access component=test client_cert="CN=ci" client_cert_verified=true`,
+		"attributes of the context")
+	assert.Contains(t, buf.String(), "msg=other component=test\n", "no attributes without context")
+}
@@ -0,0 +1,401 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/AlphaOne1/sonicred/utils"
+)
+
+// MaxCompressSize is the maximum size of a response that is compressed on the fly. Larger responses are sent
+// uncompressed, to limit the memory used for buffering.
+const MaxCompressSize = 8 << 20
+
+// defaultCompressTypes are the media types compressed on the fly, if none are configured.
+var defaultCompressTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// compressors lists the content encodings available for on-the-fly compression, in the order of server
+// preference, together with the function creating their encoder.
+var compressors = []struct {
+	encoding  string
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}{
+	{
+		encoding: "br",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+		},
+	},
+	{
+		encoding: "zstd",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+	{
+		encoding: "gzip",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+}
+
+// compressionSettings holds the configuration of the on-the-fly compression.
+type compressionSettings struct {
+	enabled   bool
+	minSize   int
+	types     []string
+	cacheSize int64
+}
+
+// compressionSettings gives the on-the-fly compression configuration.
+func (c ServerConfig) compressionSettings() compressionSettings {
+	return compressionSettings{
+		enabled:   c.Compress,
+		minSize:   c.CompressMinSize,
+		types:     *c.CompressTypes,
+		cacheSize: int64(c.CompressCacheSize) << 20,
+	}
+}
+
+// compressibleType checks if the given content type is to be compressed. Configured types ending in a slash
+// match all subtypes.
+func (s compressionSettings) compressibleType(contentType string) bool {
+	if len(s.types) == 0 {
+		return matchMediaType(contentType, defaultCompressTypes)
+	}
+
+	return matchMediaType(contentType, s.types)
+}
+
+// compress encodes the data using the given content encoding.
+func compress(encoding string, data []byte) ([]byte, error) {
+	for _, c := range compressors {
+		if c.encoding != encoding {
+			continue
+		}
+
+		var buf bytes.Buffer
+
+		writer, writerErr := c.newWriter(&buf)
+
+		if writerErr != nil {
+			return nil, fmt.Errorf("could not create %v encoder: %w", encoding, writerErr)
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return nil, fmt.Errorf("could not compress using %v: %w", encoding, err)
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("could not finish compression using %v: %w", encoding, err)
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported encoding %v", ErrConversion, encoding)
+}
+
+// compressionCacheKey identifies a compressed variant of a file.
+type compressionCacheKey struct {
+	path     string
+	modTime  int64
+	encoding string
+}
+
+// compressionCacheEntry is a compressed variant of a file.
+type compressionCacheEntry struct {
+	key         compressionCacheKey
+	contentType string
+	data        []byte
+}
+
+// compressionCache holds compressed variants of files in memory. If the total size exceeds its limit, the least
+// recently used entries are evicted.
+type compressionCache struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[compressionCacheKey]*list.Element
+	order   *list.List
+}
+
+// newCompressionCache creates a new compression cache with the given size limit in bytes.
+func newCompressionCache(maxSize int64) *compressionCache {
+	return &compressionCache{
+		maxSize: maxSize,
+		entries: make(map[compressionCacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get looks up the compressed variant with the given key and marks it as recently used.
+func (c *compressionCache) get(key compressionCacheKey) (*compressionCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[key]
+
+	if !found {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+
+	entry, _ := element.Value.(*compressionCacheEntry)
+
+	return entry, true
+}
+
+// add stores the compressed variant, evicting the least recently used entries as needed. Entries larger than
+// the whole cache are not stored.
+func (c *compressionCache) add(entry *compressionCacheEntry) {
+	size := int64(len(entry.data))
+
+	if size > c.maxSize {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.entries[entry.key]; found {
+		return
+	}
+
+	for c.size+size > c.maxSize {
+		oldest := c.order.Back()
+		oldestEntry, _ := oldest.Value.(*compressionCacheEntry)
+
+		c.order.Remove(oldest)
+		delete(c.entries, oldestEntry.key)
+		c.size -= int64(len(oldestEntry.data))
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += size
+}
+
+// compressingWriter buffers compressible responses to compress them once they are complete.
+// All other responses are passed through unchanged.
+type compressingWriter struct {
+	http.ResponseWriter
+
+	settings  compressionSettings
+	encoding  string
+	status    int
+	decided   bool
+	buffering bool
+	buffer    bytes.Buffer
+}
+
+// Unwrap gives the underlying response writer.
+func (cw *compressingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// WriteHeader decides if the response is compressed. Compressed responses are buffered, their header is written
+// only after the compression.
+func (cw *compressingWriter) WriteHeader(status int) {
+	if cw.decided {
+		return
+	}
+
+	cw.decided = true
+	cw.status = status
+
+	header := cw.Header()
+
+	// ranges are served from the uncompressed file, whose full response would have been compressed
+	ranged := status == http.StatusPartialContent
+
+	compressible := (status == http.StatusOK || ranged) &&
+		header.Get("Content-Encoding") == "" &&
+		cw.settings.compressibleType(header.Get("Content-Type"))
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < cw.settings.minSize &&
+		!ranged {
+
+		compressible = false
+	}
+
+	if compressible {
+		addVary(header, "Accept-Encoding")
+	}
+
+	if compressible && !ranged && len(cw.encoding) > 0 {
+		cw.buffering = true
+		return
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers the data of compressed responses and passes all other data through. If a compressed response
+// grows too large, it is sent uncompressed.
+func (cw *compressingWriter) Write(data []byte) (int, error) {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.buffering {
+		n, err := cw.ResponseWriter.Write(data)
+
+		if err != nil {
+			return n, fmt.Errorf("could not write response: %w", err)
+		}
+
+		return n, nil
+	}
+
+	cw.buffer.Write(data)
+
+	if cw.buffer.Len() > MaxCompressSize {
+		cw.buffering = false
+
+		cw.ResponseWriter.WriteHeader(cw.status)
+
+		if _, err := cw.ResponseWriter.Write(cw.buffer.Bytes()); err != nil {
+			return len(data), fmt.Errorf("could not write response: %w", err)
+		}
+
+		cw.buffer = bytes.Buffer{}
+	}
+
+	return len(data), nil
+}
+
+// finish compresses and sends a buffered response. It gives the compressed data, if the response was compressed.
+func (cw *compressingWriter) finish(modTime time.Time, withETag bool) []byte {
+	if !cw.buffering {
+		return nil
+	}
+
+	header := cw.Header()
+	data := cw.buffer.Bytes()
+
+	var compressed []byte
+
+	if len(data) >= cw.settings.minSize {
+		var compressErr error
+
+		if compressed, compressErr = compress(cw.encoding, data); compressErr != nil {
+			slog.Error("could not compress response", slog.String("error", compressErr.Error()))
+			compressed = nil
+		}
+	}
+
+	if compressed != nil {
+		data = compressed
+
+		header.Set("Content-Encoding", cw.encoding)
+
+		if withETag {
+			header.Set("ETag", variantETag(modTime, int64(len(data)), cw.encoding))
+		}
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if _, err := cw.ResponseWriter.Write(data); err != nil {
+		slog.Error("could not send response", slog.String("error", err.Error()))
+	}
+
+	return compressed
+}
+
+// serveCompressedEntry serves a cached compressed variant, including the handling of conditional requests.
+func serveCompressedEntry(w http.ResponseWriter, r *http.Request, entry *compressionCacheEntry) {
+	modTime := time.Unix(0, entry.key.modTime)
+
+	addVary(w.Header(), "Accept-Encoding")
+	w.Header().Set("Content-Type", entry.contentType)
+	w.Header().Set("Content-Encoding", entry.key.encoding)
+	w.Header().Set("ETag", variantETag(modTime, int64(len(entry.data)), entry.key.encoding))
+
+	http.ServeContent(w, r, entry.key.path, modTime, bytes.NewReader(entry.data))
+}
+
+// compressResponses compresses responses of compressible media types on the fly, if the client accepts it.
+// Compressed variants of files are cached, keyed by their path, modification time and encoding.
+func compressResponses(fileSystem fs.StatFS, settings compressionSettings) func(http.Handler) http.Handler {
+	cache := newCompressionCache(settings.cacheSize)
+	available := make([]string, 0, len(compressors))
+
+	for _, c := range compressors {
+		available = append(available, c.encoding)
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !settings.enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), available)
+			name, info, isFile := requestedFile(fileSystem, r.URL.Path)
+
+			var key compressionCacheKey
+
+			if isFile {
+				key = compressionCacheKey{path: name, modTime: info.ModTime().UnixNano(), encoding: encoding}
+
+				// ranges always refer to the uncompressed file, whether its compressed variant is cached or not
+				if entry, found := cache.get(key); found && len(r.Header.Get("Range")) == 0 {
+					slog.Debug("serving cached compressed file",
+						slog.String("path", utils.CutLog(name)),
+						slog.String("encoding", encoding))
+
+					serveCompressedEntry(w, r, entry)
+
+					return
+				}
+			}
+
+			cw := &compressingWriter{ResponseWriter: w, settings: settings, encoding: encoding}
+
+			next.ServeHTTP(cw, r)
+
+			// only files with a known modification time are cached, directory listings are compressed each time
+			compressed := cw.finish(time.Unix(0, key.modTime), isFile)
+
+			if compressed != nil && isFile {
+				cache.add(&compressionCacheEntry{
+					key:         key,
+					contentType: cw.Header().Get("Content-Type"),
+					data:        compressed,
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionCache(t *testing.T) {
+	t.Parallel()
+
+	cache := newCompressionCache(10)
+
+	entry := func(path string, size int) *compressionCacheEntry {
+		return &compressionCacheEntry{
+			key:  compressionCacheKey{path: path, encoding: "gzip"},
+			data: make([]byte, size),
+		}
+	}
+
+	cache.add(entry("a", 4))
+	cache.add(entry("b", 4))
+
+	_, found := cache.get(compressionCacheKey{path: "a", encoding: "gzip"})
+	assert.True(t, found, "entry a cached")
+
+	cache.add(entry("c", 4))
+
+	_, found = cache.get(compressionCacheKey{path: "b", encoding: "gzip"})
+	assert.False(t, found, "least recently used entry b evicted")
+
+	_, found = cache.get(compressionCacheKey{path: "a", encoding: "gzip"})
+	assert.True(t, found, "recently used entry a kept")
+
+	cache.add(entry("d", 11))
+
+	_, found = cache.get(compressionCacheKey{path: "d", encoding: "gzip"})
+	assert.False(t, found, "entry larger than the cache not stored")
+	assert.Equal(t, int64(8), cache.size, "cache size")
+}
+
+func TestCompressResponses(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	content := strings.Repeat("compressible content ", 100)
+
+	files := map[string]string{
+		"app.js":    content,
+		"small.txt": "small",
+		"image.png": content,
+	}
+
+	for name, fileContent := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(fileContent), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0o700); err != nil {
+		t.Fatalf("could not create test directory: %v", err)
+	}
+
+	handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+		basePath:     "/",
+		rootPath:     root,
+		indexEnabled: true,
+		compression:  compressionSettings{enabled: true, minSize: 100, cacheSize: 1 << 20},
+	})
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	request := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, uri, nil)
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	gunzip := func(data []byte) string {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+
+		if err != nil {
+			return ""
+		}
+
+		result, _ := io.ReadAll(reader)
+
+		return string(result)
+	}
+
+	for i := range 2 {
+		rec := request("/app.js", map[string]string{"Accept-Encoding": "gzip"})
+
+		assert.Equal(t, http.StatusOK, rec.Code, "status of request %d", i)
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "encoding of request %d", i)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "vary of request %d", i)
+		assert.Contains(t, rec.Header().Get("Content-Type"), "javascript", "content type of request %d", i)
+		assert.NotEmpty(t, rec.Header().Get("ETag"), "entity tag of request %d", i)
+		assert.Equal(t, content, gunzip(rec.Body.Bytes()), "content of request %d", i)
+	}
+
+	for _, name := range []string{"cached", "uncached"} {
+		if name == "uncached" {
+			// a new modification time invalidates the cached variant
+			modTime := time.Now().Add(time.Minute)
+
+			if err := os.Chtimes(filepath.Join(root, "app.js"), modTime, modTime); err != nil {
+				t.Fatalf("could not change modification time: %v", err)
+			}
+		}
+
+		rec := request("/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-1"})
+
+		assert.Equal(t, http.StatusPartialContent, rec.Code, "range request on %v variant", name)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), "range request on %v variant not compressed", name)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "vary of range request on %v variant", name)
+		assert.Equal(t, content[:2], rec.Body.String(), "range of uncompressed file on %v variant", name)
+	}
+
+	rec := request("/app.js", nil)
+
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "no encoding without Accept-Encoding")
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "vary without Accept-Encoding")
+	assert.Equal(t, content, rec.Body.String(), "uncompressed content")
+
+	rec = request("/small.txt", map[string]string{"Accept-Encoding": "gzip"})
+
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "small files are not compressed")
+
+	rec = request("/image.png", map[string]string{"Accept-Encoding": "gzip"})
+
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "non-compressible types are not compressed")
+
+	rec = request("/dir/?lang=en", map[string]string{"Accept-Encoding": "gzip"})
+
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "directory listing compressed")
+	assert.Contains(t, gunzip(rec.Body.Bytes()), "<html", "directory listing content")
+}
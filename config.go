@@ -0,0 +1,392 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// ConfigFileVersion is the version of the configuration file format understood by this SonicRed build.
+const ConfigFileVersion = 1
+
+// configVersionKey is the key in the configuration file holding its format version.
+const configVersionKey = "version"
+
+// EnvPrefix is the prefix of all environment variables that configure SonicRed.
+const EnvPrefix = "SONICRED_"
+
+// Kinds of sources a configuration value can originate from, in ascending order of precedence.
+const (
+	SourceDefault     = "default"
+	SourceFile        = "file"
+	SourceEnvironment = "environment"
+	SourceFlag        = "flag"
+)
+
+// ErrConfigFile indicates that the configuration file could not be processed.
+var ErrConfigFile = errors.New("invalid configuration file")
+
+// ErrConfigEnvironment indicates that an environment variable holds an invalid value.
+var ErrConfigEnvironment = errors.New("invalid configuration environment variable")
+
+// configSectionKeys lists the keys of the configuration file that hold structured sections instead of options.
+var configSectionKeys = []string{
+	configHeaderRulesKey, configCorsKey, configBasicAuthKey, configClientCertsKey, configOIDCKey, configBearerKey,
+	configHostsKey,
+}
+
+// configFileExcludedFlags lists the flags that make no sense inside a configuration file.
+var configFileExcludedFlags = []string{"checkconfig", "config", "help", "version"}
+
+// configEnvExcludedFlags lists the flags that are not bound to environment variables, as they would keep the
+// server from starting and their variable names are too likely to be set for other purposes, e.g.
+// SONICRED_VERSION in container builds.
+var configEnvExcludedFlags = []string{"checkconfig", "help", "version"}
+
+// ValueSource describes where the effective value of a configuration option originates from.
+type ValueSource struct {
+	Kind     string `json:"kind"`
+	Location string `json:"location,omitempty"`
+}
+
+// String gives a human-readable representation of the source, e.g. "file sonicred.yaml:12".
+func (v ValueSource) String() string {
+	if len(v.Location) == 0 {
+		return v.Kind
+	}
+
+	return v.Kind + " " + v.Location
+}
+
+// isListFlag reports if the given flag accepts multiple values.
+func isListFlag(f *flag.Flag) bool {
+	_, isList := f.Value.(*MultiStringValue)
+
+	return isList
+}
+
+// flagSources collects the sources of all flags in the flag set. Flags given on the command line are
+// marked as such, all others are reported as default.
+func flagSources(flagSet *flag.FlagSet) map[string]ValueSource {
+	sources := make(map[string]ValueSource)
+
+	flagSet.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = ValueSource{Kind: SourceDefault}
+	})
+
+	flagSet.Visit(func(f *flag.Flag) {
+		sources[f.Name] = ValueSource{Kind: SourceFlag, Location: "-" + f.Name}
+	})
+
+	return sources
+}
+
+// envName gives the name of the environment variable bound to the flag with the given name,
+// e.g. SONICRED_TRACE_ENDPOINT for trace-endpoint.
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// lookupEnv searches the environment for the variable with the given name.
+func lookupEnv(environ []string, name string) (string, bool) {
+	for _, entry := range environ {
+		if key, value, _ := strings.Cut(entry, "="); key == name {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// envListValues collects the values of a list option from the environment. Besides the plain variable,
+// e.g. SONICRED_HEADER, numbered variables like SONICRED_HEADER_1, SONICRED_HEADER_2, ... are considered.
+// They are returned in numerical order, after the value of the plain variable.
+func envListValues(name string, environ []string) ([]string, []string) {
+	type indexedValue struct {
+		index int
+		name  string
+		value string
+	}
+
+	var found []indexedValue
+
+	for _, entry := range environ {
+		key, value, _ := strings.Cut(entry, "=")
+
+		if key == name {
+			found = append(found, indexedValue{index: -1, name: key, value: value})
+			continue
+		}
+
+		suffix, hasPrefix := strings.CutPrefix(key, name+"_")
+
+		if !hasPrefix {
+			continue
+		}
+
+		if index, err := strconv.Atoi(suffix); err == nil && index >= 0 {
+			found = append(found, indexedValue{index: index, name: key, value: value})
+		}
+	}
+
+	slices.SortStableFunc(found, func(a, b indexedValue) int {
+		return a.index - b.index
+	})
+
+	names := make([]string, 0, len(found))
+	values := make([]string, 0, len(found))
+
+	for _, f := range found {
+		names = append(names, f.name)
+		values = append(values, f.value)
+	}
+
+	return names, values
+}
+
+// applyEnvironment sets all options in the flag set that have a corresponding SONICRED_ environment variable.
+// Values of options that were already set by a source of higher precedence are left untouched.
+func applyEnvironment(flagSet *flag.FlagSet, environ []string, sources map[string]ValueSource) error {
+	var errs []error
+
+	flagSet.VisitAll(func(target *flag.Flag) {
+		if slices.Contains(configEnvExcludedFlags, target.Name) || sources[target.Name].Kind != SourceDefault {
+			return
+		}
+
+		name := envName(target.Name)
+		names, values := envListValues(name, environ)
+
+		// numbered variables are only meaningful for lists
+		if !isListFlag(target) {
+			names, values = nil, nil
+
+			if value, isSet := lookupEnv(environ, name); isSet {
+				names, values = []string{name}, []string{value}
+			}
+		}
+
+		if len(names) == 0 {
+			return
+		}
+
+		for i, value := range values {
+			if err := target.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%w: invalid value %q in %s: %w",
+					ErrConfigEnvironment, value, names[i], err))
+
+				return
+			}
+		}
+
+		sources[target.Name] = ValueSource{Kind: SourceEnvironment, Location: strings.Join(names, ",")}
+	})
+
+	return errors.Join(errs...)
+}
+
+// optionValues gives the effective values of all options of the flag set, keyed by the flag name.
+// Lists are given as string slices, boolean options as bool and all others as string.
+func optionValues(flagSet *flag.FlagSet) map[string]any {
+	values := make(map[string]any)
+
+	flagSet.VisitAll(func(f *flag.Flag) {
+		switch v := f.Value.(type) {
+		case *MultiStringValue:
+			values[f.Name] = slices.Clone([]string(*v))
+		case interface{ IsBoolFlag() bool }:
+			values[f.Name] = f.Value.String() == "true"
+		default:
+			values[f.Name] = v.String()
+		}
+	})
+
+	return values
+}
+
+// logConfigSources reports the effective value of each option together with its source. Options that keep their
+// default values are only reported on debug level.
+func logConfigSources(config ServerConfig) {
+	names := make([]string, 0, len(config.Values))
+
+	for name := range config.Values {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		source := config.source(name)
+		level := slog.LevelInfo
+
+		if source.Kind == SourceDefault {
+			level = slog.LevelDebug
+		}
+
+		slog.Log(context.Background(), level, "configuration option",
+			slog.String("name", name),
+			slog.Any("value", config.reportedValue(name)),
+			slog.String("source", source.String()))
+	}
+}
+
+// applyConfigFile reads the YAML configuration file and sets all values found therein in the flag set.
+// The keys of the file are the names of the flags. Lists are given as YAML sequences. Values of options
+// that were already set by a source of higher precedence are left untouched. The sections of the file
+// that do not correspond to flags, like the virtual hosts, are returned keyed by their name.
+func applyConfigFile(
+	flagSet *flag.FlagSet,
+	fileName string,
+	sources map[string]ValueSource) (map[string]*yaml.Node, error) {
+
+	content, readErr := os.ReadFile(filepath.Clean(fileName))
+
+	if readErr != nil {
+		return nil, fmt.Errorf("could not read configuration file: %w", readErr)
+	}
+
+	var document yaml.Node
+
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrConfigFile, fileName, err)
+	}
+
+	sections := make(map[string]*yaml.Node)
+
+	// an empty file is a valid configuration
+	if len(document.Content) == 0 {
+		return sections, nil
+	}
+
+	root := document.Content[0]
+
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a mapping of option names to values",
+			ErrConfigFile, fileName, root.Line)
+	}
+
+	if err := checkConfigFileVersion(root, fileName); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+
+	seen := make(map[string]bool)
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if seen[key.Value] {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: duplicate key %q", ErrConfigFile, fileName, key.Line, key.Value))
+			continue
+		}
+
+		seen[key.Value] = true
+
+		switch {
+		case key.Value == configVersionKey:
+			continue
+		case slices.Contains(configSectionKeys, key.Value):
+			sections[key.Value] = value
+			continue
+		case slices.Contains(configFileExcludedFlags, key.Value):
+			// reported as unknown option below, regardless of the sources
+		case flagSet.Lookup(key.Value) != nil && sources[key.Value].Kind != SourceDefault:
+			// already set by a source of higher precedence
+			continue
+		}
+
+		if err := applyConfigFileValue(flagSet, fileName, key, value, sources); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return sections, errors.Join(errs...)
+}
+
+// checkConfigFileVersion verifies that the configuration file states a format version this build understands.
+func checkConfigFileVersion(root *yaml.Node, fileName string) error {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != configVersionKey {
+			continue
+		}
+
+		var version int
+
+		if err := root.Content[i+1].Decode(&version); err != nil || version != ConfigFileVersion {
+			return fmt.Errorf("%w: %s:%d: unsupported version %q, expected %d",
+				ErrConfigFile, fileName, root.Content[i+1].Line, root.Content[i+1].Value, ConfigFileVersion)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s: missing %q key", ErrConfigFile, fileName, configVersionKey)
+}
+
+// applyConfigFileValue sets the flag named by key to the given value node. Lists given in the file replace
+// the current content of the list.
+func applyConfigFileValue(
+	flagSet *flag.FlagSet,
+	fileName string,
+	key *yaml.Node,
+	value *yaml.Node,
+	sources map[string]ValueSource) error {
+
+	target := flagSet.Lookup(key.Value)
+
+	if target == nil || slices.Contains(configFileExcludedFlags, key.Value) {
+		return fmt.Errorf("%w: %s:%d: unknown option %q", ErrConfigFile, fileName, key.Line, key.Value)
+	}
+
+	location := fmt.Sprintf("%s:%d", fileName, key.Line)
+
+	var values []*yaml.Node
+
+	switch value.Kind {
+	case yaml.ScalarNode:
+		values = []*yaml.Node{value}
+	case yaml.SequenceNode:
+		if !isListFlag(target) {
+			return fmt.Errorf("%w: %s:%d: option %q does not accept multiple values",
+				ErrConfigFile, fileName, value.Line, key.Value)
+		}
+
+		values = value.Content
+	default:
+		return fmt.Errorf("%w: %s:%d: option %q expects a value or a list of values",
+			ErrConfigFile, fileName, value.Line, key.Value)
+	}
+
+	if list, isList := target.Value.(*MultiStringValue); isList {
+		*list = nil
+	}
+
+	for _, v := range values {
+		if v.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%w: %s:%d: option %q expects plain values",
+				ErrConfigFile, fileName, v.Line, key.Value)
+		}
+
+		if err := target.Value.Set(v.Value); err != nil {
+			return fmt.Errorf("%w: %s:%d: invalid value %q for option %q: %w",
+				ErrConfigFile, fileName, v.Line, v.Value, key.Value, err)
+		}
+	}
+
+	sources[target.Name] = ValueSource{Kind: SourceFile, Location: location}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), "sonicred.yaml")
+
+	if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write configuration file: %v", err)
+	}
+
+	return fileName
+}
+
+func TestParseConfigFile(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, `version: 1
+root: testroot
+port: 9090
+index: false
+header:
+  - "X-Test: a"
+  - "X-Other: b"
+tryfile:
+  - $uri
+`)
+
+	config, err := parseConfig(
+		flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-config", fileName, "-port", "8888"},
+		nil)
+
+	if !assert.NoError(t, err, "configuration should be valid") {
+		return
+	}
+
+	assert.Equal(t, "testroot", config.RootPath, "root from file")
+	assert.Equal(t, "8888", config.ListenPort, "flag takes precedence over file")
+	assert.False(t, config.IndexEnabled, "index from file")
+	assert.Equal(t, MultiStringValue{"X-Test: a", "X-Other: b"}, *config.Headers, "headers from file")
+	assert.Equal(t, MultiStringValue{"$uri"}, *config.TryFiles, "tryfiles from file")
+	assert.Equal(t, "/", config.BasePath, "base untouched")
+
+	assert.Equal(t, ValueSource{Kind: SourceFile, Location: fileName + ":2"}, config.source("root"))
+	assert.Equal(t, ValueSource{Kind: SourceFlag, Location: "-port"}, config.source("port"))
+	assert.Equal(t, ValueSource{Kind: SourceDefault}, config.source("base"))
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		content string
+		line    int
+	}{
+		{content: "root: testroot\n", line: 0},
+		{content: "version: 2\nroot: testroot\n", line: 1},
+		{content: "version: 1\nunknown: value\n", line: 2},
+		{content: "version: 1\nversion: 1\n", line: 2},
+		{content: "version: 1\nroot:\n  - a\n  - b\n", line: 3},
+		{content: "version: 1\n\nindex: maybe\n", line: 3},
+		{content: "version: 1\nconfig: other.yaml\n", line: 2},
+		{content: "- root\n", line: 1},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestParseConfigFileErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, test.content)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			if test.line == 0 {
+				// a missing version has no line to point to
+				assert.Error(t, err, "expected configuration error")
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+}
+
+func TestCheckConfigConsistencySource(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nbase: noslash\n")
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.True(t, errors.Is(checkErr, ErrInvalidBasePath), "expected invalid base path")
+	assert.ErrorContains(t, checkErr, fileName+":3", "expected location of base path")
+}
+
+func TestParseConfigEnvironment(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, "version: 1\nroot: fileroot\nbase: /file/\nheader:\n  - \"X-File: a\"\n")
+
+	config, err := parseConfig(
+		flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-base", "/flag/"},
+		[]string{
+			"SONICRED_CONFIG=" + fileName,
+			"SONICRED_ROOT=envroot",
+			"SONICRED_BASE=/env/",
+			"SONICRED_HEADER_2=X-Env-2: b",
+			"SONICRED_HEADER_10=X-Env-10: c",
+			"SONICRED_HEADER=X-Env: a",
+			"SONICRED_PORT_1=1234",
+			"SONICRED_TRACE_ENDPOINT=localhost:4318",
+			"SONICRED_VERSION=1.2.3",
+		})
+
+	if !assert.NoError(t, err, "configuration should be valid") {
+		return
+	}
+
+	assert.Equal(t, fileName, config.ConfigFile, "config file from environment")
+	assert.Equal(t, "envroot", config.RootPath, "environment takes precedence over file")
+	assert.Equal(t, "/flag/", config.BasePath, "flag takes precedence over environment")
+	assert.Equal(t,
+		MultiStringValue{"X-Env: a", "X-Env-2: b", "X-Env-10: c"},
+		*config.Headers,
+		"environment list replaces file list, ordered numerically")
+	assert.Equal(t, "8080", config.ListenPort, "numbered variables only apply to lists")
+	assert.Equal(t, "localhost:4318", config.TraceEndpoint, "dashes are mapped to underscores")
+	assert.False(t, config.PrintVersion, "version is not bound to the environment")
+
+	assert.Equal(t,
+		ValueSource{Kind: SourceEnvironment, Location: "SONICRED_ROOT"},
+		config.source("root"))
+	assert.Equal(t,
+		ValueSource{Kind: SourceEnvironment, Location: "SONICRED_HEADER,SONICRED_HEADER_2,SONICRED_HEADER_10"},
+		config.source("header"))
+	assert.Equal(t, "/flag/", config.Values["base"], "effective value reported")
+}
+
+func TestParseConfigEnvironmentError(t *testing.T) {
+	t.Parallel()
+
+	_, err := parseConfig(
+		flag.NewFlagSet("test", flag.ContinueOnError),
+		nil,
+		[]string{"SONICRED_INDEX=maybe"})
+
+	assert.ErrorIs(t, err, ErrConfigEnvironment, "expected environment error")
+	assert.ErrorContains(t, err, "SONICRED_INDEX", "expected variable name in error")
+}
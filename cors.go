@@ -0,0 +1,349 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// configCorsKey is the key in the configuration file holding the list of CORS policies.
+const configCorsKey = "cors"
+
+// corsAnyValue allows any origin or request header in a CORS policy.
+const corsAnyValue = "*"
+
+// ErrInvalidCorsPolicy indicates that a CORS policy could not be parsed.
+var ErrInvalidCorsPolicy = errors.New("invalid cors policy")
+
+// corsDefaultMethods are the methods allowed by a CORS policy, if none are configured.
+var corsDefaultMethods = []string{http.MethodGet, http.MethodHead}
+
+// corsMethodRegex matches valid HTTP method names.
+var corsMethodRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// corsOrigin matches the origins allowed by a CORS policy. Origins are given exactly, as glob pattern, e.g.,
+// https://*.example.com, or as regular expression prefixed by a tilde.
+type corsOrigin struct {
+	pattern string
+	regex   *regexp.Regexp
+}
+
+// newCorsOrigin creates the matcher of an allowed origin.
+func newCorsOrigin(pattern string) (corsOrigin, error) {
+	if expr, isRegex := strings.CutPrefix(pattern, "~"); isRegex {
+		regex, err := regexp.Compile(expr)
+
+		if err != nil {
+			return corsOrigin{}, fmt.Errorf("%w: invalid origin expression %q: %w", ErrInvalidCorsPolicy, expr, err)
+		}
+
+		return corsOrigin{pattern: pattern, regex: regex}, nil
+	}
+
+	pattern = strings.ToLower(pattern)
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return corsOrigin{}, fmt.Errorf("%w: invalid origin pattern %q: %w", ErrInvalidCorsPolicy, pattern, err)
+	}
+
+	return corsOrigin{pattern: pattern}, nil
+}
+
+// matches checks if the origin is allowed.
+func (o corsOrigin) matches(origin string) bool {
+	if o.regex != nil {
+		return o.regex.MatchString(origin)
+	}
+
+	if o.pattern == corsAnyValue {
+		return true
+	}
+
+	matched, _ := path.Match(o.pattern, strings.ToLower(origin))
+
+	return matched
+}
+
+// corsPolicy defines the cross-origin requests allowed for the paths it matches.
+type corsPolicy struct {
+	matcher       pathMatcher
+	origins       []corsOrigin
+	methods       []string
+	headers       []string
+	exposeHeaders []string
+	credentials   bool
+	maxAge        time.Duration
+}
+
+// allowsOrigin checks if the policy allows requests from the origin.
+func (c corsPolicy) allowsOrigin(origin string) bool {
+	return slices.ContainsFunc(c.origins, func(o corsOrigin) bool { return o.matches(origin) })
+}
+
+// allowsAnyOrigin checks if the policy allows all origins, so that the responses do not depend on the origin.
+func (c corsPolicy) allowsAnyOrigin() bool {
+	return slices.ContainsFunc(c.origins, func(o corsOrigin) bool { return o.pattern == corsAnyValue })
+}
+
+// allowsHeaders checks if the policy allows all the headers of an Access-Control-Request-Headers list.
+func (c corsPolicy) allowsHeaders(requested []string) bool {
+	if slices.Contains(c.headers, corsAnyValue) {
+		return true
+	}
+
+	for _, h := range requested {
+		if !slices.ContainsFunc(c.headers, func(allowed string) bool { return strings.EqualFold(allowed, h) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseCorsPolicyConfigs reads the CORS policies of the configuration file.
+func parseCorsPolicyConfigs(node *yaml.Node, fileName string) ([]corsPolicy, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a list of cors policies", ErrConfigFile, fileName, node.Line)
+	}
+
+	policies := make([]corsPolicy, 0, len(node.Content))
+
+	var errs []error
+
+	for _, entry := range node.Content {
+		policy, err := parseCorsPolicyConfig(entry)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, entry.Line, err))
+			continue
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, errors.Join(errs...)
+}
+
+// parseCorsPolicyConfig reads a single CORS policy entry of the configuration file. Each policy is a mapping with
+// one path matcher, path or regex, the allowed origins and optionally the allowed methods and headers, the
+// exposed headers, if credentials are allowed and how long preflight results may be cached.
+func parseCorsPolicyConfig(entry *yaml.Node) (corsPolicy, error) {
+	if entry.Kind != yaml.MappingNode {
+		return corsPolicy{}, fmt.Errorf("%w: expected a mapping of matcher and policy", ErrInvalidCorsPolicy)
+	}
+
+	policy := corsPolicy{methods: corsDefaultMethods}
+
+	var kind, pattern string
+
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		key, value := entry.Content[i], entry.Content[i+1]
+
+		var err error
+
+		switch key.Value {
+		case HeaderRulePath, HeaderRuleRegex:
+			if len(kind) > 0 || value.Kind != yaml.ScalarNode {
+				return corsPolicy{}, fmt.Errorf("%w: expected exactly one matcher of %v or %v",
+					ErrInvalidCorsPolicy, HeaderRulePath, HeaderRuleRegex)
+			}
+
+			kind, pattern = key.Value, value.Value
+		case "origin":
+			var origins []string
+
+			if origins, err = decodeStringList(value); err == nil {
+				for _, o := range origins {
+					origin, originErr := newCorsOrigin(o)
+
+					if originErr != nil {
+						return corsPolicy{}, originErr
+					}
+
+					policy.origins = append(policy.origins, origin)
+				}
+			}
+		case "method":
+			if policy.methods, err = decodeStringList(value); err == nil {
+				for _, m := range policy.methods {
+					if !corsMethodRegex.MatchString(m) {
+						return corsPolicy{}, fmt.Errorf("%w: invalid method %q", ErrInvalidCorsPolicy, m)
+					}
+				}
+			}
+		case "header":
+			policy.headers, err = decodeStringList(value)
+		case "exposeheader":
+			policy.exposeHeaders, err = decodeStringList(value)
+		case "credentials":
+			err = value.Decode(&policy.credentials)
+		case "maxage":
+			policy.maxAge, err = time.ParseDuration(value.Value)
+
+			if err == nil && policy.maxAge < 0 {
+				err = fmt.Errorf("negative duration %v", value.Value)
+			}
+		default:
+			return corsPolicy{}, fmt.Errorf("%w: unknown key %q", ErrInvalidCorsPolicy, key.Value)
+		}
+
+		if err != nil {
+			return corsPolicy{}, fmt.Errorf("%w: invalid %v: %w", ErrInvalidCorsPolicy, key.Value, err)
+		}
+	}
+
+	if len(kind) == 0 || len(policy.origins) == 0 {
+		return corsPolicy{}, fmt.Errorf("%w: expected one matcher of %v or %v and an origin list",
+			ErrInvalidCorsPolicy, HeaderRulePath, HeaderRuleRegex)
+	}
+
+	// any website could otherwise read the responses using the credentials of the user
+	if policy.credentials && (policy.allowsAnyOrigin() || slices.Contains(policy.headers, corsAnyValue)) {
+		return corsPolicy{}, fmt.Errorf("%w: credentials require explicit origins and headers instead of %q",
+			ErrInvalidCorsPolicy, corsAnyValue)
+	}
+
+	matcher, err := newPathMatcher(kind, pattern)
+
+	if err != nil {
+		return corsPolicy{}, fmt.Errorf("%w: %w", ErrInvalidCorsPolicy, err)
+	}
+
+	policy.matcher = matcher
+
+	return policy, nil
+}
+
+// splitHeaderList splits a comma separated header value, e.g., of Access-Control-Request-Headers.
+func splitHeaderList(value string) []string {
+	var result []string
+
+	for field := range strings.SplitSeq(value, ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			result = append(result, field)
+		}
+	}
+
+	return result
+}
+
+// setAllowOrigin sets the headers allowing the origin to read the response.
+func (c corsPolicy) setAllowOrigin(header http.Header, origin string) {
+	if c.allowsAnyOrigin() {
+		header.Set("Access-Control-Allow-Origin", corsAnyValue)
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", origin)
+
+	if c.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// servePreflight answers a preflight request. Denied requests get no CORS headers, so that browsers block the
+// actual request.
+func (c corsPolicy) servePreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	header := w.Header()
+
+	addVary(header, "Origin")
+	addVary(header, "Access-Control-Request-Method")
+	addVary(header, "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	requestedHeaders := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+
+	if !c.allowsOrigin(origin) || !slices.Contains(c.methods, method) || !c.allowsHeaders(requestedHeaders) {
+		slog.Debug("denied cors preflight request",
+			slog.String("path", utils.CutLog(r.URL.Path)),
+			slog.String("origin", utils.CutLog(origin)),
+			slog.String("method", utils.CutLog(method)))
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	c.setAllowOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+
+	if len(requestedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requestedHeaders, ", "))
+	}
+
+	if c.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// corsPolicies generates the middleware applying the first CORS policy matching the request path. It answers
+// preflight requests and allows the permitted origins to read the responses of actual requests. Other OPTIONS
+// requests are answered with the allowed methods. The policies match the path as requested by the client.
+func corsPolicies(policies []corsPolicy) func(http.Handler) http.Handler {
+	for _, policy := range policies {
+		slog.Info("adding cors policy",
+			slog.String("matcher", policy.matcher.kind),
+			slog.String("pattern", policy.matcher.pattern),
+			slog.Int("origins", len(policy.origins)))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(policies) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			index := slices.IndexFunc(policies, func(p corsPolicy) bool { return p.matcher.matches(r.URL.Path) })
+			origin := r.Header.Get("Origin")
+
+			if r.Method == http.MethodOptions {
+				if index >= 0 && len(origin) > 0 && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+					policies[index].servePreflight(w, r, origin)
+					return
+				}
+
+				w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+				w.WriteHeader(http.StatusNoContent)
+
+				return
+			}
+
+			if index < 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			policy := policies[index]
+
+			if !policy.allowsAnyOrigin() {
+				addVary(w.Header(), "Origin")
+			}
+
+			if len(origin) > 0 && policy.allowsOrigin(origin) {
+				policy.setAllowOrigin(w.Header(), origin)
+
+				if len(policy.exposeHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.exposeHeaders, ", "))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorsPolicies(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "api-mock/users.json", "fonts/font.woff2"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+cors:
+  - path: /api-mock/
+    origin:
+      - https://app.example.com
+      - https://*.staging.example.com
+      - "~^http://localhost:[0-9]+$"
+    method: [GET, HEAD, POST]
+    header: [Authorization, X-Requested-With]
+    exposeheader: X-Correlation-ID
+    credentials: true
+    maxage: 10m
+  - path: /fonts/
+    origin: "*"
+`, root))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	t.Cleanup(cleanup)
+
+	request := func(method, uri string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(t.Context(), method, uri, nil)
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	tests := []struct {
+		method       string
+		uri          string
+		headers      map[string]string
+		status       int
+		allowOrigin  string
+		allowHeaders string
+		maxAge       string
+	}{
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://app.example.com",
+				"Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "authorization"},
+			status: http.StatusNoContent, allowOrigin: "https://app.example.com", allowHeaders: "authorization",
+			maxAge: "600"},
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://qa.staging.example.com",
+				"Access-Control-Request-Method": "GET"},
+			status: http.StatusNoContent, allowOrigin: "https://qa.staging.example.com", maxAge: "600"},
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "GET"},
+			status:  http.StatusNoContent, allowOrigin: "http://localhost:3000", maxAge: "600"},
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://evil.example.org", "Access-Control-Request-Method": "GET"},
+			status:  http.StatusNoContent},
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"},
+			status:  http.StatusNoContent},
+		{method: http.MethodOptions, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://app.example.com",
+				"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Other"},
+			status: http.StatusNoContent},
+		{method: http.MethodGet, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			status:  http.StatusOK, allowOrigin: "https://app.example.com"},
+		{method: http.MethodGet, uri: "/api-mock/users.json",
+			headers: map[string]string{"Origin": "https://evil.example.org"},
+			status:  http.StatusOK},
+		{method: http.MethodGet, uri: "/fonts/font.woff2",
+			headers: map[string]string{"Origin": "https://other.example.org"},
+			status:  http.StatusOK, allowOrigin: "*"},
+		{method: http.MethodGet, uri: "/index.html",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			status:  http.StatusMovedPermanently},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestCorsPolicies-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			rec := request(test.method, test.uri, test.headers)
+
+			assert.Equal(t, test.status, rec.Code, "status of %v %v", test.method, test.uri)
+			assert.Equal(t, test.allowOrigin, rec.Header().Get("Access-Control-Allow-Origin"),
+				"allowed origin of %v %v", test.method, test.uri)
+			assert.Equal(t, test.allowHeaders, rec.Header().Get("Access-Control-Allow-Headers"),
+				"allowed headers of %v %v", test.method, test.uri)
+			assert.Equal(t, test.maxAge, rec.Header().Get("Access-Control-Max-Age"),
+				"max age of %v %v", test.method, test.uri)
+		})
+	}
+
+	rec := request(http.MethodOptions, "/api-mock/users.json", map[string]string{"Origin": "https://app.example.com",
+		"Access-Control-Request-Method": "GET"})
+
+	assert.Equal(t, "GET, HEAD, POST", rec.Header().Get("Access-Control-Allow-Methods"), "allowed methods")
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"), "credentials allowed")
+	assert.Contains(t, rec.Header().Values("Vary"), "Origin", "preflight varies by origin")
+
+	rec = request(http.MethodGet, "/api-mock/users.json", map[string]string{"Origin": "https://app.example.com"})
+
+	assert.Equal(t, "X-Correlation-ID", rec.Header().Get("Access-Control-Expose-Headers"), "exposed headers")
+	assert.Equal(t, "content", rec.Body.String(), "content of cross-origin request")
+
+	rec = request(http.MethodGet, "/fonts/font.woff2", map[string]string{"Origin": "https://app.example.com"})
+
+	assert.Empty(t, rec.Header().Get("Vary"), "no vary for policies allowing any origin")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"), "no credentials for any origin")
+
+	rec = request(http.MethodOptions, "/index.html", nil)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code, "options request without preflight")
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"), "allowed methods of options request")
+}
+
+func TestCorsPoliciesConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policies string
+		line     int
+	}{
+		{policies: "  - path: /a\n", line: 3},
+		{policies: "  - origin: \"*\"\n", line: 3},
+		{policies: "  - path: /a\n    regex: ^/b\n    origin: \"*\"\n", line: 3},
+		{policies: "  - regex: \"(\"\n    origin: \"*\"\n", line: 3},
+		{policies: "  - path: /a\n    origin: \"~(\"\n", line: 3},
+		{policies: "  - path: /a\n    origin: \"*\"\n    method: \"GET POST\"\n", line: 3},
+		{policies: "  - path: /a\n    origin: \"*\"\n    maxage: long\n", line: 3},
+		{policies: "  - path: /a\n    origin: \"*\"\n    credentials: maybe\n", line: 3},
+		{policies: "  - path: /a\n    origin: [https://a.example.com, \"*\"]\n    credentials: true\n", line: 3},
+		{policies: "  - path: /a\n    origin: https://a.example.com\n    header: \"*\"\n    credentials: true\n",
+			line: 3},
+		{policies: "  - path: /a\n    origin: \"*\"\n  - path: /b\n    other: x\n", line: 5},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestCorsPoliciesConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\ncors:\n"+test.policies)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorIs(t, err, ErrInvalidCorsPolicy, "expected invalid policy")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/AlphaOne1/sonicred/utils"
+)
+
+// ErrInvalidErrorPage indicates that an error page parameter could not be parsed.
+var ErrInvalidErrorPage = errors.New("invalid error page, expected <status>=<path>, e.g., 404=/errors/404.html")
+
+// errorPageData is the data available in the error page templates.
+type errorPageData struct {
+	Status        int
+	StatusText    string
+	Method        string
+	Path          string
+	CorrelationID string
+}
+
+// validErrorStatus checks if the status is an error status code or an error status class, i.e., 4xx or 5xx.
+func validErrorStatus(status string) bool {
+	if status == "4xx" || status == "5xx" {
+		return true
+	}
+
+	code, err := strconv.Atoi(status)
+
+	return err == nil && code >= http.StatusBadRequest && code <= 599
+}
+
+// parseErrorPages parses the error page parameters of the form status=path. The status is either a status code,
+// e.g., 404, or a status class, e.g., 5xx.
+func parseErrorPages(params []string) (map[string]string, error) {
+	pages := make(map[string]string, len(params))
+
+	for _, param := range params {
+		status, pagePath, found := strings.Cut(param, "=")
+		status = strings.ToLower(strings.TrimSpace(status))
+		pagePath = strings.TrimSpace(pagePath)
+
+		if !found || !validErrorStatus(status) || !fs.ValidPath(strings.TrimPrefix(pagePath, "/")) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidErrorPage, param)
+		}
+
+		slog.Info("registering error page", slog.String("status", status), slog.String("path", pagePath))
+
+		pages[status] = strings.TrimPrefix(pagePath, "/")
+	}
+
+	return pages, nil
+}
+
+// errorPageFor gives the error page for the status code, an exact match taking precedence over the status class.
+func errorPageFor(pages map[string]string, status int) (string, bool) {
+	if page, found := pages[strconv.Itoa(status)]; found {
+		return page, true
+	}
+
+	page, found := pages[strconv.Itoa(status/100)+"xx"]
+
+	return page, found
+}
+
+// renderErrorPage reads the error page template from the file system and executes it.
+func renderErrorPage(fileSystem fs.FS, page string, data errorPageData) ([]byte, error) {
+	content, readErr := fs.ReadFile(fileSystem, page)
+
+	if readErr != nil {
+		return nil, fmt.Errorf("could not read error page: %w", readErr)
+	}
+
+	tmpl, parseErr := template.New(page).Parse(string(content))
+
+	if parseErr != nil {
+		return nil, fmt.Errorf("could not parse error page: %w", parseErr)
+	}
+
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("could not execute error page: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// errorPageWriter suppresses the body of error responses that have an error page configured, so that the error
+// page can be sent instead.
+type errorPageWriter struct {
+	http.ResponseWriter
+
+	pages   map[string]string
+	status  int
+	page    string
+	written bool
+}
+
+// Unwrap gives the underlying response writer.
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// WriteHeader writes the response header, unless an error page replaces the response.
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.written {
+		return
+	}
+
+	ew.written = true
+	ew.status = status
+
+	if page, found := errorPageFor(ew.pages, status); found {
+		ew.page = page
+		return
+	}
+
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the response data, unless an error page replaces the response.
+func (ew *errorPageWriter) Write(data []byte) (int, error) {
+	if !ew.written {
+		ew.WriteHeader(http.StatusOK)
+	}
+
+	if len(ew.page) > 0 {
+		return len(data), nil
+	}
+
+	n, err := ew.ResponseWriter.Write(data)
+
+	if err != nil {
+		return n, fmt.Errorf("could not write response: %w", err)
+	}
+
+	return n, nil
+}
+
+// errorPages generates the middleware replacing error responses with the configured error pages. The error
+// pages are read from the file system on each use and executed as HTML templates, with the data given in
+// errorPageData. They are sent with the original status code.
+func errorPages(fileSystem fs.FS, pages map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(pages) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ew := &errorPageWriter{ResponseWriter: w, pages: pages}
+
+			next.ServeHTTP(ew, r)
+
+			if len(ew.page) == 0 {
+				return
+			}
+
+			content, renderErr := renderErrorPage(fileSystem, ew.page, errorPageData{
+				Status:        ew.status,
+				StatusText:    http.StatusText(ew.status),
+				Method:        r.Method,
+				Path:          r.URL.Path,
+				CorrelationID: w.Header().Get("X-Correlation-ID"),
+			})
+
+			header := w.Header()
+			header.Del("Content-Encoding")
+			header.Del("Content-Range")
+			header.Del("ETag")
+			header.Del("Last-Modified")
+
+			if renderErr != nil {
+				slog.Error("could not render error page",
+					slog.String("page", utils.CutLog(ew.page)),
+					slog.String("error", renderErr.Error()))
+
+				http.Error(w, http.StatusText(ew.status), ew.status)
+
+				return
+			}
+
+			contentType := mime.TypeByExtension(path.Ext(ew.page))
+
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+
+			header.Set("Content-Type", contentType)
+			header.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(ew.status)
+
+			if r.Method == http.MethodHead {
+				return
+			}
+
+			if _, err := w.Write(content); err != nil {
+				slog.Error("could not send error page", slog.String("error", err.Error()))
+			}
+		})
+	}
+}
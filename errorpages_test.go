@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrorPages(t *testing.T) {
+	t.Parallel()
+
+	pages, err := parseErrorPages([]string{"404=/errors/404.html", "5XX = /errors/5xx.html"})
+
+	if assert.NoError(t, err, "valid error pages") {
+		assert.Equal(t, map[string]string{"404": "errors/404.html", "5xx": "errors/5xx.html"}, pages)
+	}
+
+	for _, invalid := range []string{"404", "200=/ok.html", "3xx=/redirect.html", "404=/../outside.html", "abc=/a"} {
+		_, err := parseErrorPages([]string{invalid})
+		assert.ErrorIs(t, err, ErrInvalidErrorPage, "invalid error page %q", invalid)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "errors"), 0o700); err != nil {
+		t.Fatalf("could not create test directory: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0o700); err != nil {
+		t.Fatalf("could not create test directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "errors", "404.html"),
+		[]byte("<p>{{.Status}} {{.StatusText}}: {{.Path}} ({{.CorrelationID}})</p>"), 0o600); err != nil {
+		t.Fatalf("could not write error page: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "errors", "4xx.html"),
+		[]byte("<p>client error {{.Status}}</p>"), 0o600); err != nil {
+		t.Fatalf("could not write error page: %v", err)
+	}
+
+	wafFile := filepath.Join(t.TempDir(), "waf.conf")
+
+	if err := os.WriteFile(wafFile, []byte(
+		"SecRuleEngine On\nSecRule REQUEST_URI \"@contains attack\" \"id:1,phase:1,deny,status:403\"\n"),
+		0o600); err != nil {
+		t.Fatalf("could not write waf configuration: %v", err)
+	}
+
+	handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+		basePath:   "/",
+		rootPath:   root,
+		wafCfg:     []string{wafFile},
+		errorPages: []string{"404=/errors/404.html", "4xx=/errors/4xx.html"},
+	})
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	request := func(uri string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, uri, nil))
+
+		return rec
+	}
+
+	rec := request("/missing<b>.html")
+
+	assert.Equal(t, http.StatusNotFound, rec.Code, "status of missing file")
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"), "content type of error page")
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "<p>404 Not Found: /missing&lt;b&gt;.html ("),
+		"templated error page, got %q", rec.Body.String())
+	assert.Contains(t, rec.Body.String(), rec.Header().Get("X-Correlation-ID"), "correlation ID in error page")
+	assert.NotEmpty(t, rec.Header().Get("X-Correlation-ID"), "correlation ID set")
+
+	rec = request("/dir/")
+
+	assert.Equal(t, http.StatusForbidden, rec.Code, "status of disabled directory listing")
+	assert.Equal(t, "<p>client error 403</p>", rec.Body.String(), "error page of status class")
+
+	rec = request("/" + strings.Repeat("a", 256))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "status of invalid path")
+	assert.Equal(t, "<p>client error 400</p>", rec.Body.String(), "error page of invalid path")
+
+	rec = request("/attack")
+
+	assert.Equal(t, http.StatusForbidden, rec.Code, "status of request blocked by waf")
+	assert.Equal(t, "<p>client error 403</p>", rec.Body.String(), "error page of waf block")
+}
@@ -0,0 +1,377 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// configHeaderRulesKey is the key in the configuration file holding the list of header rules.
+const configHeaderRulesKey = "headerrules"
+
+// Header rule matcher kinds, used in the configuration file and in the section lines of header files.
+const (
+	HeaderRulePath  = "path"
+	HeaderRuleRegex = "regex"
+	HeaderRuleType  = "type"
+)
+
+// ErrInvalidHeaderRule indicates that a header rule could not be parsed.
+var ErrInvalidHeaderRule = errors.New("invalid header rule")
+
+// headerRule sets additional headers on responses whose path or content type match.
+type headerRule struct {
+	kind    string
+	pattern string
+	regex   *regexp.Regexp
+	headers [][2]string
+}
+
+// newHeaderRule creates a header rule of the given matcher kind and pattern.
+func newHeaderRule(kind, pattern string, headers [][2]string) (headerRule, error) {
+	rule := headerRule{kind: kind, pattern: pattern, headers: headers}
+
+	switch kind {
+	case HeaderRulePath:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return rule, fmt.Errorf("%w: invalid path pattern %q: %w", ErrInvalidHeaderRule, pattern, err)
+		}
+	case HeaderRuleRegex:
+		regex, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return rule, fmt.Errorf("%w: invalid regular expression %q: %w", ErrInvalidHeaderRule, pattern, err)
+		}
+
+		rule.regex = regex
+	case HeaderRuleType:
+		rule.pattern = strings.ToLower(pattern)
+	default:
+		return rule, fmt.Errorf("%w: unknown matcher %q, expected %v, %v or %v",
+			ErrInvalidHeaderRule, kind, HeaderRulePath, HeaderRuleRegex, HeaderRuleType)
+	}
+
+	return rule, nil
+}
+
+// matchPathPattern checks if the request path matches the glob pattern. Patterns ending in a slash match all
+// paths below, patterns without a slash match the file name only. Directory requests are matched as their
+// index.html.
+func matchPathPattern(pattern, urlPath string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(urlPath, pattern)
+	}
+
+	if strings.HasSuffix(urlPath, "/") {
+		urlPath += "index.html"
+	}
+
+	if !strings.Contains(pattern, "/") {
+		urlPath = path.Base(urlPath)
+	}
+
+	matched, _ := path.Match(pattern, urlPath)
+
+	return matched
+}
+
+// pathMatcher selects requests by their path, using a glob pattern as for header rules or a regular expression.
+type pathMatcher struct {
+	kind    string
+	pattern string
+	regex   *regexp.Regexp
+}
+
+// newPathMatcher creates a path matcher of the given kind, path or regex.
+func newPathMatcher(kind, pattern string) (pathMatcher, error) {
+	matcher := pathMatcher{kind: kind, pattern: pattern}
+
+	switch kind {
+	case HeaderRulePath:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return matcher, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	case HeaderRuleRegex:
+		regex, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return matcher, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+
+		matcher.regex = regex
+	default:
+		return matcher, fmt.Errorf("unknown matcher %q, expected %v or %v", kind, HeaderRulePath, HeaderRuleRegex)
+	}
+
+	return matcher, nil
+}
+
+// matches checks if the request path matches.
+func (m pathMatcher) matches(urlPath string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(urlPath)
+	}
+
+	return matchPathPattern(m.pattern, urlPath)
+}
+
+// matches checks if the rule applies to a response with the given request path and content type.
+func (h headerRule) matches(urlPath, contentType string) bool {
+	switch h.kind {
+	case HeaderRulePath:
+		return matchPathPattern(h.pattern, urlPath)
+	case HeaderRuleRegex:
+		return h.regex.MatchString(urlPath)
+	case HeaderRuleType:
+		return matchMediaType(contentType, []string{h.pattern})
+	default:
+		return false
+	}
+}
+
+// matchMediaType checks if the media type of the content type is one of the given types. Types ending in a
+// slash match all subtypes.
+func matchMediaType(contentType string, types []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if mediaType == "" {
+		return false
+	}
+
+	for _, t := range types {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerValue gives the value to send for the header. Expires headers can be given relative to the time of the
+// response, e.g., "+1h".
+func headerValue(key, value string) string {
+	if strings.EqualFold(key, "Expires") && strings.HasPrefix(value, "+") {
+		if d, err := time.ParseDuration(value[1:]); err == nil {
+			return time.Now().Add(d).UTC().Format(http.TimeFormat)
+		}
+	}
+
+	return value
+}
+
+// parseHeaderSection parses the section line of a header file, e.g., "[path /assets/*.js]", into the matcher
+// kind and pattern.
+func parseHeaderSection(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", "", false
+	}
+
+	kind, pattern, _ := strings.Cut(strings.TrimSpace(line[1:len(line)-1]), " ")
+
+	return kind, strings.TrimSpace(pattern), true
+}
+
+// splitHeaderSections splits the lines of header files into the global headers and the header rules. Lines
+// following a section line belong to the rule of that section.
+func splitHeaderSections(lines []string) ([]string, []headerRule, error) {
+	var global []string
+	var rules []headerRule
+	var sectionLines []string
+
+	kind, pattern, inSection := "", "", false
+
+	finishSection := func() error {
+		if !inSection {
+			return nil
+		}
+
+		rule, err := newHeaderRule(kind, pattern, headerParamToHeaders(sectionLines))
+
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+		sectionLines = nil
+
+		return nil
+	}
+
+	for _, line := range lines {
+		if k, p, isSection := parseHeaderSection(line); isSection {
+			if err := finishSection(); err != nil {
+				return nil, nil, err
+			}
+
+			kind, pattern, inSection = k, p, true
+
+			continue
+		}
+
+		if inSection {
+			sectionLines = append(sectionLines, line)
+		} else {
+			global = append(global, line)
+		}
+	}
+
+	if err := finishSection(); err != nil {
+		return nil, nil, err
+	}
+
+	return global, rules, nil
+}
+
+// parseHeaderRuleConfigs reads the header rules of the configuration file. Each rule is a mapping with one
+// matcher, path, regex or type, and the headers to set.
+func parseHeaderRuleConfigs(node *yaml.Node, fileName string) ([]headerRule, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a list of header rules", ErrConfigFile, fileName, node.Line)
+	}
+
+	rules := make([]headerRule, 0, len(node.Content))
+
+	var errs []error
+
+	for _, entry := range node.Content {
+		rule, err := parseHeaderRuleConfig(entry)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, entry.Line, err))
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// parseHeaderRuleConfig reads a single header rule entry of the configuration file.
+func parseHeaderRuleConfig(entry *yaml.Node) (headerRule, error) {
+	if entry.Kind != yaml.MappingNode {
+		return headerRule{}, fmt.Errorf("%w: expected a mapping of matcher and headers", ErrInvalidHeaderRule)
+	}
+
+	var kind, pattern string
+	var headers []string
+
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		key, value := entry.Content[i], entry.Content[i+1]
+
+		switch key.Value {
+		case HeaderRulePath, HeaderRuleRegex, HeaderRuleType:
+			if len(kind) > 0 || value.Kind != yaml.ScalarNode {
+				return headerRule{}, fmt.Errorf("%w: expected exactly one matcher of %v, %v or %v",
+					ErrInvalidHeaderRule, HeaderRulePath, HeaderRuleRegex, HeaderRuleType)
+			}
+
+			kind, pattern = key.Value, value.Value
+		case "header":
+			values, err := decodeStringList(value)
+
+			if err != nil {
+				return headerRule{}, fmt.Errorf("%w: %w", ErrInvalidHeaderRule, err)
+			}
+
+			headers = values
+		default:
+			return headerRule{}, fmt.Errorf("%w: unknown key %q", ErrInvalidHeaderRule, key.Value)
+		}
+	}
+
+	if len(kind) == 0 || len(headers) == 0 {
+		return headerRule{}, fmt.Errorf("%w: expected one matcher of %v, %v or %v and a header list",
+			ErrInvalidHeaderRule, HeaderRulePath, HeaderRuleRegex, HeaderRuleType)
+	}
+
+	return newHeaderRule(kind, pattern, headerParamToHeaders(headers))
+}
+
+// headerRuleWriter applies the matching header rules right before the response header is written, when the
+// status code and content type are known.
+type headerRuleWriter struct {
+	http.ResponseWriter
+
+	rules   []headerRule
+	urlPath string
+	written bool
+}
+
+// Unwrap gives the underlying response writer.
+func (hw *headerRuleWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// WriteHeader sets the headers of the matching rules and writes the response header. Error responses are left
+// untouched, so that they are not cached according to the rules for the content.
+func (hw *headerRuleWriter) WriteHeader(status int) {
+	if !hw.written {
+		hw.written = true
+
+		if status < http.StatusBadRequest {
+			header := hw.Header()
+			contentType := header.Get("Content-Type")
+
+			for _, rule := range hw.rules {
+				if !rule.matches(hw.urlPath, contentType) {
+					continue
+				}
+
+				for _, h := range rule.headers {
+					header.Set(h[0], headerValue(h[0], h[1]))
+				}
+			}
+		}
+	}
+
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the response header, if not already done, and the data.
+func (hw *headerRuleWriter) Write(data []byte) (int, error) {
+	if !hw.written {
+		hw.WriteHeader(http.StatusOK)
+	}
+
+	n, err := hw.ResponseWriter.Write(data)
+
+	if err != nil {
+		return n, fmt.Errorf("could not write response: %w", err)
+	}
+
+	return n, nil
+}
+
+// applyHeaderRules generates the middleware setting the headers of the matching rules. All matching rules are
+// applied in their order, so later rules override the headers of earlier ones. The rules match the path as
+// requested by the client.
+func applyHeaderRules(rules []headerRule) func(http.Handler) http.Handler {
+	for _, rule := range rules {
+		slog.Info("adding header rule",
+			slog.String("matcher", rule.kind),
+			slog.String("pattern", rule.pattern),
+			slog.Int("headers", len(rule.headers)))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&headerRuleWriter{ResponseWriter: w, rules: rules, urlPath: r.URL.Path}, r)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPathPattern(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/assets/*.js", path: "/assets/app.1234abcd.js", want: true},
+		{pattern: "/assets/*.js", path: "/assets/sub/app.js", want: false},
+		{pattern: "index.html", path: "/", want: true},
+		{pattern: "index.html", path: "/docs/index.html", want: true},
+		{pattern: "index.html", path: "/docs/other.html", want: false},
+		{pattern: "/api-mock/", path: "/api-mock/users/1", want: true},
+		{pattern: "/api-mock/", path: "/api-mock", want: false},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestMatchPathPattern-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, matchPathPattern(test.pattern, test.path), "%v on %v", test.pattern, test.path)
+		})
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "assets/app.1234abcd.js", "api-mock/users.json", "image.png"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	headerFile := filepath.Join(t.TempDir(), "headers.conf")
+
+	if err := os.WriteFile(headerFile, []byte(`X-Global: yes
+[path /assets/*.js]
+Cache-Control: immutable, max-age=31536000
+[type image/]
+Cache-Control: max-age=3600
+Expires: +1h
+`), 0o600); err != nil {
+		t.Fatalf("could not write header file: %v", err)
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+headerfile: %s
+headerrules:
+  - path: index.html
+    header: "Cache-Control: no-cache"
+  - regex: ^/api-mock/
+    header:
+      - "Cache-Control: no-store"
+`, root, headerFile))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	tests := []struct {
+		uri          string
+		cacheControl string
+	}{
+		{uri: "/", cacheControl: "no-cache"},
+		{uri: "/assets/app.1234abcd.js", cacheControl: "immutable, max-age=31536000"},
+		{uri: "/api-mock/users.json", cacheControl: "no-store"},
+		{uri: "/image.png", cacheControl: "max-age=3600"},
+		{uri: "/missing.js", cacheControl: ""},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil))
+
+		assert.Equal(t, test.cacheControl, rec.Header().Get("Cache-Control"), "Cache-Control of %v", test.uri)
+		assert.Equal(t, "yes", rec.Header().Get("X-Global"), "global header of %v", test.uri)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/image.png", nil))
+
+	expires, expiresErr := http.ParseTime(rec.Header().Get("Expires"))
+
+	if assert.NoError(t, expiresErr, "expires should be a valid time") {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute, "relative expires")
+	}
+}
+
+func TestHeaderRulesConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rules string
+		line  int
+	}{
+		{rules: "  - path: /a\n", line: 3},
+		{rules: "  - path: /a\n    regex: ^/b\n    header: \"X: y\"\n", line: 3},
+		{rules: "  - regex: \"(\"\n    header: \"X: y\"\n", line: 3},
+		{rules: "  - other: /a\n    header: \"X: y\"\n", line: 3},
+		{rules: "  - path: /a\n    header: \"X: y\"\n  - type: text/\n", line: 5},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestHeaderRulesConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\nheaderrules:\n"+test.rules)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+}
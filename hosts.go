@@ -0,0 +1,435 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// configHostsKey is the key in the configuration file holding the list of virtual hosts.
+const configHostsKey = "hosts"
+
+// hostNamesKey is the key of a virtual host entry holding the host names it serves.
+const hostNamesKey = "names"
+
+// ErrNoHostNames indicates that a virtual host has no host names.
+var ErrNoHostNames = errors.New("virtual host needs at least one name")
+
+// ErrDuplicateHostName indicates that a host name is used by more than one virtual host.
+var ErrDuplicateHostName = errors.New("host name used by multiple virtual hosts")
+
+// ErrUnknownDefaultHost indicates that the default host is not the name of any virtual host.
+var ErrUnknownDefaultHost = errors.New("default host is not a name of any virtual host")
+
+// HostConfig holds the configuration options that can be set per virtual host. The main host is configured
+// using the top-level options, the virtual hosts inherit all options they do not set themselves from it.
+type HostConfig struct {
+	Names        []string
+	RootPath     string
+	BasePath     string
+	IndexEnabled bool
+	Headers      *MultiStringValue
+	HeadersFiles *MultiStringValue
+	TryFiles     *MultiStringValue
+	WafCfg       *MultiStringValue
+	ErrorPages   *MultiStringValue
+	RewriteFiles *MultiStringValue
+	RewriteStage string
+	DefaultLang  string
+	TLSCert      string
+	TLSKey       string
+	HeaderRules  []headerRule
+	CorsPolicies []corsPolicy
+	BasicAuth    []basicAuthRule
+	ClientCerts  []clientCertRule
+	OIDC         *oidcConfig
+	Bearer       *bearerConfig
+
+	// Sources holds for each option, identified by its flag name, where its effective value originates from.
+	Sources map[string]ValueSource
+}
+
+// source gives the origin of the value of the option with the given flag name.
+func (h HostConfig) source(name string) ValueSource {
+	if s, found := h.Sources[name]; found {
+		return s
+	}
+
+	return ValueSource{Kind: SourceDefault}
+}
+
+// clone creates a deep copy of the host configuration, so that modifications of the copy's lists do not
+// affect the original.
+func (h HostConfig) clone() HostConfig {
+	cloneList := func(l *MultiStringValue) *MultiStringValue {
+		result := slices.Clone(*l)
+		return &result
+	}
+
+	h.Names = slices.Clone(h.Names)
+	h.Headers = cloneList(h.Headers)
+	h.HeadersFiles = cloneList(h.HeadersFiles)
+	h.TryFiles = cloneList(h.TryFiles)
+	h.WafCfg = cloneList(h.WafCfg)
+	h.ErrorPages = cloneList(h.ErrorPages)
+	h.RewriteFiles = cloneList(h.RewriteFiles)
+	h.HeaderRules = slices.Clone(h.HeaderRules)
+	h.CorsPolicies = slices.Clone(h.CorsPolicies)
+	h.BasicAuth = slices.Clone(h.BasicAuth)
+	h.ClientCerts = slices.Clone(h.ClientCerts)
+	h.Sources = maps.Clone(h.Sources)
+
+	return h
+}
+
+// defineFlags defines the options of the host in the flag set, using the current values as defaults.
+func (h *HostConfig) defineFlags(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&h.RootPath, "root", h.RootPath, "root directory for webserver")
+	flagSet.StringVar(&h.BasePath, "base", h.BasePath, "base path for serving")
+	flagSet.BoolVar(&h.IndexEnabled, "index", h.IndexEnabled, "enable directory listing")
+	flagSet.Var(h.Headers, "header", "additional HTTP header")
+	flagSet.Var(h.HeadersFiles, "headerfile", "file containing additional HTTP headers")
+	flagSet.Var(h.TryFiles, "tryfile", "always try to load file expression first")
+	flagSet.Var(h.WafCfg, "wafcfg", "waf configuration file")
+	flagSet.Var(h.ErrorPages, "errorpage", "error page for a status code or class")
+	flagSet.Var(h.RewriteFiles, "rewritefile", "file containing redirect and rewrite rules")
+	flagSet.StringVar(&h.RewriteStage, "rewritestage", h.RewriteStage,
+		"apply the rewrite rules before or after stripping the base path")
+	flagSet.StringVar(&h.DefaultLang, "defaultlang", h.DefaultLang, "language of the variant served if no other matches")
+	flagSet.StringVar(&h.TLSCert, "tlscert", h.TLSCert, "tls certificate file")
+	flagSet.StringVar(&h.TLSKey, "tlskey", h.TLSKey, "tls key file")
+}
+
+// mainHost gives the configuration of the main host, that is set using the top-level options.
+func (c ServerConfig) mainHost() HostConfig {
+	return HostConfig{
+		RootPath:     c.RootPath,
+		BasePath:     c.BasePath,
+		IndexEnabled: c.IndexEnabled,
+		Headers:      c.Headers,
+		HeadersFiles: c.HeadersFiles,
+		TryFiles:     c.TryFiles,
+		WafCfg:       c.WafCfg,
+		ErrorPages:   c.ErrorPages,
+		RewriteFiles: c.RewriteFiles,
+		RewriteStage: c.RewriteStage,
+		DefaultLang:  c.DefaultLang,
+		TLSCert:      c.TLSCert,
+		TLSKey:       c.TLSKey,
+		HeaderRules:  c.HeaderRules,
+		CorsPolicies: c.CorsPolicies,
+		BasicAuth:    c.BasicAuth,
+		ClientCerts:  c.ClientCerts,
+		OIDC:         c.OIDC,
+		Bearer:       c.Bearer,
+		Sources:      c.Sources,
+	}
+}
+
+// usesMainHost reports if the main host serves any requests. This is not the case if a default host is
+// configured, that serves all requests not matching any virtual host.
+func (c ServerConfig) usesMainHost() bool {
+	return len(c.Hosts) == 0 || len(c.DefaultHost) == 0
+}
+
+// certKeyPairs gives the TLS certificates of the main host, all virtual hosts and the additional pairs. The first
+// one is the default certificate, if given, else the certificate of the main host or, if that has none, of the
+// default host.
+func (c ServerConfig) certKeyPairs() []certKeyPair {
+	var pairs []certKeyPair
+
+	add := func(pair certKeyPair) {
+		if (len(pair.cert) > 0 || len(pair.key) > 0) && !slices.ContainsFunc(pairs, pair.sameFiles) {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	// the source of a pair is the one of the option given, to point to the other one missing
+	hostPair := func(host HostConfig) certKeyPair {
+		source := host.source("tlscert")
+
+		if len(host.TLSCert) == 0 {
+			source = host.source("tlskey")
+		}
+
+		return certKeyPair{cert: host.TLSCert, key: host.TLSKey, source: source}
+	}
+
+	add(hostPair(c.mainHost()))
+
+	for _, host := range c.Hosts {
+		if slices.ContainsFunc(host.Names, func(name string) bool {
+			return normalizeHostName(name) == normalizeHostName(c.DefaultHost)
+		}) {
+			add(hostPair(host))
+		}
+	}
+
+	for _, host := range c.Hosts {
+		add(hostPair(host))
+	}
+
+	if c.TLSPairs != nil {
+		for _, pair := range *c.TLSPairs {
+			cert, key, _ := strings.Cut(pair, ",")
+			add(certKeyPair{cert: cert, key: key, source: c.source("tlspair")})
+		}
+	}
+
+	if index := slices.IndexFunc(pairs, func(pair certKeyPair) bool {
+		return len(c.TLSDefault) > 0 && pair.cert == c.TLSDefault
+	}); index > 0 {
+		defaultPair := pairs[index]
+		pairs = slices.Insert(slices.Delete(pairs, index, index+1), 0, defaultPair)
+	}
+
+	return pairs
+}
+
+// hostNames gives the names of all virtual hosts.
+func (c ServerConfig) hostNames() []string {
+	var names []string
+
+	for _, host := range c.Hosts {
+		names = append(names, host.Names...)
+	}
+
+	return names
+}
+
+// normalizeHostName brings the host name into the canonical form used for matching: lower case without
+// port and trailing dot.
+func normalizeHostName(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// virtualHostHandler dispatches the requests to the handler of the virtual host given in their Host header.
+// Requests for unknown hosts are served by the fallback handler.
+func virtualHostHandler(hosts map[string]http.Handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, found := hosts[normalizeHostName(r.Host)]; found {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// decodeStringList decodes a list of strings, given either as single value or as list of values.
+func decodeStringList(node *yaml.Node) ([]string, error) {
+	if node.Kind == yaml.ScalarNode {
+		return []string{node.Value}, nil
+	}
+
+	var values []string
+
+	if err := node.Decode(&values); err != nil {
+		return nil, fmt.Errorf("could not decode list of values: %w", err)
+	}
+
+	return values, nil
+}
+
+// parseHostConfigs reads the virtual host entries of the configuration file. Each entry is a mapping of the
+// host names and the options of the host. Options not given are inherited from the main host.
+func parseHostConfigs(node *yaml.Node, fileName string, mainHost HostConfig) ([]HostConfig, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: %s:%d: expected a list of virtual hosts", ErrConfigFile, fileName, node.Line)
+	}
+
+	hosts := make([]HostConfig, 0, len(node.Content))
+
+	var errs []error
+
+	for _, entry := range node.Content {
+		if entry.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: expected a mapping of option names to values",
+				ErrConfigFile, fileName, entry.Line))
+
+			continue
+		}
+
+		host := mainHost.clone()
+		host.Names = nil
+		host.Sources[hostNamesKey] = ValueSource{
+			Kind:     SourceFile,
+			Location: fmt.Sprintf("%s:%d", fileName, entry.Line),
+		}
+
+		flagSet := flag.NewFlagSet("host", flag.ContinueOnError)
+		flagSet.SetOutput(io.Discard)
+		host.defineFlags(flagSet)
+
+		given := make(map[string]bool)
+
+		for i := 0; i+1 < len(entry.Content); i += 2 {
+			key, value := entry.Content[i], entry.Content[i+1]
+			given[key.Value] = true
+
+			if key.Value == hostNamesKey {
+				names, err := decodeStringList(value)
+
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%w: %s:%d: expected a host name or a list of host names",
+						ErrConfigFile, fileName, value.Line))
+				}
+
+				host.Names = names
+
+				continue
+			}
+
+			if key.Value == configHeaderRulesKey {
+				rules, err := parseHeaderRuleConfigs(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.HeaderRules = rules
+
+				continue
+			}
+
+			if key.Value == configCorsKey {
+				policies, err := parseCorsPolicyConfigs(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.CorsPolicies = policies
+
+				continue
+			}
+
+			if key.Value == configBasicAuthKey {
+				rules, err := parseBasicAuthConfigs(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.BasicAuth = rules
+
+				continue
+			}
+
+			if key.Value == configClientCertsKey {
+				rules, err := parseClientCertRuleConfigs(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.ClientCerts = rules
+
+				continue
+			}
+
+			if key.Value == configOIDCKey {
+				settings, err := parseOIDCConfig(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.OIDC = settings
+
+				continue
+			}
+
+			if key.Value == configBearerKey {
+				settings, err := parseBearerConfig(value, fileName)
+
+				if err != nil {
+					errs = append(errs, err)
+				}
+
+				host.Bearer = settings
+
+				continue
+			}
+
+			if err := applyConfigFileValue(flagSet, fileName, key, value, host.Sources); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// a certificate of the host never belongs to the key of the main host, and vice versa
+		if given["tlscert"] != given["tlskey"] {
+			if given["tlscert"] {
+				host.TLSKey = ""
+			} else {
+				host.TLSCert = ""
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, errors.Join(errs...)
+}
+
+// checkHostConsistency validates the virtual host configurations.
+func checkHostConsistency(config ServerConfig) error {
+	var errs []error
+
+	seen := make(map[string]bool)
+
+	for _, host := range config.Hosts {
+		location := host.source(hostNamesKey)
+
+		if len(host.Names) == 0 {
+			errs = append(errs, fmt.Errorf("%w (%v)", ErrNoHostNames, location))
+		}
+
+		for _, name := range host.Names {
+			if seen[normalizeHostName(name)] {
+				errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrDuplicateHostName, name, location))
+			}
+
+			seen[normalizeHostName(name)] = true
+		}
+
+		if host.RootPath == "" {
+			errs = append(errs, fmt.Errorf("%w (%v)", ErrEmptyRootPath, host.source("root")))
+		}
+
+		if !strings.HasPrefix(host.BasePath, "/") {
+			errs = append(errs, fmt.Errorf("%w (%v)", ErrInvalidBasePath, host.source("base")))
+		}
+
+		if !slices.Contains([]string{RewriteStageBefore, RewriteStageAfter}, host.RewriteStage) {
+			errs = append(errs, fmt.Errorf("%w: %q (%v)",
+				ErrInvalidRewriteStage, host.RewriteStage, host.source("rewritestage")))
+		}
+
+		if !validLanguage(host.DefaultLang) {
+			errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidLanguage, host.DefaultLang, host.source("defaultlang")))
+		}
+	}
+
+	if len(config.DefaultHost) > 0 && !seen[normalizeHostName(config.DefaultHost)] {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrUnknownDefaultHost, config.DefaultHost,
+			config.source("defaulthost")))
+	}
+
+	return errors.Join(errs...)
+}
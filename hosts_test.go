@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	t.Parallel()
+
+	roots := t.TempDir()
+
+	for _, name := range []string{"main", "a", "b"} {
+		if err := os.Mkdir(filepath.Join(roots, name), 0o700); err != nil {
+			t.Fatalf("could not create root directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(roots, name, "index.html"), []byte(name), 0o600); err != nil {
+			t.Fatalf("could not write index file: %v", err)
+		}
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %[1]s/main
+header:
+  - "X-Main: yes"
+hosts:
+  - names: [a.example.com, www.a.example.com]
+    root: %[1]s/a
+  - names: b.example.com
+    root: %[1]s/b
+    header:
+      - "X-B: yes"
+`, roots))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	if !assert.NoError(t, checkConfigConsistency(config), "configuration should be consistent") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	tests := []struct {
+		host    string
+		body    string
+		headerA string
+		headerB string
+	}{
+		{host: "a.example.com", body: "a", headerA: "yes"},
+		{host: "WWW.A.example.com:8080", body: "a", headerA: "yes"},
+		{host: "b.example.com.", body: "b", headerB: "yes"},
+		{host: "unknown.example.com", body: "main", headerA: "yes"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code, "status for %s", test.host)
+		assert.Equal(t, test.body, rec.Body.String(), "content for %s", test.host)
+		assert.Equal(t, test.headerA, rec.Header().Get("X-Main"), "inherited header for %s", test.host)
+		assert.Equal(t, test.headerB, rec.Header().Get("X-B"), "host header for %s", test.host)
+	}
+}
+
+func TestVirtualHostsDefaultHost(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, `version: 1
+root: /noexist
+defaulthost: fallback.example.com
+hosts:
+  - names: fallback.example.com
+    root: testroot
+`)
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil)
+	req.Host = "unknown.example.com"
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code, "unknown hosts served by default host")
+}
+
+func TestVirtualHostsConsistency(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, `version: 1
+root: testroot
+defaulthost: missing.example.com
+hosts:
+  - names: a.example.com
+  - names: [A.example.com]
+  - base: /
+`)
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrDuplicateHostName, "expected duplicate host name")
+	assert.ErrorIs(t, checkErr, ErrNoHostNames, "expected missing host names")
+	assert.ErrorIs(t, checkErr, ErrUnknownDefaultHost, "expected unknown default host")
+	assert.ErrorContains(t, checkErr, fileName+":6", "expected location of duplicate host")
+}
+
+func TestVirtualHostsPartialCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	mainPair := writeTestCertificate(t, dir, "main", time.Now().Add(time.Hour), "example.com")
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: testroot
+tlscert: %s
+tlskey: %s
+hosts:
+  - names: a.example.com
+    tlscert: %s
+`, mainPair.cert, mainPair.key, filepath.Join(dir, "a.pem")))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be readable") {
+		return
+	}
+
+	assert.Empty(t, config.Hosts[0].TLSKey, "key of the main host not inherited with own certificate")
+
+	_, tlsErr := generateServerTLSConfig(config, nil)
+
+	assert.ErrorIs(t, tlsErr, errTLSConfig, "expected missing key of the host")
+	assert.ErrorContains(t, tlsErr, fileName+":7", "expected location of the certificate of the host")
+}
@@ -0,0 +1,457 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdCheckInterval is the minimum time between two checks of a htpasswd file for changes.
+const HtpasswdCheckInterval = 2 * time.Second
+
+// SHA-crypt parameters, see https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	shaCryptRoundsPrefix  = "rounds="
+)
+
+// ErrInvalidHtpasswd indicates that a htpasswd file could not be parsed.
+var ErrInvalidHtpasswd = errors.New("invalid htpasswd file")
+
+// ErrUnsupportedHash indicates a password hash of an unsupported scheme, e.g., MD5 or SHA-1.
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// htpasswdDummyHash is verified for unknown users, so that they take as long as known ones.
+const htpasswdDummyHash = "$2a$10$Hy3Ny5lN0SSvliiafbxqJ.uiNCFRqhqo4lFBsGuJbu279eX6rbVaW"
+
+// cryptAlphabet is the base64 alphabet of the crypt password hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// shaCryptVariant holds the hash function and output byte order of the SHA-256 or SHA-512 crypt variant.
+type shaCryptVariant struct {
+	newHash func() hash.Hash
+	order   [][3]int
+}
+
+// shaCryptVariants maps the identifiers of the SHA-crypt variants, $5$ and $6$, to their parameters. A negative
+// index in the order stands for a zero byte.
+var shaCryptVariants = map[string]shaCryptVariant{
+	"5": {newHash: sha256.New, order: [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14}, {15, 25, 5}, {6, 16, 26}, {27, 7, 17},
+		{18, 28, 8}, {9, 19, 29}, {-1, 31, 30},
+	}},
+	"6": {newHash: sha512.New, order: [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48}, {28, 49, 7},
+		{50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41}, {-1, -1, 63},
+	}},
+}
+
+// shaCryptSettings holds the parameters of a SHA-crypt hash, e.g., $5$rounds=10000$salt$hash.
+type shaCryptSettings struct {
+	variant shaCryptVariant
+	prefix  string
+	rounds  int
+	salt    string
+}
+
+// parseShaCryptSettings parses the variant, rounds and salt of a SHA-crypt hash.
+func parseShaCryptSettings(encoded string) (shaCryptSettings, error) {
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) < 3 || parts[0] != "" {
+		return shaCryptSettings{}, fmt.Errorf("%w: malformed sha-crypt hash", ErrUnsupportedHash)
+	}
+
+	variant, found := shaCryptVariants[parts[1]]
+
+	if !found {
+		return shaCryptSettings{}, fmt.Errorf("%w: unknown sha-crypt variant %q", ErrUnsupportedHash, parts[1])
+	}
+
+	settings := shaCryptSettings{
+		variant: variant,
+		prefix:  "$" + parts[1] + "$",
+		rounds:  shaCryptDefaultRounds,
+		salt:    parts[2],
+	}
+
+	if roundsValue, isRounds := strings.CutPrefix(parts[2], shaCryptRoundsPrefix); isRounds && len(parts) > 3 {
+		rounds, err := strconv.Atoi(roundsValue)
+
+		if err != nil {
+			return shaCryptSettings{}, fmt.Errorf("%w: invalid sha-crypt rounds %q", ErrUnsupportedHash, roundsValue)
+		}
+
+		settings.rounds = min(max(rounds, shaCryptMinRounds), shaCryptMaxRounds)
+		settings.prefix += shaCryptRoundsPrefix + strconv.Itoa(settings.rounds) + "$"
+		settings.salt = parts[3]
+	}
+
+	if len(settings.salt) > shaCryptMaxSalt {
+		settings.salt = settings.salt[:shaCryptMaxSalt]
+	}
+
+	return settings, nil
+}
+
+// shaCrypt computes the SHA-crypt hash of the password using the settings of the given hash, that is its
+// variant, rounds and salt.
+func shaCrypt(password, encoded string) (string, error) {
+	settings, err := parseShaCryptSettings(encoded)
+
+	if err != nil {
+		return "", err
+	}
+
+	variant, prefix, rounds, salt := settings.variant, settings.prefix, settings.rounds, settings.salt
+
+	pw, sl := []byte(password), []byte(salt)
+
+	digest := func(parts ...[]byte) []byte {
+		h := variant.newHash()
+
+		for _, p := range parts {
+			h.Write(p)
+		}
+
+		return h.Sum(nil)
+	}
+
+	// repeat gives the sequence of len bytes made up of copies of the block
+	repeat := func(block []byte, length int) []byte {
+		result := make([]byte, 0, length)
+
+		for len(result) < length {
+			result = append(result, block[:min(len(block), length-len(result))]...)
+		}
+
+		return result
+	}
+
+	altDigest := digest(pw, sl, pw)
+
+	h := variant.newHash()
+	h.Write(pw)
+	h.Write(sl)
+	h.Write(repeat(altDigest, len(pw)))
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(altDigest)
+		} else {
+			h.Write(pw)
+		}
+	}
+
+	result := h.Sum(nil)
+
+	pSeq := repeat(digest(repeat(pw, len(pw)*len(pw))), len(pw))
+	sSeq := repeat(digest(repeat(sl, len(sl)*(16+int(result[0])))), len(sl))
+
+	for i := range rounds {
+		h.Reset()
+
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(result)
+		}
+
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+
+		if i&1 != 0 {
+			h.Write(result)
+		} else {
+			h.Write(pSeq)
+		}
+
+		result = h.Sum(result[:0])
+	}
+
+	var output strings.Builder
+
+	output.WriteString(prefix + salt + "$")
+
+	for _, group := range variant.order {
+		value, chars := 0, 4
+
+		for _, index := range group {
+			value <<= 8
+
+			if index < 0 {
+				chars--
+			} else {
+				value |= int(result[index])
+			}
+		}
+
+		for range chars {
+			output.WriteByte(cryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+
+	return output.String(), nil
+}
+
+// argon2Params holds the parameters of an argon2 hash in the PHC string format, e.g.,
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+type argon2Params struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2Hash parses an argon2 hash in the PHC string format.
+func parseArgon2Hash(encoded string) (argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 || parts[0] != "" || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return argon2Params{}, fmt.Errorf("%w: malformed argon2 hash", ErrUnsupportedHash)
+	}
+
+	params := argon2Params{variant: parts[1]}
+
+	if params.variant != "argon2id" && params.variant != "argon2i" {
+		return argon2Params{}, fmt.Errorf("%w: unknown argon2 variant %q", ErrUnsupportedHash, params.variant)
+	}
+
+	var threads uint32
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &threads); err != nil ||
+		params.time == 0 || threads == 0 || threads > 255 {
+
+		return argon2Params{}, fmt.Errorf("%w: invalid argon2 parameters %q", ErrUnsupportedHash, parts[3])
+	}
+
+	params.threads = uint8(threads)
+
+	var saltErr, keyErr error
+
+	params.salt, saltErr = base64.RawStdEncoding.DecodeString(parts[4])
+	params.key, keyErr = base64.RawStdEncoding.DecodeString(parts[5])
+
+	if saltErr != nil || keyErr != nil || len(params.key) == 0 {
+		return argon2Params{}, fmt.Errorf("%w: invalid argon2 salt or key", ErrUnsupportedHash)
+	}
+
+	return params, nil
+}
+
+// checkPasswordHash checks if the password hash is of a supported scheme and well-formed.
+func checkPasswordHash(encoded string) error {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return fmt.Errorf("%w: invalid bcrypt hash: %w", ErrUnsupportedHash, err)
+		}
+	case strings.HasPrefix(encoded, "$5$"), strings.HasPrefix(encoded, "$6$"):
+		if _, err := parseShaCryptSettings(encoded); err != nil {
+			return err
+		}
+	case strings.HasPrefix(encoded, "$argon2"):
+		if _, err := parseArgon2Hash(encoded); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: expected bcrypt, sha-crypt or argon2", ErrUnsupportedHash)
+	}
+
+	return nil
+}
+
+// verifyPassword checks if the password matches the hash. The comparison takes constant time.
+func verifyPassword(encoded, password string) bool {
+	switch {
+	case strings.HasPrefix(encoded, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+	case strings.HasPrefix(encoded, "$5$"), strings.HasPrefix(encoded, "$6$"):
+		computed, err := shaCrypt(password, encoded)
+
+		return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1
+	case strings.HasPrefix(encoded, "$argon2"):
+		params, err := parseArgon2Hash(encoded)
+
+		if err != nil {
+			return false
+		}
+
+		keyFunc := argon2.IDKey
+
+		if params.variant == "argon2i" {
+			keyFunc = argon2.Key
+		}
+
+		key := keyFunc([]byte(password), params.salt, params.time, params.memory, params.threads,
+			uint32(len(params.key))) //nolint:gosec // length of a decoded hash
+
+		return subtle.ConstantTimeCompare(key, params.key) == 1
+	default:
+		return false
+	}
+}
+
+// parseHtpasswd reads the users and their password hashes from an Apache-style htpasswd file. Empty lines and
+// lines starting with # are ignored.
+func parseHtpasswd(in io.Reader, fileName string) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(in)
+
+	var errs []error
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, encoded, found := strings.Cut(line, ":")
+
+		if !found || len(user) == 0 {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: expected user:hash", ErrInvalidHtpasswd, fileName, lineNumber))
+			continue
+		}
+
+		if err := checkPasswordHash(encoded); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s:%d: user %q: %w",
+				ErrInvalidHtpasswd, fileName, lineNumber, user, err))
+
+			continue
+		}
+
+		users[user] = encoded
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%w: could not read %s: %w", ErrInvalidHtpasswd, fileName, err))
+	}
+
+	return users, errors.Join(errs...)
+}
+
+// htpasswdFile holds the users of a htpasswd file. The file is read again when it changes, checked at most
+// every HtpasswdCheckInterval.
+type htpasswdFile struct {
+	name string
+
+	lock    sync.Mutex
+	users   map[string]string
+	size    int64
+	modTime time.Time
+	checked time.Time
+}
+
+// loadHtpasswdFile reads the htpasswd file with the given name.
+func loadHtpasswdFile(name string) (*htpasswdFile, error) {
+	h := &htpasswdFile{name: name}
+
+	info, err := os.Stat(name)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not stat htpasswd file: %w", err)
+	}
+
+	if err := h.read(info); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// read reads the file, replacing the users only if it is valid.
+func (h *htpasswdFile) read(info os.FileInfo) error {
+	in, err := os.Open(filepath.Clean(h.name))
+
+	if err != nil {
+		return fmt.Errorf("could not open htpasswd file: %w", err)
+	}
+
+	defer func() { _ = in.Close() }()
+
+	users, err := parseHtpasswd(in, h.name)
+
+	if err != nil {
+		return err
+	}
+
+	h.users, h.size, h.modTime = users, info.Size(), info.ModTime()
+
+	return nil
+}
+
+// refresh reads the file again if it changed since the last check. Invalid files are reported, keeping the
+// previous users.
+func (h *htpasswdFile) refresh(now time.Time) {
+	if now.Sub(h.checked) < HtpasswdCheckInterval {
+		return
+	}
+
+	h.checked = now
+
+	info, err := os.Stat(h.name)
+
+	if err != nil || (info.Size() == h.size && info.ModTime().Equal(h.modTime)) {
+		return
+	}
+
+	if err := h.read(info); err != nil {
+		slog.Error("could not reload htpasswd file, keeping previous users",
+			slog.String("file", h.name),
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	slog.Info("reloaded htpasswd file",
+		slog.String("file", h.name),
+		slog.Int("users", len(h.users)))
+}
+
+// authenticate checks the credentials of the user. Unknown users are checked against a dummy hash, so that
+// they cannot be told apart by the response time.
+func (h *htpasswdFile) authenticate(user, password string) bool {
+	h.lock.Lock()
+	h.refresh(time.Now())
+	encoded, found := h.users[user]
+	h.lock.Unlock()
+
+	if !found {
+		verifyPassword(htpasswdDummyHash, password)
+		return false
+	}
+
+	return verifyPassword(encoded, password)
+}
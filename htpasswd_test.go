@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test hashes of the password "secret" and, for argon2, of testArgon2idValue
+const (
+	testBcryptHash = "$2y$04$8Oyp5SQ0ClG80IGGu7LI3Ofc0fh722evtBP4MT6BoI.RuPUJWd0/6"
+	testSha512Hash = "$6$rounds=1000$abc$MqEcPZUYRGGcOeq7PhMpfjfu/F0HrVEI0OlZBijWvO8mSG77iNUDP5MqFceKpJTBc8" +
+		"iITVtNyLiNTRNCxv6oh0"
+	testArgon2idHash  = "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$OExbXxrbvQgbYThP81TOKGnzxD4G4iHpWEy4ZnF9I/g"
+	testArgon2idValue = "argon-secret"
+)
+
+func TestShaCrypt(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{password: "Hello world!", want: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{password: "Hello world!", want: "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{password: "Hello world!", want: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4" +
+			"OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{password: "secret", want: testSha512Hash},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestShaCrypt-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			got, err := shaCrypt(test.password, test.want)
+
+			assert.NoError(t, err, "hash should be computed")
+			assert.Equal(t, test.want, got, "hash of %v", test.password)
+		})
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{hash: testBcryptHash, password: "secret", want: true},
+		{hash: testBcryptHash, password: "Secret", want: false},
+		{hash: testSha512Hash, password: "secret", want: true},
+		{hash: testSha512Hash, password: "secret2", want: false},
+		{hash: testArgon2idHash, password: testArgon2idValue, want: true},
+		{hash: testArgon2idHash, password: "secret", want: false},
+		{hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secret", want: false},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestVerifyPassword-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, verifyPassword(test.hash, test.password), "%v against %v",
+				test.password, test.hash)
+		})
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	users, err := parseHtpasswd(strings.NewReader(
+		"# build users\nbcrypt:"+testBcryptHash+"\n\nsha:"+testSha512Hash+"\nargon:"+testArgon2idHash+"\n"),
+		"htpasswd")
+
+	assert.NoError(t, err, "valid htpasswd file")
+	assert.Len(t, users, 3, "users of htpasswd file")
+
+	tests := []string{
+		"missing-hash",
+		":" + testBcryptHash,
+		"md5:$apr1$abc$Y1gHsR9Lhd2T0zbUZ0fN71",
+		"sha1:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"plain:secret",
+		"bcrypt:$2y$04$short",
+		"sha:$7$salt$hash",
+		"sha:$5$rounds=many$salt$hash",
+		"argon:$argon2d$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"argon:$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestParseHtpasswd-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseHtpasswd(strings.NewReader("valid:"+testBcryptHash+"\n"+test+"\n"), "htpasswd")
+
+			assert.ErrorIs(t, err, ErrInvalidHtpasswd, "invalid line %v", test)
+			assert.ErrorContains(t, err, "htpasswd:2", "location of invalid line %v", test)
+		})
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "htpasswd")
+
+	if err := os.WriteFile(fileName, []byte("alice:"+testBcryptHash+"\n"), 0o600); err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	file, err := loadHtpasswdFile(fileName)
+
+	if !assert.NoError(t, err, "htpasswd file should be loaded") {
+		return
+	}
+
+	assert.True(t, file.authenticate("alice", "secret"), "alice authenticated")
+	assert.False(t, file.authenticate("bob", "secret"), "unknown bob not authenticated")
+
+	changeFile := func(content string, modTime time.Time) {
+		if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write htpasswd file: %v", err)
+		}
+
+		if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+			t.Fatalf("could not change htpasswd file time: %v", err)
+		}
+
+		// force the check of the next authentication
+		file.checked = time.Time{}
+	}
+
+	changeFile("bob:"+testSha512Hash+"\n", time.Now().Add(time.Minute))
+
+	assert.False(t, file.authenticate("alice", "secret"), "alice removed")
+	assert.True(t, file.authenticate("bob", "secret"), "bob added")
+
+	changeFile("bob:invalid\n", time.Now().Add(2*time.Minute))
+
+	assert.True(t, file.authenticate("bob", "secret"), "previous users kept for invalid file")
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrHTTPPortWithoutTLS indicates a plain HTTP port configured for a server not using TLS.
+var ErrHTTPPortWithoutTLS = errors.New("http port is only valid if TLS is enabled")
+
+// httpRedirectHandler answers the ACME HTTP-01 challenges using the certManager, if given, and permanently
+// redirects all other requests to HTTPS on the httpsPort, keeping host, path and query. The certManager has to be
+// the one of the TLS configuration, see newSharedACMEManager, as it knows the tokens of its pending challenges.
+func httpRedirectHandler(certManager *autocert.Manager, httpsPort string) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Host) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, "https://"+httpsHost(r.Host, httpsPort)+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+
+	if certManager == nil {
+		return redirect
+	}
+
+	return certManager.HTTPHandler(redirect)
+}
+
+// httpsHost replaces the port of the host by the httpsPort, omitting the default HTTPS port.
+func httpsHost(host, httpsPort string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	if httpsPort != "443" {
+		return net.JoinHostPort(host, httpsPort)
+	}
+
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+
+	return host
+}
+
+// generateHTTPHandler generates the handler of the plain HTTP server, see httpRedirectHandler.
+func generateHTTPHandler(config ServerConfig, certManager *autocert.Manager) http.Handler {
+	return httpRedirectHandler(certManager, config.ListenPort)
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host     string
+		target   string
+		port     string
+		location string
+	}{
+		{host: "example.com", target: "/", port: "443", location: "https://example.com/"},
+		{host: "example.com:80", target: "/docs/a%20b.html?x=1&y=2", port: "443",
+			location: "https://example.com/docs/a%20b.html?x=1&y=2"},
+		{host: "example.com:8080", target: "/docs/", port: "8443", location: "https://example.com:8443/docs/"},
+		{host: "[::1]:80", target: "/", port: "443", location: "https://[::1]/"},
+		{host: "[::1]", target: "/x", port: "8443", location: "https://[::1]:8443/x"},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestHTTPRedirect-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.target, nil)
+			req.Host = test.host
+
+			httpRedirectHandler(nil, test.port).ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusPermanentRedirect, rec.Code, "status of %v%v", test.host, test.target)
+			assert.Equal(t, test.location, rec.Header().Get("Location"), "location of %v%v", test.host, test.target)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil)
+	req.Host = ""
+
+	httpRedirectHandler(nil, "443").ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "request without host")
+}
+
+func TestHTTPChallenge(t *testing.T) {
+	t.Parallel()
+
+	httpServer := httptest.NewUnstartedServer(nil)
+	acmeServer := newTestACMEServer(t, "shop.example.com", httpServer.Listener.Addr().String())
+	settings := acmeSettings{
+		domains:   []string{"shop.example.com"},
+		certCache: t.TempDir(),
+		endpoint:  acmeServer.URL + "/directory",
+	}
+
+	certManager, err := newSharedACMEManager(settings)
+
+	if !assert.NoError(t, err, "manager should be created") {
+		return
+	}
+
+	handler := httpRedirectHandler(certManager, "443")
+
+	httpServer.Config.Handler = handler
+	httpServer.Start()
+	defer httpServer.Close()
+
+	// without the manager of the plain HTTP server, the offered HTTP-01 challenge cannot be used
+	unsharedSettings := settings
+	unsharedSettings.certCache = t.TempDir()
+
+	unsharedConfig, err := createACMEConfig(unsharedSettings, nil)
+
+	if assert.NoError(t, err, "configuration without shared manager should be created") {
+		_, err = unsharedConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"})
+		assert.Error(t, err, "certificate retrieval without shared manager")
+		assert.Zero(t, acmeServer.validated(), "challenge not accepted without shared manager")
+	}
+
+	config, err := createACMEConfig(settings, certManager)
+
+	if !assert.NoError(t, err, "configuration should be created") {
+		return
+	}
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"})
+
+	if assert.NoError(t, err, "certificate should be retrieved using the HTTP-01 challenge") {
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		assert.Equal(t, []string{"shop.example.com"}, leaf.DNSNames, "names of the certificate")
+	}
+
+	assert.Equal(t, 1, acmeServer.validated(), "challenge validated using the plain HTTP server")
+
+	tests := []struct {
+		host     string
+		target   string
+		status   int
+		location string
+	}{
+		{host: "shop.example.com", target: "/.well-known/acme-challenge/other", status: http.StatusNotFound},
+		{host: "other.example.com", target: "/.well-known/acme-challenge/other", status: http.StatusForbidden},
+		{host: "shop.example.com", target: "/cart?id=1", status: http.StatusPermanentRedirect,
+			location: "https://shop.example.com/cart?id=1"},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestHTTPChallenge-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.target, nil)
+			req.Host = test.host
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.status, rec.Code, "status of %v%v", test.host, test.target)
+			assert.Equal(t, test.location, rec.Header().Get("Location"), "location of %v%v", test.host, test.target)
+		})
+	}
+}
+
+func TestHTTPPortWithoutTLS(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nhttpport: 80\n")
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrHTTPPortWithoutTLS, "expected http port without TLS")
+	assert.ErrorContains(t, checkErr, fileName+":3", "expected location of http port")
+
+	config, err = parseConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-config", fileName, "-acmedomain", "shop.example.com"}, nil)
+
+	if assert.NoError(t, err, "configuration should be valid") {
+		assert.NoError(t, checkConfigConsistency(config), "http port with ACME domain")
+	}
+}
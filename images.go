@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ImageVariantsMetric is the name of the counter of responses for images with format variants, by served format.
+const ImageVariantsMetric = "sonicred.image.variants"
+
+// originalImageFormat is the format reported in the metric if the original image is served.
+const originalImageFormat = "original"
+
+// ErrUnknownImageFormat indicates that a configured image format is not supported.
+var ErrUnknownImageFormat = errors.New("unknown image format")
+
+// imageFormat is an alternative image format, served from sidecar files like photo.jpg.avif.
+type imageFormat struct {
+	name      string
+	mediaType string
+	extension string
+}
+
+// imageFormats lists the supported alternative image formats.
+var imageFormats = []imageFormat{
+	{name: "avif", mediaType: "image/avif", extension: ".avif"},
+	{name: "webp", mediaType: "image/webp", extension: ".webp"},
+	{name: "jxl", mediaType: "image/jxl", extension: ".jxl"},
+}
+
+// defaultImageFormats is the negotiation order of the image formats, if none is configured.
+var defaultImageFormats = []string{"avif", "webp"}
+
+// lookupImageFormats gives the image formats with the given names, keeping their order. Without names, the
+// default formats are used.
+func lookupImageFormats(names []string) ([]imageFormat, error) {
+	if len(names) == 0 {
+		names = defaultImageFormats
+	}
+
+	formats := make([]imageFormat, 0, len(names))
+
+	for _, name := range names {
+		found := false
+
+		for _, format := range imageFormats {
+			if strings.EqualFold(format.name, name) {
+				formats = append(formats, format)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownImageFormat, name)
+		}
+	}
+
+	return formats, nil
+}
+
+// acceptsMediaType checks if the Accept header explicitly lists the media type with a non-zero quality. Wildcards
+// are not considered, as clients send them also for formats they cannot display.
+func acceptsMediaType(accept, mediaType string) bool {
+	for entry := range strings.SplitSeq(accept, ",") {
+		entryType, params, _ := strings.Cut(entry, ";")
+
+		if !strings.EqualFold(strings.TrimSpace(entryType), mediaType) {
+			continue
+		}
+
+		for param := range strings.SplitSeq(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+
+			if strings.TrimSpace(key) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 32); err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// imageVariants generates the middleware serving alternative formats of images, e.g., photo.jpg.avif or
+// photo.jpg.webp for photo.jpg, to clients accepting them. The formats are tried in the given order. Responses
+// for images with variants are marked to vary by Accept and counted by their served format.
+func imageVariants(fileSystem fs.StatFS, formats []imageFormat) func(http.Handler) http.Handler {
+	counter, counterErr := otel.Meter(ServerName).Int64Counter(ImageVariantsMetric,
+		metric.WithDescription("Number of responses for images with format variants, by served format."),
+		metric.WithUnit("{response}"))
+
+	if counterErr != nil {
+		slog.Warn("could not create image variants metric", slog.String("error", counterErr.Error()))
+	}
+
+	count := func(r *http.Request, format string) {
+		if counter != nil {
+			counter.Add(r.Context(), 1, metric.WithAttributes(attribute.String("format", format)))
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(formats) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, _, found := requestedFile(fileSystem, r.URL.Path)
+
+			if !found {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			available := make([]imageFormat, 0, len(formats))
+
+			for _, format := range formats {
+				if info, statErr := fileSystem.Stat(name + format.extension); statErr == nil && info.Mode().IsRegular() {
+					available = append(available, format)
+				}
+			}
+
+			if len(available) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addVary(w.Header(), "Accept")
+
+			accept := r.Header.Get("Accept")
+
+			for _, format := range available {
+				if !acceptsMediaType(accept, format.mediaType) {
+					continue
+				}
+
+				slog.Debug("serving image variant",
+					slog.String("path", utils.CutLog(name)),
+					slog.String("format", format.name))
+
+				count(r, format.name)
+
+				w.Header().Set("Content-Type", format.mediaType)
+				r.URL.Path = "/" + name + format.extension
+
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			count(r, originalImageFormat)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
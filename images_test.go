@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      bool
+	}{
+		{accept: "image/avif,image/webp,image/apng,*/*;q=0.8", mediaType: "image/avif", want: true},
+		{accept: "image/avif,image/webp,image/apng,*/*;q=0.8", mediaType: "image/webp", want: true},
+		{accept: "image/webp;q=0.5", mediaType: "image/webp", want: true},
+		{accept: "image/avif;q=0, image/webp", mediaType: "image/avif", want: false},
+		{accept: "image/*,*/*;q=0.8", mediaType: "image/avif", want: false},
+		{accept: "", mediaType: "image/webp", want: false},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestAcceptsMediaType-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, acceptsMediaType(test.accept, test.mediaType),
+				"%v in %v", test.mediaType, test.accept)
+		})
+	}
+}
+
+func TestImageVariants(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	root := t.TempDir()
+
+	files := map[string]string{
+		"photo.jpg":      "jpeg",
+		"photo.jpg.avif": "avif",
+		"photo.jpg.webp": "webp",
+		"plain.png":      "png",
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		formats     []string
+		uri         string
+		accept      string
+		content     string
+		contentType string
+		vary        string
+	}{
+		{uri: "/photo.jpg", accept: "image/avif,image/webp,*/*", content: "avif", contentType: "image/avif",
+			vary: "Accept"},
+		{uri: "/photo.jpg", accept: "image/webp,*/*", content: "webp", contentType: "image/webp", vary: "Accept"},
+		{uri: "/photo.jpg", accept: "*/*", content: "jpeg", contentType: "image/jpeg", vary: "Accept"},
+		{formats: []string{"webp", "avif"}, uri: "/photo.jpg", accept: "image/avif,image/webp,*/*", content: "webp",
+			contentType: "image/webp", vary: "Accept"},
+		{uri: "/plain.png", accept: "image/avif,image/webp,*/*", content: "png", contentType: "image/png"},
+	}
+
+	for _, test := range tests {
+		handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+			basePath:     "/",
+			rootPath:     root,
+			imageFormats: test.formats,
+		})
+
+		if !assert.NoError(t, handlerErr, "handler should be generated") {
+			return
+		}
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		cleanup()
+
+		assert.Equal(t, http.StatusOK, rec.Code, "status of %v for %v", test.uri, test.accept)
+		assert.Equal(t, test.content, rec.Body.String(), "content of %v for %v", test.uri, test.accept)
+		assert.Equal(t, test.contentType, rec.Header().Get("Content-Type"), "type of %v for %v",
+			test.uri, test.accept)
+		assert.Equal(t, test.vary, rec.Header().Get("Vary"), "vary of %v for %v", test.uri, test.accept)
+	}
+
+	var data metricdata.ResourceMetrics
+
+	if !assert.NoError(t, reader.Collect(t.Context(), &data), "metrics should be collected") {
+		return
+	}
+
+	counts := make(map[string]int64)
+
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if sum, isSum := m.Data.(metricdata.Sum[int64]); isSum && m.Name == ImageVariantsMetric {
+				for _, point := range sum.DataPoints {
+					format, _ := point.Attributes.Value(attribute.Key("format"))
+					counts[format.AsString()] += point.Value
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]int64{"avif": 1, "webp": 2, originalImageFormat: 1}, counts, "served formats")
+
+	_, _, err := generateFileHandler(fileHandlerSettings{
+		basePath:     "/",
+		rootPath:     root,
+		imageFormats: []string{"gif"},
+	})
+
+	assert.ErrorIs(t, err, ErrUnknownImageFormat, "unknown image format")
+}
@@ -0,0 +1,663 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// JWTLeeway is the allowed clock skew when checking the expiry and not-before times of tokens.
+const JWTLeeway = time.Minute
+
+// JWKSRefreshInterval is the time after which remote key sets are fetched again.
+const JWKSRefreshInterval = time.Hour
+
+// JWKSRequestTimeout is the timeout of the requests fetching remote key sets.
+const JWKSRequestTimeout = 10 * time.Second
+
+// jwksMinRefreshInterval is the minimum time between two fetches of a remote key set, if a token references an
+// unknown key.
+const jwksMinRefreshInterval = time.Minute
+
+// jwksMaxSize is the maximum size of a key set or discovery document.
+const jwksMaxSize = 1 << 20
+
+// ErrInvalidJWT indicates that a token is malformed or its signature is invalid.
+var ErrInvalidJWT = errors.New("invalid token")
+
+// ErrInvalidClaims indicates that the claims of a token, e.g., its expiry or audience, are not accepted.
+var ErrInvalidClaims = errors.New("invalid token claims")
+
+// ErrInvalidJWKS indicates that a key set could not be parsed.
+var ErrInvalidJWKS = errors.New("invalid key set")
+
+// ErrUnknownKey indicates that no key of the key set matches the token.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwtHeader is the header of a signed token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtAlgorithm describes the verification of a signature algorithm.
+type jwtAlgorithm struct {
+	hash   crypto.Hash
+	verify func(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool
+}
+
+// verifyPKCS1 verifies an RSA PKCS#1 v1.5 signature.
+func verifyPKCS1(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	rsaKey, isRSA := key.(*rsa.PublicKey)
+
+	return isRSA && rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature) == nil
+}
+
+// verifyPSS verifies an RSA PSS signature.
+func verifyPSS(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	rsaKey, isRSA := key.(*rsa.PublicKey)
+
+	return isRSA &&
+		rsa.VerifyPSS(rsaKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+}
+
+// ecdsaCurves maps the hashes of the ECDSA algorithms to the curves of their keys, see RFC 7518, section 3.4.
+var ecdsaCurves = map[crypto.Hash]elliptic.Curve{
+	crypto.SHA256: elliptic.P256(),
+	crypto.SHA384: elliptic.P384(),
+	crypto.SHA512: elliptic.P521(),
+}
+
+// verifyECDSA verifies an ECDSA signature, given as the concatenation of r and s. The curve of the key has to be
+// the one of the algorithm.
+func verifyECDSA(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	ecKey, isEC := key.(*ecdsa.PublicKey)
+
+	if !isEC || ecKey.Curve != ecdsaCurves[hash] {
+		return false
+	}
+
+	size := (ecKey.Curve.Params().BitSize + 7) / 8
+
+	if len(signature) != 2*size {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+
+	return ecdsa.Verify(ecKey, digest, r, s)
+}
+
+// jwtAlgorithms lists the supported signature algorithms. Symmetric algorithms and "none" are not supported.
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256, verify: verifyPKCS1},
+	"RS384": {hash: crypto.SHA384, verify: verifyPKCS1},
+	"RS512": {hash: crypto.SHA512, verify: verifyPKCS1},
+	"PS256": {hash: crypto.SHA256, verify: verifyPSS},
+	"PS384": {hash: crypto.SHA384, verify: verifyPSS},
+	"PS512": {hash: crypto.SHA512, verify: verifyPSS},
+	"ES256": {hash: crypto.SHA256, verify: verifyECDSA},
+	"ES384": {hash: crypto.SHA384, verify: verifyECDSA},
+	"ES512": {hash: crypto.SHA512, verify: verifyECDSA},
+}
+
+// jwtKey is a public key of a key set.
+type jwtKey struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtKeySource gives the keys that may have signed a token with the given key ID.
+type jwtKeySource interface {
+	keys(ctx context.Context, kid string) ([]jwtKey, error)
+}
+
+// staticKeys is a key set that does not change, e.g., from a file.
+type staticKeys []jwtKey
+
+// keys gives the keys matching the key ID. Keys without ID match all tokens.
+func (s staticKeys) keys(_ context.Context, kid string) ([]jwtKey, error) {
+	var result []jwtKey
+
+	for _, k := range s {
+		if len(k.id) == 0 || len(kid) == 0 || k.id == kid {
+			result = append(result, k)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+
+	return result, nil
+}
+
+// jsonWebKey is a key of a JSON web key set.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the JSON web key into a public key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(field, value string) ([]byte, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("%w: key %q has an invalid %v", ErrInvalidJWKS, k.Kid, field)
+		}
+
+		return data, nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, nErr := decode("n", k.N)
+		e, eErr := decode("e", k.E)
+
+		if err := errors.Join(nErr, eErr); err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%w: key %q has an invalid exponent", ErrInvalidJWKS, k.Kid)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[k.Crv]
+
+		if !found {
+			return nil, fmt.Errorf("%w: key %q has an unsupported curve %q", ErrInvalidJWKS, k.Kid, k.Crv)
+		}
+
+		x, xErr := decode("x", k.X)
+		y, yErr := decode("y", k.Y)
+
+		if err := errors.Join(xErr, yErr); err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		point := append([]byte{4}, append(leftPad(x, size), leftPad(y, size)...)...)
+
+		key, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %w", ErrInvalidJWKS, k.Kid, err)
+		}
+
+		return key, nil
+	case "OKP":
+		x, err := decode("x", k.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: key %q has an unsupported curve %q", ErrInvalidJWKS, k.Kid, k.Crv)
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("%w: key %q has an unsupported type %q", ErrInvalidJWKS, k.Kid, k.Kty)
+	}
+}
+
+// leftPad pads the big-endian number with zeros to the given size.
+func leftPad(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// parseJWKS parses a JSON web key set. Keys not meant for signatures are skipped.
+func parseJWKS(data []byte) (staticKeys, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWKS, err)
+	}
+
+	keys := make(staticKeys, 0, len(set.Keys))
+
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, jwtKey{id: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no signing keys", ErrInvalidJWKS)
+	}
+
+	return keys, nil
+}
+
+// fetchLimited gets the resource at the URL, reading at most jwksMaxSize bytes.
+func fetchLimited(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %v: %w", url, err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch %v: status %v", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read %v: %w", url, err)
+	}
+
+	return data, nil
+}
+
+// remoteKeys is a key set fetched from a URL. It is fetched again after JWKSRefreshInterval or, at most every
+// jwksMinRefreshInterval, if a token references an unknown key. The key set is fetched in the background, only
+// the checks of tokens whose key is not known yet wait for it.
+type remoteKeys struct {
+	url    string
+	client *http.Client
+
+	lock    sync.Mutex
+	cached  staticKeys
+	fetched time.Time
+	pending chan struct{}
+}
+
+// keys gives the keys matching the key ID, fetching the key set if needed.
+func (r *remoteKeys) keys(ctx context.Context, kid string) ([]jwtKey, error) {
+	r.lock.Lock()
+
+	keys, err := r.cached.keys(ctx, kid)
+
+	if r.pending == nil && (time.Since(r.fetched) > JWKSRefreshInterval ||
+		(err != nil && time.Since(r.fetched) > jwksMinRefreshInterval)) {
+
+		r.fetched = time.Now()
+		r.pending = make(chan struct{})
+
+		go r.refresh()
+	}
+
+	pending := r.pending
+
+	r.lock.Unlock()
+
+	if err == nil || pending == nil {
+		return keys, err
+	}
+
+	select {
+	case <-pending:
+	case <-ctx.Done():
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.cached.keys(ctx, kid)
+}
+
+// refresh fetches the key set, keeping the previous keys on errors.
+func (r *remoteKeys) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), JWKSRequestTimeout)
+	defer cancel()
+
+	data, err := fetchLimited(ctx, r.client, r.url)
+
+	var keys staticKeys
+
+	if err == nil {
+		keys, err = parseJWKS(data)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	defer close(r.pending)
+
+	r.pending = nil
+
+	if err != nil {
+		slog.Error("could not fetch key set, keeping previous keys",
+			slog.String("url", r.url),
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	r.cached = keys
+
+	slog.Info("fetched key set", slog.String("url", r.url), slog.Int("keys", len(keys)))
+}
+
+// jwtClaims are the claims of a token.
+type jwtClaims map[string]any
+
+// time gives the value of a numeric date claim, e.g., exp.
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	value, found := c[name].(json.Number)
+
+	if !found {
+		return time.Time{}, false
+	}
+
+	seconds, err := value.Float64()
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(seconds), 0), true
+}
+
+// strings gives the values of a claim as strings. Lists give their elements, numbers and booleans their text.
+func (c jwtClaims) strings(name string) []string {
+	var result []string
+
+	var add func(value any)
+
+	add = func(value any) {
+		switch v := value.(type) {
+		case string:
+			result = append(result, v)
+		case json.Number:
+			result = append(result, v.String())
+		case bool:
+			result = append(result, strconv.FormatBool(v))
+		case []any:
+			for _, element := range v {
+				if _, isList := element.([]any); !isList {
+					add(element)
+				}
+			}
+		}
+	}
+
+	add(c[name])
+
+	return result
+}
+
+// subject gives the subject of the token.
+func (c jwtClaims) subject() string {
+	subject, _ := c["sub"].(string)
+
+	return subject
+}
+
+// jwtValidation holds the expected issuer and audiences of tokens.
+type jwtValidation struct {
+	issuer    string
+	audiences []string
+}
+
+// check validates the standard claims: the token must not be expired or not yet valid, and it must have the
+// expected issuer and one of the expected audiences, if those are set.
+func (v jwtValidation) check(claims jwtClaims, now time.Time) error {
+	expiry, hasExpiry := claims.time("exp")
+
+	if !hasExpiry {
+		return fmt.Errorf("%w: missing expiry", ErrInvalidClaims)
+	}
+
+	if now.After(expiry.Add(JWTLeeway)) {
+		return fmt.Errorf("%w: expired at %v", ErrInvalidClaims, expiry.UTC().Format(time.RFC3339))
+	}
+
+	if notBefore, found := claims.time("nbf"); found && now.Add(JWTLeeway).Before(notBefore) {
+		return fmt.Errorf("%w: not valid before %v", ErrInvalidClaims, notBefore.UTC().Format(time.RFC3339))
+	}
+
+	if issuer, _ := claims["iss"].(string); len(v.issuer) > 0 && issuer != v.issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidClaims, issuer)
+	}
+
+	if len(v.audiences) > 0 && !slices.ContainsFunc(claims.strings("aud"), func(a string) bool {
+		return slices.Contains(v.audiences, a)
+	}) {
+		return fmt.Errorf("%w: unexpected audience %v", ErrInvalidClaims, claims.strings("aud"))
+	}
+
+	return nil
+}
+
+// decodeJWTPart decodes a base64url encoded part of a token as JSON. Numbers are kept as json.Number.
+func decodeJWTPart(part string, target any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(target); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+
+	return nil
+}
+
+// verifyJWT checks the signature of the token in compact serialization using the keys of the source and gives
+// its claims. The standard claims are not checked, see jwtValidation.
+func verifyJWT(ctx context.Context, token string, source jwtKeySource) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected three parts", ErrInvalidJWT)
+	}
+
+	var header jwtHeader
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+
+	keys, err := source.keys(ctx, header.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	verified := false
+
+	for _, k := range keys {
+		if len(k.alg) > 0 && k.alg != header.Alg {
+			continue
+		}
+
+		if header.Alg == "EdDSA" {
+			edKey, isEd := k.key.(ed25519.PublicKey)
+			verified = isEd && ed25519.Verify(edKey, signingInput, signature)
+		} else if alg, supported := jwtAlgorithms[header.Alg]; supported {
+			h := alg.hash.New()
+			h.Write(signingInput)
+			verified = alg.verify(k.key, alg.hash, h.Sum(nil), signature)
+		} else {
+			return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidJWT, header.Alg)
+		}
+
+		if verified {
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidJWT)
+	}
+
+	var claims jwtClaims
+
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// claimRule requires for each claim one of the listed values, e.g., the membership in one of the groups.
+type claimRule map[string][]string
+
+// matches checks if the claims satisfy the rule. Claims with multiple values, e.g., groups, need to contain one
+// of the listed values.
+func (c claimRule) matches(claims jwtClaims) bool {
+	for name, allowed := range c {
+		if !slices.ContainsFunc(claims.strings(name), func(v string) bool { return slices.Contains(allowed, v) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// claimProtection requires a token or login for the paths it matches and, optionally, claims of the user.
+type claimProtection struct {
+	matcher pathMatcher
+	claims  claimRule
+}
+
+// parseClaimProtections reads the protected paths, each a mapping with one path matcher, path or regex, and
+// optionally the claims required, e.g., groups.
+func parseClaimProtections(node *yaml.Node) ([]claimProtection, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, errors.New("expected a list of protected paths")
+	}
+
+	protections := make([]claimProtection, 0, len(node.Content))
+
+	for _, entry := range node.Content {
+		if entry.Kind != yaml.MappingNode {
+			return nil, errors.New("expected a mapping of matcher and claims")
+		}
+
+		var kind, pattern string
+
+		protection := claimProtection{}
+
+		for i := 0; i+1 < len(entry.Content); i += 2 {
+			key, value := entry.Content[i], entry.Content[i+1]
+
+			switch key.Value {
+			case HeaderRulePath, HeaderRuleRegex:
+				if len(kind) > 0 || value.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("expected exactly one matcher of %v or %v", HeaderRulePath, HeaderRuleRegex)
+				}
+
+				kind, pattern = key.Value, value.Value
+			case "claims":
+				claims, err := parseClaimRule(value)
+
+				if err != nil {
+					return nil, err
+				}
+
+				protection.claims = claims
+			default:
+				return nil, fmt.Errorf("unknown key %q", key.Value)
+			}
+		}
+
+		matcher, err := newPathMatcher(kind, pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		protection.matcher = matcher
+		protections = append(protections, protection)
+	}
+
+	return protections, nil
+}
+
+// parseClaimRule reads a mapping of claim names to their allowed value or list of values.
+func parseClaimRule(node *yaml.Node) (claimRule, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, errors.New("expected a mapping of claims and their allowed values")
+	}
+
+	rule := make(claimRule)
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		values, err := decodeStringList(node.Content[i+1])
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid values of claim %q: %w", node.Content[i].Value, err)
+		}
+
+		rule[node.Content[i].Value] = values
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,335 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signTestJWT creates a token with the claims, signed by the key using RS256, ES256 or EdDSA.
+func signTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+
+	alg := map[string]string{
+		"*rsa.PrivateKey":    "RS256",
+		"*ecdsa.PrivateKey":  "ES256",
+		"ed25519.PrivateKey": "EdDSA",
+	}[fmt.Sprintf("%T", key)]
+
+	encode := func(value any) string {
+		data, err := json.Marshal(value)
+
+		if err != nil {
+			t.Fatalf("could not encode token part: %v", err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+
+	var signature []byte
+	var err error
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+
+		var r, s *big.Int
+
+		if r, s, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+			signature = append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signingInput))
+	}
+
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWKS creates the JSON web key set of the public keys, identified by their key IDs.
+func testJWKS(t *testing.T, keys map[string]crypto.Signer) []byte {
+	t.Helper()
+
+	encode := base64.RawURLEncoding.EncodeToString
+	set := make([]map[string]string, 0, len(keys))
+
+	for kid, key := range keys {
+		switch k := key.Public().(type) {
+		case *rsa.PublicKey:
+			set = append(set, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+				"n": encode(k.N.Bytes()), "e": encode(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			point, _ := k.Bytes()
+			set = append(set, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": encode(point[1:33]), "y": encode(point[33:])})
+		case ed25519.PublicKey:
+			set = append(set, map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": encode(k)})
+		}
+	}
+
+	data, err := json.Marshal(map[string]any{"keys": set})
+
+	if err != nil {
+		t.Fatalf("could not encode key set: %v", err)
+	}
+
+	return data
+}
+
+// testKeys generates an RSA, an ECDSA and an Ed25519 key.
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	rsaKey, rsaErr := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, ecErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, edErr := ed25519.GenerateKey(rand.Reader)
+
+	if rsaErr != nil || ecErr != nil || edErr != nil {
+		t.Fatalf("could not generate keys: %v %v %v", rsaErr, ecErr, edErr)
+	}
+
+	return map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey, "ed": edKey}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	t.Parallel()
+
+	keys := testKeys(t)
+	keySet, err := parseJWKS(testJWKS(t, keys))
+
+	if !assert.NoError(t, err, "key set should be parsed") {
+		return
+	}
+
+	claims := map[string]any{"sub": "ci", "exp": time.Now().Add(time.Hour).Unix()}
+
+	for kid, key := range keys {
+		token := signTestJWT(t, key, kid, claims)
+
+		got, err := verifyJWT(t.Context(), token, keySet)
+
+		assert.NoError(t, err, "token signed by %v key", kid)
+		assert.Equal(t, "ci", got.subject(), "subject of token signed by %v key", kid)
+
+		_, err = verifyJWT(t.Context(), token[:len(token)-4]+"AAAA", keySet)
+
+		assert.ErrorIs(t, err, ErrInvalidJWT, "manipulated signature of %v key", kid)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	_, err = verifyJWT(t.Context(), signTestJWT(t, otherKey, "ec", claims), keySet)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "token signed by unknown key")
+
+	_, err = verifyJWT(t.Context(), signTestJWT(t, otherKey, "other", claims), keySet)
+	assert.ErrorIs(t, err, ErrUnknownKey, "token with unknown key ID")
+
+	// ES512 requires a P-521 key, see RFC 7518, section 3.4
+	mismatchInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES512","kid":"ec"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ci"}`))
+	mismatchDigest := sha512.Sum512([]byte(mismatchInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, keys["ec"].(*ecdsa.PrivateKey), mismatchDigest[:])
+
+	if assert.NoError(t, err, "token should be signed") {
+		signature := append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+
+		_, err = verifyJWT(t.Context(), mismatchInput+"."+base64.RawURLEncoding.EncodeToString(signature), keySet)
+		assert.ErrorIs(t, err, ErrInvalidJWT, "algorithm not matching the curve of the key")
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ci"}`)) + "."
+
+	_, err = verifyJWT(t.Context(), unsigned, keySet)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "unsigned token")
+
+	_, err = verifyJWT(t.Context(), "not-a-token", keySet)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "malformed token")
+}
+
+func TestParseJWKSErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "secp256k1", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "OKP", "crv": "Ed448", "x": "AQ"}]}`,
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestParseJWKSErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseJWKS([]byte(test))
+
+			assert.ErrorIs(t, err, ErrInvalidJWKS, "invalid key set %v", test)
+		})
+	}
+}
+
+func TestJWTValidation(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	validation := jwtValidation{issuer: "https://issuer.example.com", audiences: []string{"sonicred", "artefacts"}}
+
+	tests := []struct {
+		claims map[string]any
+		valid  bool
+	}{
+		{claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://issuer.example.com",
+			"aud": "sonicred"}, valid: true},
+		{claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://issuer.example.com",
+			"aud": []string{"other", "artefacts"}, "nbf": now.Unix()}, valid: true},
+		{claims: map[string]any{"exp": now.Add(-30 * time.Second).Unix(), "iss": "https://issuer.example.com",
+			"aud": "sonicred"}, valid: true},
+		{claims: map[string]any{"iss": "https://issuer.example.com", "aud": "sonicred"}},
+		{claims: map[string]any{"exp": now.Add(-time.Hour).Unix(), "iss": "https://issuer.example.com",
+			"aud": "sonicred"}},
+		{claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Hour).Unix(),
+			"iss": "https://issuer.example.com", "aud": "sonicred"}},
+		{claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://evil.example.com",
+			"aud": "sonicred"}},
+		{claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://issuer.example.com",
+			"aud": "other"}},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestJWTValidation-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			var claims jwtClaims
+
+			data, _ := json.Marshal(test.claims)
+
+			if err := decodeJWTPart(base64.RawURLEncoding.EncodeToString(data), &claims); err != nil {
+				t.Fatalf("could not decode claims: %v", err)
+			}
+
+			err := validation.check(claims, now)
+
+			if test.valid {
+				assert.NoError(t, err, "valid claims %v", test.claims)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidClaims, "invalid claims %v", test.claims)
+			}
+		})
+	}
+}
+
+func TestClaimRule(t *testing.T) {
+	t.Parallel()
+
+	claims := jwtClaims{"sub": "alice", "groups": []any{"docs", "dev"}, "admin": true}
+
+	tests := []struct {
+		rule claimRule
+		want bool
+	}{
+		{rule: claimRule{}, want: true},
+		{rule: claimRule{"groups": {"ops", "docs"}}, want: true},
+		{rule: claimRule{"groups": {"ops"}}, want: false},
+		{rule: claimRule{"groups": {"dev"}, "sub": {"alice"}}, want: true},
+		{rule: claimRule{"groups": {"dev"}, "sub": {"bob"}}, want: false},
+		{rule: claimRule{"admin": {"true"}}, want: true},
+		{rule: claimRule{"missing": {"x"}}, want: false},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestClaimRule-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, test.rule.matches(claims), "rule %v", test.rule)
+		})
+	}
+}
+
+func TestRemoteKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := testKeys(t)
+
+	var fetches atomic.Int32
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+
+		_, _ = w.Write(testJWKS(t, map[string]crypto.Signer{"rsa": keys["rsa"]}))
+	}))
+	defer server.Close()
+
+	remote := &remoteKeys{url: server.URL, client: server.Client()}
+
+	_, err := verifyJWT(t.Context(), signTestJWT(t, keys["rsa"], "rsa", map[string]any{}), remote)
+	assert.NoError(t, err, "token signed by remote key")
+
+	_, err = verifyJWT(t.Context(), signTestJWT(t, keys["rsa"], "rsa", map[string]any{}), remote)
+	assert.NoError(t, err, "token signed by cached remote key")
+
+	_, err = verifyJWT(t.Context(), signTestJWT(t, keys["ec"], "ec", map[string]any{}), remote)
+	assert.ErrorIs(t, err, ErrUnknownKey, "token signed by unknown key")
+
+	assert.Equal(t, int32(1), fetches.Load(), "key set fetched once")
+
+	remote.lock.Lock()
+	remote.fetched = time.Now().Add(-JWKSRefreshInterval - time.Minute)
+	remote.lock.Unlock()
+
+	start := time.Now()
+
+	_, err = verifyJWT(t.Context(), signTestJWT(t, keys["rsa"], "rsa", map[string]any{}), remote)
+	assert.NoError(t, err, "token signed by cached remote key while refreshing")
+	assert.Less(t, time.Since(start), time.Second, "known key not waiting for the refresh")
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = verifyJWT(ctx, signTestJWT(t, keys["ec"], "ec", map[string]any{}), remote)
+	assert.ErrorIs(t, err, ErrUnknownKey, "unknown key while refreshing")
+
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		remote.lock.Lock()
+		defer remote.lock.Unlock()
+
+		return remote.pending == nil
+	}, 5*time.Second, 10*time.Millisecond, "key set refreshed in the background")
+	assert.Equal(t, int32(2), fetches.Load(), "single refresh")
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/AlphaOne1/sonicred/utils"
+)
+
+// LanguageParameter is the name of the query parameter and of the cookie overriding the language preferences
+// of the client, as also used by the directory listing.
+const LanguageParameter = "lang"
+
+// ErrInvalidLanguage indicates that a language is not a valid language tag.
+var ErrInvalidLanguage = errors.New("invalid language tag")
+
+// languageTagRegex matches the language tags usable in the names of language variants, e.g., de or pt-br.
+var languageTagRegex = regexp.MustCompile(`^[a-z]{1,8}(?:-[a-z0-9]{1,8})*$`)
+
+// languageNegotiatedExtensions lists the file extensions, for which language variants are looked for.
+var languageNegotiatedExtensions = []string{".html", ".htm"}
+
+// validLanguage checks if the language is empty or a valid language tag.
+func validLanguage(lang string) bool {
+	return lang == "" || languageTagRegex.MatchString(strings.ToLower(lang))
+}
+
+// languageVariants gives the language variants of the named file by their language, e.g., about.de.html for
+// about.html. Variants of directory indexes are found as index.de.html.
+func languageVariants(fileSystem fs.FS, name string) map[string]string {
+	ext := path.Ext(name)
+
+	if !slices.Contains(languageNegotiatedExtensions, ext) {
+		return nil
+	}
+
+	dir, file := path.Split(name)
+	stem := strings.TrimSuffix(file, ext) + "."
+
+	readDir := strings.TrimSuffix(dir, "/")
+
+	if readDir == "" {
+		readDir = "."
+	}
+
+	entries, err := fs.ReadDir(fileSystem, readDir)
+
+	if err != nil {
+		return nil
+	}
+
+	variants := make(map[string]string)
+
+	for _, entry := range entries {
+		lang, isVariant := strings.CutPrefix(entry.Name(), stem)
+		lang, hasExt := strings.CutSuffix(lang, ext)
+		lang = strings.ToLower(lang)
+
+		if isVariant && hasExt && !entry.IsDir() && languageTagRegex.MatchString(lang) {
+			variants[lang] = dir + entry.Name()
+		}
+	}
+
+	return variants
+}
+
+// preferredLanguages gives the languages the client prefers, in descending order. An override given by query
+// parameter or cookie comes first, followed by the ranked languages of the Accept-Language header. For each of
+// them, the exact variant, e.g. de-ch, precedes the base language.
+func preferredLanguages(r *http.Request) []string {
+	var langs []string
+
+	if lang := r.URL.Query().Get(LanguageParameter); len(lang) > 0 {
+		langs = append(langs, strings.ToLower(lang))
+	}
+
+	if cookie, err := r.Cookie(LanguageParameter); err == nil && len(cookie.Value) > 0 {
+		langs = append(langs, strings.ToLower(cookie.Value))
+	}
+
+	for _, pref := range utils.ParseLanguageHeader(r.Header.Get("Accept-Language")) {
+		if pref.Pref > 0 {
+			langs = append(langs, strings.ToLower(pref.Variant), strings.ToLower(pref.Lang))
+		}
+	}
+
+	return langs
+}
+
+// languageNegotiation generates the middleware choosing between the language variants of the requested file,
+// e.g., about.de.html and about.en.html for about.html. The variant of the most preferred language is served,
+// otherwise the requested file itself or, if that does not exist, the variant of the default language. Responses
+// for files with variants are marked to vary by Accept-Language and Cookie, served variants state their language
+// in Content-Language.
+func languageNegotiation(fileSystem fs.StatFS, defaultLang string) func(http.Handler) http.Handler {
+	defaultLang = strings.ToLower(defaultLang)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, "/")
+
+			if name == "" || strings.HasSuffix(name, "/") {
+				name += "index.html"
+			}
+
+			if !fs.ValidPath(name) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			variants := languageVariants(fileSystem, name)
+
+			if len(variants) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addVary(w.Header(), "Accept-Language")
+			addVary(w.Header(), "Cookie")
+
+			serveVariant := func(lang string) bool {
+				variant, found := variants[lang]
+
+				if !found {
+					return false
+				}
+
+				slog.Debug("serving language variant",
+					slog.String("path", utils.CutLog(r.URL.Path)),
+					slog.String("variant", variant))
+
+				w.Header().Set("Content-Language", lang)
+				r.URL.Path = "/" + variant
+
+				next.ServeHTTP(w, r)
+
+				return true
+			}
+
+			for _, lang := range preferredLanguages(r) {
+				if serveVariant(lang) {
+					return
+				}
+			}
+
+			if info, err := fileSystem.Stat(name); err == nil && info.Mode().IsRegular() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !serveVariant(defaultLang) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
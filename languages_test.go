@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguageNegotiation(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	files := map[string]string{
+		"about.html":         "about",
+		"about.de.html":      "über",
+		"about.pt-br.html":   "sobre",
+		"docs/index.en.html": "docs",
+		"docs/index.fr.html": "documents",
+		"app.js":             "code",
+		"app.de.js":          "Code",
+	}
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+		basePath:     "/",
+		rootPath:     root,
+		indexEnabled: true,
+		defaultLang:  "en",
+	})
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	// the parallel subtests run after this function returned
+	t.Cleanup(cleanup)
+
+	tests := []struct {
+		uri            string
+		acceptLanguage string
+		cookie         string
+		content        string
+		language       string
+	}{
+		{uri: "/about.html", acceptLanguage: "fr, de;q=0.8", content: "über", language: "de"},
+		{uri: "/about.html", acceptLanguage: "pt-BR, de;q=0.8", content: "sobre", language: "pt-br"},
+		{uri: "/about.html", acceptLanguage: "fr", content: "about"},
+		{uri: "/about.html", acceptLanguage: "de;q=0", content: "about"},
+		{uri: "/about.html?lang=pt-br", acceptLanguage: "de", content: "sobre", language: "pt-br"},
+		{uri: "/about.html", acceptLanguage: "de", cookie: "pt-br", content: "sobre", language: "pt-br"},
+		{uri: "/docs/", acceptLanguage: "fr-CA", content: "documents", language: "fr"},
+		{uri: "/docs/", acceptLanguage: "es", content: "docs", language: "en"},
+		{uri: "/app.js", acceptLanguage: "de", content: "code"},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestLanguageNegotiation-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+			req.Header.Set("Accept-Language", test.acceptLanguage)
+
+			if len(test.cookie) > 0 {
+				req.AddCookie(&http.Cookie{Name: LanguageParameter, Value: test.cookie})
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code, "status of %v", test.uri)
+			assert.Equal(t, test.content, rec.Body.String(), "content of %v", test.uri)
+			assert.Equal(t, test.language, rec.Header().Get("Content-Language"), "language of %v", test.uri)
+
+			if test.uri == "/app.js" {
+				assert.Empty(t, rec.Header().Get("Vary"), "no vary for files without variants")
+			} else {
+				assert.Equal(t, []string{"Accept-Language", "Cookie"}, rec.Header().Values("Vary"),
+					"vary of %v", test.uri)
+			}
+		})
+	}
+}
@@ -4,18 +4,25 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"slices"
+	"sync"
+
+	"github.com/AlphaOne1/sonicred/utils"
 )
 
 var errLogConfig = errors.New("invalid log configuration")
 
 // setupLogging sets the log format and level. It can try to guess in which environment
 // SonicRed runs (logStyle "auto"). If its parent seems to not be an init process, then
-// text logging is used, otherwise JSON.
-func setupLogging(logLevel string, logStyle string) error {
+// text logging is used, otherwise JSON. The log is written to out.
+func setupLogging(out io.Writer, logLevel string, logStyle string) error {
 	var parsedLogLevel slog.Level
 
 	if levelErr := (&parsedLogLevel).UnmarshalText([]byte(logLevel)); levelErr != nil {
@@ -38,13 +45,141 @@ func setupLogging(logLevel string, logStyle string) error {
 
 	switch {
 	case (logStyle == "auto" && ppid > 1) || logStyle == "text":
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &options)))
+		slog.SetDefault(slog.New(contextAttrsHandler{slog.NewTextHandler(out, &options)}))
 	case logStyle == "auto" || logStyle == "json":
 		options.ReplaceAttr = nil
-		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &options)))
+		slog.SetDefault(slog.New(contextAttrsHandler{slog.NewJSONHandler(out, &options)}))
 	default:
 		return fmt.Errorf("unsupported log style %s: %w", logStyle, errLogConfig)
 	}
 
 	return nil
 }
+
+// logAttrsKey is the context key of the attributes added to all log records of a request.
+type logAttrsKey struct{}
+
+// requestLogAttrsKey is the context key of the attributes added while the request is served.
+type requestLogAttrsKey struct{}
+
+// requestLogAttrs collects the attributes added while the request is served, e.g., the reason of a failed
+// authentication, so that they are also part of the access log written afterwards.
+type requestLogAttrs struct {
+	lock  sync.Mutex
+	attrs []slog.Attr
+}
+
+// withLogAttrs gives a context whose log records carry the attributes, e.g., the identity of the client in the
+// access log. Inside the access log, the attributes are added to all further records of the request.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	if collected, found := ctx.Value(requestLogAttrsKey{}).(*requestLogAttrs); found {
+		collected.lock.Lock()
+		collected.attrs = append(collected.attrs, attrs...)
+		collected.lock.Unlock()
+
+		return ctx
+	}
+
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+
+	return context.WithValue(ctx, logAttrsKey{}, append(slices.Clip(existing), attrs...))
+}
+
+// contextAttrsHandler adds the attributes set by withLogAttrs to the records logged with the context.
+type contextAttrsHandler struct {
+	slog.Handler
+}
+
+// Handle adds the attributes of the context to the record and passes it on.
+func (h contextAttrsHandler) Handle(ctx context.Context, record slog.Record) error {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+
+	if collected, found := ctx.Value(requestLogAttrsKey{}).(*requestLogAttrs); found {
+		collected.lock.Lock()
+		attrs = append(slices.Clip(attrs), collected.attrs...)
+		collected.lock.Unlock()
+	}
+
+	if len(attrs) > 0 {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+
+	return h.Handler.Handle(ctx, record) //nolint:wrapcheck // the handler is only decorated
+}
+
+// WithAttrs keeps adding the attributes of the context to the derived handler.
+func (h contextAttrsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextAttrsHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps adding the attributes of the context to the derived handler.
+func (h contextAttrsHandler) WithGroup(name string) slog.Handler {
+	return contextAttrsHandler{h.Handler.WithGroup(name)}
+}
+
+// statusRecorder remembers the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+// Unwrap gives the underlying response writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// WriteHeader remembers the first status code and writes the response header.
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write remembers the implicit status code, if none was written, and writes the data.
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+
+	return sr.ResponseWriter.Write(data) //nolint:wrapcheck // the writer is only decorated
+}
+
+// accessLog logs every request with the client's address, http method, accessed path, correlation ID, basic
+// authentication user and response status. The record is written after the request was served, so that it
+// carries the attributes added meanwhile by withLogAttrs, e.g., the reason of a failed authentication.
+func accessLog() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), requestLogAttrsKey{}, &requestLogAttrs{})
+			recorder := statusRecorder{ResponseWriter: w}
+
+			next.ServeHTTP(&recorder, r.WithContext(ctx))
+
+			attrs := []slog.Attr{
+				slog.String("client", r.RemoteAddr),
+				slog.String("method", r.Method),
+				slog.String("target", utils.CutLog(r.URL.Path)),
+			}
+
+			if correlationID := r.Header.Get("X-Correlation-ID"); correlationID != "" {
+				attrs = append(attrs, slog.String("correlation_id", utils.CutLog(correlationID)))
+			}
+
+			if user, _, found := r.BasicAuth(); found {
+				attrs = append(attrs, slog.String("user", utils.CutLog(user)))
+			}
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+
+			attrs = append(attrs, slog.Int("status", recorder.status))
+
+			slog.LogAttrs(ctx, slog.LevelInfo, "access", attrs...)
+		})
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"flag"
@@ -16,6 +17,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -24,7 +26,6 @@ import (
 	"github.com/AlphaOne1/geany"
 	"github.com/AlphaOne1/midgard"
 	"github.com/AlphaOne1/midgard/defs"
-	"github.com/AlphaOne1/midgard/handler/accesslog"
 	"github.com/AlphaOne1/midgard/handler/correlation"
 	"github.com/AlphaOne1/midgard/helper"
 
@@ -34,6 +35,8 @@ import (
 	"github.com/AlphaOne1/sonicred/utils"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // ServerName is the reported server name in the header.
@@ -54,6 +57,9 @@ var ErrEmptyRootPath = errors.New("root path must not be empty")
 // ErrInvalidBasePath indicates that the base path configuration must start with a forward slash (/).
 var ErrInvalidBasePath = errors.New("base path must start with /")
 
+// ErrInvalidCompression indicates that the compression parameters are out of range.
+var ErrInvalidCompression = errors.New("invalid compression parameter")
+
 // ErrInconsistentTraceParameters indicates that the trace-endpoint parameter is set while telemetry is disabled.
 var ErrInconsistentTraceParameters = errors.New("trace-endpoint parameter is set, but telemetry is disabled")
 
@@ -89,17 +95,45 @@ type ServerConfig struct {
 	BasePath          string
 	ListenPort        string
 	ListenAddress     string
+	HTTPPort          string
 	TLSCert           string
 	TLSKey            string
+	TLSPairs          *MultiStringValue
+	TLSDefault        string
+	TLSProfile        string
+	TLSMinVersion     string
+	TLSMaxVersion     string
+	TLSCiphers        *MultiStringValue
+	TLSCurves         *MultiStringValue
+	TLSALPN           *MultiStringValue
+	TLSTicketRotation time.Duration
+	OCSPStaple        bool
 	ClientCAs         *MultiStringValue
+	ClientAuth        string
+	ClientIDHeader    string
+	ClientCRLs        *MultiStringValue
+	ClientOCSP        bool
+	RevocationPolicy  string
 	AcmeDomains       *MultiStringValue
 	CertCache         string
 	AcmeEndpoint      string
+	AcmeEABKID        string
+	AcmeEABKey        string
+	AcmeEABKeyFile    string
+	AcmeRoots         string
+	AcmeEmail         string
+	AcmeKeyType       string
+	AcmeRenewBefore   time.Duration
 	IndexEnabled      bool
 	Headers           *MultiStringValue
 	HeadersFiles      *MultiStringValue
 	TryFiles          *MultiStringValue
 	WafCfg            *MultiStringValue
+	ErrorPages        *MultiStringValue
+	RewriteFiles      *MultiStringValue
+	RewriteStage      string
+	RewriteTests      *MultiStringValue
+	DefaultLang       string
 	InstrumentPort    string
 	InstrumentAddress string
 	EnableTelemetry   bool
@@ -108,63 +142,332 @@ type ServerConfig struct {
 	LogLevel          string
 	LogStyle          string
 	PrintVersion      bool
+	ConfigFile        string
+	WatchConfig       time.Duration
+	CheckConfig       bool
+	DefaultHost       string
+	Hosts             []HostConfig
+	HeaderRules       []headerRule
+	CorsPolicies      []corsPolicy
+	BasicAuth         []basicAuthRule
+	ClientCerts       []clientCertRule
+	OIDC              *oidcConfig
+	Bearer            *bearerConfig
+	Compress          bool
+	CompressTypes     *MultiStringValue
+	CompressMinSize   int
+	CompressCacheSize int
+	ImageFormats      *MultiStringValue
+
+	// Sources holds for each option, identified by its flag name, where its effective value originates from.
+	Sources map[string]ValueSource
+	// Values holds the effective value of each option, identified by its flag name, for reporting purposes.
+	Values map[string]any
+	// Sections holds the structured sections of the configuration file, like the virtual hosts, keyed by their
+	// name, for reporting purposes.
+	Sections map[string]*yaml.Node
+}
+
+// source gives the origin of the value of the option with the given flag name.
+func (c ServerConfig) source(name string) ValueSource {
+	if s, found := c.Sources[name]; found {
+		return s
+	}
+
+	return ValueSource{Kind: SourceDefault}
+}
+
+// reportedValue gives the value of the option with the given flag name as logged and reported, with the values
+// of secret options redacted.
+func (c ServerConfig) reportedValue(name string) any {
+	if value := c.Values[name]; !slices.Contains(secretOptions, name) || value == "" {
+		return value
+	}
+
+	return RedactedValue
+}
+
+// setupFlags defines and parses all command line flags, merging them with the environment and the
+// configuration file, if given. A leading "check" subcommand is equivalent to the -checkconfig flag.
+func setupFlags() (ServerConfig, error) {
+	args := os.Args[1:]
+	checkCommand := len(args) > 0 && args[0] == CheckCommand
+
+	if checkCommand {
+		args = args[1:]
+	}
+
+	config, err := parseConfig(flag.CommandLine, args, os.Environ())
+	config.CheckConfig = config.CheckConfig || checkCommand
+
+	return config, err
 }
 
-// setupFlags defines and parses all command line flags.
-func setupFlags() ServerConfig {
+// RedactedValue replaces the values of secret options in the log and the configuration report.
+const RedactedValue = "[redacted]"
+
+// secretOptions lists the options holding secrets. Their values are neither logged nor reported, only whether
+// they are set. Prefer the options reading secrets from files, where available.
+var secretOptions = []string{"acmeeabkey"}
+
+// parseConfig defines all options in the given flag set and parses the arguments. Options not set on the
+// command line are taken from the SONICRED_ environment variables, then from the configuration file, if given.
+func parseConfig(flagSet *flag.FlagSet, args []string, environ []string) (ServerConfig, error) {
 	config := ServerConfig{
-		ClientCAs:    &MultiStringValue{},
-		AcmeDomains:  &MultiStringValue{},
-		Headers:      &MultiStringValue{},
-		HeadersFiles: &MultiStringValue{},
-		TryFiles:     &MultiStringValue{},
-		WafCfg:       &MultiStringValue{},
-	}
-
-	flag.StringVar(&config.RootPath, "root", "/www", "root directory for webserver")
-	flag.StringVar(&config.BasePath, "base", "/", "base path for serving")
-	flag.StringVar(&config.ListenPort, "port", "8080", "port to listen on")
-	flag.StringVar(&config.ListenAddress, "address", "", "address to listen on")
-	flag.StringVar(&config.TLSCert, "tlscert", "", "tls certificate file")
-	flag.StringVar(&config.TLSKey, "tlskey", "", "tls key file")
-	flag.Var(config.ClientCAs, "clientca", "client certificate authority file for mTLS")
-	flag.Var(config.AcmeDomains, "acmedomain", "domain for automatic certificate retrieval")
-	flag.StringVar(&config.CertCache, "certcache", os.TempDir(), "directory for certificate cache")
-	flag.StringVar(&config.AcmeEndpoint, "acmeendpoint", "", " acme endpoint to use")
-	flag.BoolVar(&config.IndexEnabled, "index", true, "enable directory listing")
-	flag.Var(config.Headers, "header", "additional HTTP header")
-	flag.Var(config.HeadersFiles, "headerfile", "file containing additional HTTP headers")
-	flag.Var(config.TryFiles, "tryfile", "always try to load file expression first")
-	flag.Var(config.WafCfg, "wafcfg", "waf configuration file")
-	flag.StringVar(&config.InstrumentPort, "iport", "8081", "port to listen on for instrumentation")
-	flag.StringVar(&config.InstrumentAddress, "iaddress", "", "address to listen on for instrumentation")
-	flag.BoolVar(&config.EnableTelemetry, "telemetry", true, "enable telemetry support")
-	flag.StringVar(&config.TraceEndpoint, "trace-endpoint", "", "deprecated, endpoint for tracing data")
-	flag.BoolVar(&config.EnablePprof, "pprof", false, "enable pprof support")
-	flag.StringVar(&config.LogLevel, "log", "info", "log level, valid options are debug, info, warn and error")
-	flag.StringVar(&config.LogStyle, "logstyle", "auto", "log style, valid options are auto, text and json")
-	flag.BoolVar(&config.PrintVersion, "version", false, "print version and exit")
-
-	flag.Parse()
-
-	return config
+		TLSPairs:      &MultiStringValue{},
+		ClientCAs:     &MultiStringValue{},
+		ClientCRLs:    &MultiStringValue{},
+		AcmeDomains:   &MultiStringValue{},
+		TLSCiphers:    &MultiStringValue{},
+		TLSCurves:     &MultiStringValue{},
+		TLSALPN:       &MultiStringValue{},
+		Headers:       &MultiStringValue{},
+		HeadersFiles:  &MultiStringValue{},
+		TryFiles:      &MultiStringValue{},
+		WafCfg:        &MultiStringValue{},
+		ErrorPages:    &MultiStringValue{},
+		RewriteFiles:  &MultiStringValue{},
+		RewriteTests:  &MultiStringValue{},
+		CompressTypes: &MultiStringValue{},
+		ImageFormats:  &MultiStringValue{},
+	}
+
+	flagSet.StringVar(&config.RootPath, "root", "/www", "root directory for webserver")
+	flagSet.StringVar(&config.BasePath, "base", "/", "base path for serving")
+	flagSet.StringVar(&config.ListenPort, "port", "8080", "port to listen on")
+	flagSet.StringVar(&config.ListenAddress, "address", "", "address to listen on")
+	flagSet.StringVar(&config.HTTPPort, "httpport", "", "plain http port for ACME challenges and redirects to https")
+	flagSet.StringVar(&config.TLSCert, "tlscert", "", "tls certificate file")
+	flagSet.StringVar(&config.TLSKey, "tlskey", "", "tls key file")
+	flagSet.Var(config.TLSPairs, "tlspair", "additional tls certificate and key file, separated by comma")
+	flagSet.StringVar(&config.TLSDefault, "tlsdefault", "", "tls certificate file for clients without matching name")
+	flagSet.StringVar(&config.TLSProfile, "tlsprofile", TLSProfileModern,
+		"tls profile, valid options are modern, intermediate and custom")
+	flagSet.StringVar(&config.TLSMinVersion, "tlsminversion", "", "minimum tls version of the custom profile")
+	flagSet.StringVar(&config.TLSMaxVersion, "tlsmaxversion", "", "maximum tls version of the custom profile")
+	flagSet.Var(config.TLSCiphers, "tlscipher", "tls 1.2 cipher suite of the custom profile")
+	flagSet.Var(config.TLSCurves, "tlscurve", "key exchange curve of the custom profile, in order of preference")
+	flagSet.Var(config.TLSALPN, "tlsalpn", "application protocol offered to tls clients, in order of preference")
+	flagSet.DurationVar(&config.TLSTicketRotation, "tlsticketrotation", 0, "interval to rotate the session ticket key")
+	flagSet.BoolVar(&config.OCSPStaple, "ocspstaple", false, "staple OCSP responses to the tls certificates")
+	flagSet.Var(config.ClientCAs, "clientca", "client certificate authority file for mTLS")
+	flagSet.StringVar(&config.ClientAuth, "clientauth", ClientAuthRequire,
+		"client certificate mode, valid options are request, verify-if-given and require")
+	flagSet.StringVar(&config.ClientIDHeader, "clientidheader", "", "response header with the client certificate identity")
+	flagSet.Var(config.ClientCRLs, "clientcrl", "certificate revocation list file for client certificates")
+	flagSet.BoolVar(&config.ClientOCSP, "clientocsp", false, "check client certificates using OCSP")
+	flagSet.StringVar(&config.RevocationPolicy, "revocationpolicy", RevocationPolicySoft,
+		"policy for client certificates of unknown revocation status, valid options are soft and hard")
+	flagSet.Var(config.AcmeDomains, "acmedomain", "domain for automatic certificate retrieval")
+	flagSet.StringVar(&config.CertCache, "certcache", os.TempDir(), "directory for certificate cache")
+	flagSet.StringVar(&config.AcmeEndpoint, "acmeendpoint", "", " acme endpoint to use")
+	flagSet.StringVar(&config.AcmeEABKID, "acmeeabkid", "", "key id of the acme external account binding")
+	flagSet.StringVar(&config.AcmeEABKey, "acmeeabkey", "", "base64url encoded key of the acme external account binding")
+	flagSet.StringVar(&config.AcmeEABKeyFile, "acmeeabkeyfile", "",
+		"file containing the base64url encoded key of the acme external account binding")
+	flagSet.StringVar(&config.AcmeRoots, "acmeroots", "", "root certificate bundle trusted for the acme endpoint")
+	flagSet.StringVar(&config.AcmeEmail, "acmeemail", "", "contact email of the acme account")
+	flagSet.StringVar(&config.AcmeKeyType, "acmekeytype", ACMEKeyTypeECDSA,
+		"preferred key type of acme certificates, valid options are ecdsa and rsa")
+	flagSet.DurationVar(&config.AcmeRenewBefore, "acmerenewbefore", 0,
+		"time before expiry to renew acme certificates, default 30 days or a third of the lifetime")
+	flagSet.BoolVar(&config.IndexEnabled, "index", true, "enable directory listing")
+	flagSet.Var(config.Headers, "header", "additional HTTP header")
+	flagSet.Var(config.HeadersFiles, "headerfile", "file containing additional HTTP headers")
+	flagSet.Var(config.TryFiles, "tryfile", "always try to load file expression first")
+	flagSet.Var(config.WafCfg, "wafcfg", "waf configuration file")
+	flagSet.Var(config.ErrorPages, "errorpage", "error page for a status code or class, e.g., 404=/errors/404.html")
+	flagSet.Var(config.RewriteFiles, "rewritefile", "file containing redirect and rewrite rules")
+	flagSet.StringVar(&config.RewriteStage, "rewritestage", RewriteStageBefore,
+		"apply the rewrite rules before or after stripping the base path")
+	flagSet.Var(config.RewriteTests, "rewritetest", "print the rewrite rules matching the URL and exit")
+	flagSet.StringVar(&config.DefaultLang, "defaultlang", "", "language of the variant served if no other matches")
+	flagSet.BoolVar(&config.Compress, "compress", true, "enable on-the-fly compression of responses")
+	flagSet.Var(config.CompressTypes, "compresstype", "media type to compress on the fly")
+	flagSet.IntVar(&config.CompressMinSize, "compressminsize", 1024, "minimum size of responses to compress")
+	flagSet.IntVar(&config.CompressCacheSize, "compresscache", 64, "size of the cache of compressed files in MiB")
+	flagSet.Var(config.ImageFormats, "imageformat", "image format variant to serve, in order of preference")
+	flagSet.StringVar(&config.InstrumentPort, "iport", "8081", "port to listen on for instrumentation")
+	flagSet.StringVar(&config.InstrumentAddress, "iaddress", "", "address to listen on for instrumentation")
+	flagSet.BoolVar(&config.EnableTelemetry, "telemetry", true, "enable telemetry support")
+	flagSet.StringVar(&config.TraceEndpoint, "trace-endpoint", "", "deprecated, endpoint for tracing data")
+	flagSet.BoolVar(&config.EnablePprof, "pprof", false, "enable pprof support")
+	flagSet.StringVar(&config.LogLevel, "log", "info", "log level, valid options are debug, info, warn and error")
+	flagSet.StringVar(&config.LogStyle, "logstyle", "auto", "log style, valid options are auto, text and json")
+	flagSet.BoolVar(&config.PrintVersion, "version", false, "print version and exit")
+	flagSet.StringVar(&config.ConfigFile, "config", "", "configuration file")
+	flagSet.StringVar(&config.DefaultHost, "defaulthost", "", "virtual host serving requests for unknown hosts")
+	flagSet.BoolVar(&config.CheckConfig, "checkconfig", false, "check the configuration, print it and exit")
+	flagSet.DurationVar(&config.WatchConfig, "watchconfig", 0, "interval to check the configuration file for changes")
+
+	if err := flagSet.Parse(args); err != nil {
+		return config, fmt.Errorf("could not parse arguments: %w", err)
+	}
+
+	config.Sources = flagSources(flagSet)
+
+	if err := applyEnvironment(flagSet, environ, config.Sources); err != nil {
+		return config, err
+	}
+
+	if len(config.ConfigFile) > 0 {
+		sections, err := applyConfigFile(flagSet, config.ConfigFile, config.Sources)
+
+		if err != nil {
+			return config, err
+		}
+
+		config.Sections = sections
+
+		if rules, found := sections[configHeaderRulesKey]; found {
+			if config.HeaderRules, err = parseHeaderRuleConfigs(rules, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if policies, found := sections[configCorsKey]; found {
+			if config.CorsPolicies, err = parseCorsPolicyConfigs(policies, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if rules, found := sections[configBasicAuthKey]; found {
+			if config.BasicAuth, err = parseBasicAuthConfigs(rules, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if rules, found := sections[configClientCertsKey]; found {
+			if config.ClientCerts, err = parseClientCertRuleConfigs(rules, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if settings, found := sections[configOIDCKey]; found {
+			if config.OIDC, err = parseOIDCConfig(settings, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if settings, found := sections[configBearerKey]; found {
+			if config.Bearer, err = parseBearerConfig(settings, config.ConfigFile); err != nil {
+				return config, err
+			}
+		}
+
+		if hosts, found := sections[configHostsKey]; found {
+			if config.Hosts, err = parseHostConfigs(hosts, config.ConfigFile, config.mainHost()); err != nil {
+				return config, err
+			}
+		}
+	}
+
+	config.Values = optionValues(flagSet)
+
+	return config, nil
 }
 
+// checkConfigConsistency validates the merged configuration. Each reported error names the source of the
+// offending value, e.g. the file and line of the configuration file.
 func checkConfigConsistency(config ServerConfig) error {
 	var errs []error
 
 	if config.RootPath == "" {
-		errs = append(errs, ErrEmptyRootPath)
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrEmptyRootPath, config.source("root")))
 	}
 
 	if !strings.HasPrefix(config.BasePath, "/") {
-		errs = append(errs, ErrInvalidBasePath)
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrInvalidBasePath, config.source("base")))
 	}
 
 	if !config.EnableTelemetry && config.TraceEndpoint != "" {
-		errs = append(errs, ErrInconsistentTraceParameters)
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrInconsistentTraceParameters, config.source("trace-endpoint")))
 	}
 
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", errLogConfig, config.LogLevel, config.source("log")))
+	}
+
+	if !slices.Contains([]string{"auto", "text", "json"}, config.LogStyle) {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", errLogConfig, config.LogStyle, config.source("logstyle")))
+	}
+
+	if !slices.Contains([]string{RewriteStageBefore, RewriteStageAfter}, config.RewriteStage) {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)",
+			ErrInvalidRewriteStage, config.RewriteStage, config.source("rewritestage")))
+	}
+
+	if !validLanguage(config.DefaultLang) {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidLanguage, config.DefaultLang, config.source("defaultlang")))
+	}
+
+	if config.CompressMinSize < 0 {
+		errs = append(errs, fmt.Errorf("%w: minimum size %d (%v)",
+			ErrInvalidCompression, config.CompressMinSize, config.source("compressminsize")))
+	}
+
+	if config.CompressCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("%w: cache size %d (%v)",
+			ErrInvalidCompression, config.CompressCacheSize, config.source("compresscache")))
+	}
+
+	if _, found := clientAuthModes[config.ClientAuth]; !found {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidClientAuth, config.ClientAuth, config.source("clientauth")))
+	}
+
+	if len(*config.ClientCAs) == 0 && (len(config.ClientCerts) > 0 ||
+		slices.ContainsFunc(config.Hosts, func(h HostConfig) bool { return len(h.ClientCerts) > 0 })) {
+
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrClientCertsWithoutCA, config.source("clientca")))
+	}
+
+	for _, pair := range *config.TLSPairs {
+		if cert, key, found := strings.Cut(pair, ","); !found || len(cert) == 0 || len(key) == 0 {
+			errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidTLSPair, pair, config.source("tlspair")))
+		}
+	}
+
+	if len(config.TLSDefault) > 0 && !slices.ContainsFunc(config.certKeyPairs(), func(pair certKeyPair) bool {
+		return pair.cert == config.TLSDefault
+	}) {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrUnknownDefaultCert, config.TLSDefault, config.source("tlsdefault")))
+	}
+
+	if config.RevocationPolicy != RevocationPolicySoft && config.RevocationPolicy != RevocationPolicyHard {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)",
+			ErrInvalidRevocationPolicy, config.RevocationPolicy, config.source("revocationpolicy")))
+	}
+
+	if len(*config.ClientCAs) == 0 && (len(*config.ClientCRLs) > 0 || config.ClientOCSP) {
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrRevocationWithoutCA, config.source("clientca")))
+	}
+
+	if config.AcmeKeyType != ACMEKeyTypeECDSA && config.AcmeKeyType != ACMEKeyTypeRSA {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)",
+			ErrInvalidACMEKeyType, config.AcmeKeyType, config.source("acmekeytype")))
+	}
+
+	if config.AcmeRenewBefore < 0 {
+		errs = append(errs, fmt.Errorf("%w: %v (%v)",
+			ErrInvalidACMERenewal, config.AcmeRenewBefore, config.source("acmerenewbefore")))
+	}
+
+	errs = append(errs, checkEABConsistency(config))
+
+	if len(config.HTTPPort) > 0 && len(config.certKeyPairs()) == 0 && len(*config.AcmeDomains) == 0 {
+		errs = append(errs, fmt.Errorf("%w (%v)", ErrHTTPPortWithoutTLS, config.source("httpport")))
+	}
+
+	errs = append(errs, checkTLSConsistency(config))
+
+	if _, err := lookupImageFormats(*config.ImageFormats); err != nil {
+		errs = append(errs, fmt.Errorf("%w (%v)", err, config.source("imageformat")))
+	}
+
+	errs = append(errs, checkHostConsistency(config))
+
 	return errors.Join(errs...)
 }
 
@@ -208,30 +511,61 @@ func setupTelemetryEnvVars(traceEndpoint string) error {
 	return errors.Join(errs...)
 }
 
-// generateFileHandler generates the handlers to serve the files, initializing all necessary middlewares.
-func generateFileHandler(
-	enableTelemetry bool,
-	basePath string,
-	rootPath string,
-	indexEnabled bool,
-	additionalHeaders [][2]string,
-	tryFiles []string,
-	wafCfg []string) (http.Handler, func(), error) {
+// fileHandlerSettings holds everything the file handler of a host and its middlewares are built from.
+type fileHandlerSettings struct {
+	telemetry      bool
+	basePath       string
+	rootPath       string
+	indexEnabled   bool
+	headers        [][2]string
+	tryFiles       []string
+	wafCfg         []string
+	compression    compressionSettings
+	errorPages     []string
+	rewrites       rewriteSettings
+	defaultLang    string
+	imageFormats   []string
+	cors           []corsPolicy
+	basicAuth      []basicAuthRule
+	clientCerts    []clientCertRule
+	clientIDHeader string
+	oidc           *oidcConfig
+	bearer         *bearerConfig
+}
 
+// generateFileHandler generates the handlers to serve the files, initializing all necessary middlewares.
+func generateFileHandler(settings fileHandlerSettings) (http.Handler, func(), error) {
 	mwStack := make([]defs.Middleware, 0, 4)
 
-	if enableTelemetry {
+	if settings.telemetry {
 		mwStack = append(mwStack, otelhttp.NewMiddleware("fileserver"))
 	}
 
-	root, rootErr := os.OpenRoot(rootPath)
+	pages, pagesErr := parseErrorPages(settings.errorPages)
+
+	if pagesErr != nil {
+		return nil, func() {}, pagesErr
+	}
+
+	formats, formatsErr := lookupImageFormats(settings.imageFormats)
+
+	if formatsErr != nil {
+		return nil, func() {}, formatsErr
+	}
+
+	root, rootErr := os.OpenRoot(settings.rootPath)
 
 	if rootErr != nil {
 		return nil, func() {}, fmt.Errorf("could not open root: %w", rootErr)
 	}
 
-	if len(wafCfg) > 0 {
-		wafMW, wafMWErr := wafMiddleware(wafCfg)
+	// the correlation ID is set before the error pages, so that they can show it also for blocked requests
+	mwStack = append(mwStack,
+		helper.Must(correlation.New()),
+		errorPages(root.FS(), pages))
+
+	if len(settings.wafCfg) > 0 {
+		wafMW, wafMWErr := wafMiddleware(settings.wafCfg)
 
 		if wafMWErr != nil {
 			if err := root.Close(); err != nil {
@@ -256,18 +590,60 @@ func generateFileHandler(
 		return nil, func() {}, fmt.Errorf("could not get StatFS from RootFS: %w", ErrConversion)
 	}
 
+	tryFilesMW, tryFilesErr := addTryFiles(settings.tryFiles, statFS)
+
+	if tryFilesErr != nil {
+		if err := root.Close(); err != nil {
+			slog.Error("failed to close root filesystem",
+				slog.String("error", err.Error()))
+		}
+
+		return nil, func() {}, tryFilesErr
+	}
+
+	basicAuthMW, basicAuthErr := basicAuthentication(settings.basicAuth)
+	oidcMW, oidcErr := oidcAuthentication(settings.oidc, settings.basePath)
+	bearerIdentityMW, bearerMW, bearerErr := bearerAuthentication(settings.bearer)
+
+	if err := errors.Join(basicAuthErr, oidcErr, bearerErr); err != nil {
+		if err := root.Close(); err != nil {
+			slog.Error("failed to close root filesystem",
+				slog.String("error", err.Error()))
+		}
+
+		return nil, func() {}, err
+	}
+
+	authorizeRequested, authorizeResolved := pathAuthorization(settings.basePath,
+		clientCertAuthorization(settings.clientCerts),
+		basicAuthMW,
+		oidcMW,
+		bearerMW)
+
 	mwStack = append(mwStack,
 		// handlers that see the basePath prefix
-		addHeaders(additionalHeaders),
-		helper.Must(correlation.New()),
-		helper.Must(accesslog.New()),
+		addHeaders(settings.headers),
+		// the client identities are added before the access log, so that they are logged there
+		exposeClientIdentity(settings.clientIDHeader),
+		bearerIdentityMW,
+		accessLog(),
+		corsPolicies(settings.cors),
+		authorizeRequested,
+		settings.rewrites.middleware(RewriteStageBefore),
 		func(next http.Handler) http.Handler {
-			return http.StripPrefix(basePath, next)
+			return http.StripPrefix(settings.basePath, next)
 		},
 		// handlers that operate on the filesystem, no basePath prefix
-		addTryFiles(tryFiles, statFS),
+		settings.rewrites.middleware(RewriteStageAfter),
+		tryFilesMW,
+		// rewrites and try-files must not lead to protected paths
+		authorizeResolved,
 		checkValidFilePath(),
-		helper.Must(dirindex.DirIndex(statFS, indexEnabled, basePath, rootPath)))
+		languageNegotiation(statFS, settings.defaultLang),
+		imageVariants(statFS, formats),
+		compressResponses(statFS, settings.compression),
+		helper.Must(dirindex.DirIndex(statFS, settings.indexEnabled, settings.basePath, settings.rootPath)),
+		precompressedFiles(statFS))
 
 	return midgard.StackMiddlewareHandler(
 			mwStack,
@@ -310,7 +686,7 @@ func setupInstrumentation(
 		slog.SetDefault(
 			slog.New(slog.NewMultiHandler(
 				slog.Default().Handler(),
-				logger.Handler())))
+				contextAttrsHandler{logger.Handler()})))
 	}
 
 	cleanup := func(ctx context.Context) {
@@ -325,42 +701,194 @@ func setupInstrumentation(
 	return metricHandler, cleanup, nil
 }
 
-// run initializes all necessary parts and starts the server.
-// It returns the desired process exit code.
-func run(signalShutdown context.Context) int {
-	_ = geany.PrintLogo(logoTmpl, map[string]string{"Tag": buildInfoTag, "ExeTime": utils.ExecutableTime()})
+// generateHostHandler builds the handler serving the files of a single host, including the file handler and its
+// middlewares, according to the host configuration.
+func generateHostHandler(config ServerConfig, host HostConfig) (http.Handler, func(), error) {
+	headers, headerRules, headersErr := headerFilesToHeaders(*host.HeadersFiles)
+
+	if headersErr != nil {
+		return nil, func() {}, fmt.Errorf("could not process headers files %v: %w", *host.HeadersFiles, headersErr)
+	}
+
+	rewriteRules, rewriteErr := readRewriteFiles(*host.RewriteFiles)
+
+	if rewriteErr != nil {
+		return nil, func() {}, fmt.Errorf("could not process rewrite files %v: %w", *host.RewriteFiles, rewriteErr)
+	}
+
+	handler, handlerCleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+		telemetry:      config.EnableTelemetry,
+		basePath:       host.BasePath,
+		rootPath:       host.RootPath,
+		indexEnabled:   host.IndexEnabled,
+		headers:        append(headerParamToHeaders(*host.Headers), headers...),
+		tryFiles:       *host.TryFiles,
+		wafCfg:         *host.WafCfg,
+		compression:    config.compressionSettings(),
+		errorPages:     *host.ErrorPages,
+		rewrites:       rewriteSettings{rules: rewriteRules, stage: host.RewriteStage},
+		defaultLang:    host.DefaultLang,
+		imageFormats:   *config.ImageFormats,
+		cors:           host.CorsPolicies,
+		basicAuth:      host.BasicAuth,
+		clientCerts:    host.ClientCerts,
+		clientIDHeader: config.ClientIDHeader,
+		oidc:           host.OIDC,
+		bearer:         host.Bearer,
+	})
+
+	if handlerErr != nil {
+		return nil, func() {}, handlerErr
+	}
+
+	handler = applyHeaderRules(append(slices.Clone(host.HeaderRules), headerRules...))(handler)
+
+	if !strings.HasSuffix(host.BasePath, "/") {
+		slog.Warn("base path does not end with a slash, just serving the exact file",
+			slog.String("path", host.BasePath))
+	}
+
+	// remove all implicitly registered handlers
+	serverMux := http.NewServeMux()
+	serverMux.Handle("GET "+host.BasePath, handler)
+
+	// preflight requests of cross-origin requests are answered by the cors middleware
+	if len(host.CorsPolicies) > 0 {
+		serverMux.Handle("OPTIONS "+host.BasePath, handler)
+	}
+
+	return serverMux, handlerCleanup, nil
+}
+
+// generateServerHandler builds the complete handler of the server. Without virtual hosts, this is just the
+// handler of the main host. Otherwise, requests are dispatched using their Host header to the handlers of
+// the virtual hosts. Unmatched requests go to the default host, if configured, or to the main host.
+func generateServerHandler(config ServerConfig) (http.Handler, func(), error) {
+	if len(config.Hosts) == 0 {
+		return generateHostHandler(config, config.mainHost())
+	}
+
+	hostHandlers := make(map[string]http.Handler)
+	cleanups := make([]func(), 0, len(config.Hosts)+1)
+
+	cleanupAll := func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+
+	for _, host := range config.Hosts {
+		slog.Info("registering virtual host",
+			slog.Any("names", host.Names),
+			slog.String("root", host.RootPath),
+			slog.String("base", host.BasePath))
+
+		handler, cleanup, err := generateHostHandler(config, host)
 
-	// Parse command line flags
-	config := setupFlags()
+		if err != nil {
+			cleanupAll()
+			return nil, func() {}, fmt.Errorf("could not generate handler for host %v: %w", host.Names, err)
+		}
+
+		cleanups = append(cleanups, cleanup)
+
+		for _, name := range host.Names {
+			hostHandlers[normalizeHostName(name)] = handler
+		}
+	}
+
+	defaultHandler := hostHandlers[normalizeHostName(config.DefaultHost)]
+
+	if config.usesMainHost() {
+		handler, cleanup, err := generateHostHandler(config, config.mainHost())
+
+		if err != nil {
+			cleanupAll()
+			return nil, func() {}, err
+		}
+
+		cleanups = append(cleanups, cleanup)
+		defaultHandler = handler
+	}
+
+	return virtualHostHandler(hostHandlers, defaultHandler), cleanupAll, nil
+}
+
+// generateServerTLSConfig generates the TLS configuration of the server, using the certificates of the main host
+// and all virtual hosts. certManager is the one shared with the plain HTTP server, see newSharedACMEManager.
+func generateServerTLSConfig(config ServerConfig, certManager *autocert.Manager) (*tls.Config, error) {
+	return generateTLSConfig(
+		config.certKeyPairs(),
+		config.acmeSettings(),
+		config.tlsSettings(),
+		*config.ClientCAs,
+		config.ClientAuth,
+		revocationSettings{
+			crlFiles: *config.ClientCRLs,
+			ocsp:     config.ClientOCSP,
+			policy:   config.RevocationPolicy,
+		},
+		config.hostNames(),
+		certManager,
+		config.OCSPStaple)
+}
+
+// run initializes all necessary parts and starts the server. Every signal received on reloadSignal
+// reloads the configuration. It returns the desired process exit code.
+func run(signalShutdown context.Context, reloadSignal <-chan os.Signal) int {
+	// Parse command line flags and configuration file
+	config, configErr := setupFlags()
+
+	// the output of the check and rewrite test modes is to be processed by machines, so we do not clutter it
+	if !config.CheckConfig && len(*config.RewriteTests) == 0 {
+		_ = geany.PrintLogo(logoTmpl, map[string]string{"Tag": buildInfoTag, "ExeTime": utils.ExecutableTime()})
+	}
+
+	if configErr != nil {
+		slog.Error("invalid configuration", slog.String("error", configErr.Error()))
+		return 1
+	}
 
 	if config.PrintVersion {
 		// we already printed the logo that contains all the necessary information
 		return 0
 	}
 
+	if config.CheckConfig {
+		return checkConfig(config, os.Stdout)
+	}
+
+	if len(*config.RewriteTests) > 0 {
+		return testRewrites(config, os.Stdout)
+	}
+
 	if err := checkConfigConsistency(config); err != nil {
 		slog.Error("invalid configuration", slog.String("error", err.Error()))
 		return 1
 	}
 
-	if err := setupLogging(config.LogLevel, config.LogStyle); err != nil {
+	if err := setupLogging(os.Stdout, config.LogLevel, config.LogStyle); err != nil {
 		slog.Error("error setting up logging", slog.String("error", err.Error()))
 		return 1
 	}
 
 	slog.Info("logging", slog.String("level", config.LogLevel))
 
-	slog.Info("using root directory", slog.String("root", config.RootPath))
+	logConfigSources(config)
 
-	if _, statErr := os.Stat(config.RootPath); statErr != nil {
-		slog.Error("could not get info of root path",
-			slog.String("path", config.RootPath),
-			slog.String("error", statErr.Error()))
+	if config.usesMainHost() {
+		slog.Info("using root directory", slog.String("root", config.RootPath))
 
-		return 1
-	}
+		if _, statErr := os.Stat(config.RootPath); statErr != nil {
+			slog.Error("could not get info of root path",
+				slog.String("path", config.RootPath),
+				slog.String("error", statErr.Error()))
 
-	slog.Info("using base path", slog.String("path", config.BasePath))
+			return 1
+		}
+
+		slog.Info("using base path", slog.String("path", config.BasePath))
+	}
 
 	var metricHandler http.Handler
 
@@ -383,13 +911,14 @@ func run(signalShutdown context.Context) int {
 
 	slog.Info("registering handlers for FileServer")
 
-	tlsConfig, tlsConfigErr := generateTLSConfig(
-		config.TLSCert,
-		config.TLSKey,
-		*config.AcmeDomains,
-		config.CertCache,
-		config.AcmeEndpoint,
-		*config.ClientCAs)
+	certManager, certManagerErr := newSharedACMEManager(config.acmeSettings())
+
+	if certManagerErr != nil {
+		slog.Error("invalid TLS configuration", slog.String("error", certManagerErr.Error()))
+		return 1
+	}
+
+	tlsConfig, tlsConfigErr := generateServerTLSConfig(config, certManager)
 
 	if tlsConfigErr != nil {
 		slog.Error("invalid TLS configuration", slog.String("error", tlsConfigErr.Error()))
@@ -400,46 +929,61 @@ func run(signalShutdown context.Context) int {
 		Addr:              net.JoinHostPort(config.ListenAddress, config.ListenPort),
 		ReadHeaderTimeout: ReadTimeout,
 		ReadTimeout:       ReadTimeout,
-		TLSConfig:         tlsConfig,
 	}
 
 	defer func() { _ = server.Close() }()
 
-	headers, headersErr := headerFilesToHeaders(*config.HeadersFiles)
-
-	if headersErr != nil {
-		slog.Error("could not process headers file",
-			slog.Any("files", *config.HeadersFiles),
-			slog.String("error", headersErr.Error()))
+	reloader := configReloader{
+		args:        os.Args[1:],
+		config:      config,
+		handler:     &reloadableHandler{},
+		certManager: certManager,
+	}
 
-		return 1
+	if tlsConfig != nil {
+		reloader.tlsConfig = newReloadableTLSConfig(tlsConfig, config.TLSTicketRotation)
+		server.TLSConfig = reloader.tlsConfig.serverConfig()
 	}
 
-	handler, handlerCleanup, handlerErr := generateFileHandler(
-		config.EnableTelemetry,
-		config.BasePath,
-		config.RootPath,
-		config.IndexEnabled,
-		append(headerParamToHeaders(*config.Headers), headers...),
-		*config.TryFiles,
-		*config.WafCfg)
+	handler, handlerCleanup, handlerErr := generateServerHandler(config)
 
 	if handlerErr != nil {
 		slog.Error("could not generate file handlers", slog.String("error", handlerErr.Error()))
 		return 1
 	}
 
-	defer handlerCleanup()
+	reloader.handler.swap(handler, handlerCleanup)
+	server.Handler = reloader.handler
 
-	if !strings.HasSuffix(config.BasePath, "/") {
-		slog.Warn("base path does not end with a slash, just serving the exact file",
-			slog.String("path", config.BasePath))
+	defer reloader.handler.close()
+
+	var httpServer *http.Server
+
+	if len(config.HTTPPort) > 0 {
+		reloader.httpHandler = &reloadableHandler{}
+		reloader.httpHandler.swap(generateHTTPHandler(config, certManager), func() {})
+
+		httpServer = &http.Server{
+			Addr:              net.JoinHostPort(config.ListenAddress, config.HTTPPort),
+			Handler:           reloader.httpHandler,
+			ReadHeaderTimeout: ReadTimeout,
+			ReadTimeout:       ReadTimeout,
+		}
+
+		defer func() { _ = httpServer.Close() }()
 	}
 
-	// remove all implicitly registered handlers
-	serverMux := http.NewServeMux()
-	serverMux.Handle("GET "+config.BasePath, handler)
-	server.Handler = serverMux
+	configChanged := make(chan []string, 1)
+
+	go utils.WatchFiles(signalShutdown, config.WatchConfig, watchedConfigFiles(config), func(files []string) {
+		select {
+		case configChanged <- files:
+		default:
+			// a reload is already pending
+		}
+	})
+
+	go reloader.handleReloads(signalShutdown, reloadSignal, configChanged)
 
 	monitoringServer, monitoringServerErr := instrumentation.Server(
 		config.InstrumentAddress,
@@ -459,6 +1003,10 @@ func run(signalShutdown context.Context) int {
 		service.WithServer(&server, ServerName),
 	}
 
+	if httpServer != nil {
+		serviceOptions = append(serviceOptions, service.WithServer(httpServer, "http"))
+	}
+
 	if monitoringServer != nil {
 		serviceOptions = append(serviceOptions, service.WithServer(monitoringServer, "instrumentation"))
 	}
@@ -489,10 +1037,15 @@ func main() {
 	signalShutdown, signalShutdownFunc := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer signalShutdownFunc()
 
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+
+	defer signal.Stop(reloadSignal)
+
 	go func() {
 		<-signalShutdown.Done()
 		slog.Info("received shutdown signal, shutting down")
 	}()
 
-	exitFunc(run(signalShutdown))
+	exitFunc(run(signalShutdown, reloadSignal))
 }
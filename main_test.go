@@ -398,14 +398,11 @@ func TestSonicMainInvalidWAFFile(t *testing.T) {
 }
 
 func BenchmarkHandler(b *testing.B) {
-	fileHandler, fileCleanup, fileHandlerErr := generateFileHandler(
-		false,
-		"/",
-		"testroot/",
-		true,
-		nil,
-		nil,
-		nil)
+	fileHandler, fileCleanup, fileHandlerErr := generateFileHandler(fileHandlerSettings{
+		basePath:     "/",
+		rootPath:     "testroot/",
+		indexEnabled: true,
+	})
 
 	if fileHandlerErr != nil {
 		b.Fatalf("could not generate file handlers: %v", fileHandlerErr)
@@ -444,14 +441,11 @@ func BenchmarkHandler(b *testing.B) {
 func sonicMainHandlerTest(t *testing.T, uri string, method string, header string, headerValue string) {
 	t.Helper()
 
-	fileHandler, fileCleanup, fileHandlerErr := generateFileHandler(
-		false,
-		"/",
-		"testroot/",
-		true,
-		nil,
-		nil,
-		nil)
+	fileHandler, fileCleanup, fileHandlerErr := generateFileHandler(fileHandlerSettings{
+		basePath:     "/",
+		rootPath:     "testroot/",
+		indexEnabled: true,
+	})
 
 	if fileHandlerErr != nil {
 		t.Fatalf("could not generate file handlers: %v", fileHandlerErr)
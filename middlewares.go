@@ -5,16 +5,22 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AlphaOne1/midgard/handler/addheader"
 	"github.com/AlphaOne1/midgard/helper"
@@ -68,22 +74,30 @@ func headerParamToHeaders(param []string) [][2]string {
 }
 
 // headerFilesToHeaders reads the additional header information from the given files
-// and generates key-value pairs of them.
-func headerFilesToHeaders(files []string) ([][2]string, error) {
+// and generates key-value pairs of them. Headers following a section line form header rules,
+// that only apply to matching responses.
+func headerFilesToHeaders(files []string) ([][2]string, []headerRule, error) {
 	var allLines []string
+	var rules []headerRule
 
 	for _, filePath := range files {
 		slog.Info("reading additional header file", slog.String("file", filePath))
 
 		lines, err := readHeaderFile(filePath)
 		if err != nil {
-			return nil, fmt.Errorf("could not process header file %v: %w", filePath, err)
+			return nil, nil, fmt.Errorf("could not process header file %v: %w", filePath, err)
 		}
 
-		allLines = append(allLines, lines...)
+		global, fileRules, err := splitHeaderSections(lines)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not process header file %v: %w", filePath, err)
+		}
+
+		allLines = append(allLines, global...)
+		rules = append(rules, fileRules...)
 	}
 
-	return headerParamToHeaders(allLines), nil
+	return headerParamToHeaders(allLines), rules, nil
 }
 
 // readHeaderFile opens and reads a header file, returning the parsed header lines.
@@ -149,15 +163,65 @@ func addHeaders(headers [][2]string) func(http.Handler) http.Handler {
 	))
 }
 
+// ErrInvalidTryFile indicates that a try-file fallback could not be parsed or is not the last try-file.
+var ErrInvalidTryFile = errors.New("invalid try-file fallback, expected =<status> or =<status>:<path> as last entry")
+
+// tryFileFallback is the last try-file entry, given as =<status> or =<status>:<path>, used if none of the
+// expressions matches a file.
+type tryFileFallback struct {
+	status int
+	path   string
+}
+
+// parseTryFileFallback parses a try-file fallback entry. A fallback without path must have an error status,
+// a fallback with path may also be successful.
+func parseTryFileFallback(entry string) (*tryFileFallback, error) {
+	statusText, fallbackPath, hasPath := strings.Cut(strings.TrimPrefix(entry, "="), ":")
+	status, err := strconv.Atoi(statusText)
+
+	if err != nil ||
+		status < http.StatusOK || status > 599 ||
+		(status >= http.StatusMultipleChoices && status < http.StatusBadRequest) ||
+		(!hasPath && status < http.StatusBadRequest) ||
+		(hasPath && !strings.HasPrefix(fallbackPath, "/")) {
+
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTryFile, entry)
+	}
+
+	// preventing redirects due to file handlers redirecting /index.html to /
+	if strings.HasSuffix(fallbackPath, "/index.html") {
+		fallbackPath = fallbackPath[:len(fallbackPath)-len("index.html")]
+	}
+
+	return &tryFileFallback{status: status, path: fallbackPath}, nil
+}
+
 // preprocessTryFiles sanitizes and pre-processes a list of try-file patterns,
-// ensuring paths are adjusted for specific environments.
-func preprocessTryFiles(tries []string) []string {
+// ensuring paths are adjusted for specific environments. A last entry starting with = is
+// split off as fallback.
+func preprocessTryFiles(tries []string) ([]string, *tryFileFallback, error) {
 	result := make([]string, 0, len(tries))
 	windowsDriveRe := regexp.MustCompile(`(?i)^(?:[A-Z]:[\\/]|\\\\|//)`)
 
-	for _, tryFile := range tries {
+	var fallback *tryFileFallback
+
+	for i, tryFile := range tries {
 		slog.Info("registering try-files", slog.String("pattern", tryFile))
 
+		if strings.HasPrefix(tryFile, "=") {
+			if i != len(tries)-1 {
+				return nil, nil, fmt.Errorf("%w: %q", ErrInvalidTryFile, tryFile)
+			}
+
+			var err error
+
+			if fallback, err = parseTryFileFallback(tryFile); err != nil {
+				return nil, nil, err
+			}
+
+			continue
+		}
+
 		// preventing endless loops due to file handlers redirecting /index.html to /
 		if strings.HasSuffix(tryFile, "/index.html") {
 			tryFile = tryFile[:len(tryFile)-len("index.html")]
@@ -173,27 +237,120 @@ func preprocessTryFiles(tries []string) []string {
 		result = append(result, tryFile)
 	}
 
-	return result
+	return result, fallback, nil
+}
+
+// tryFileVariable gives the value of the variable usable in try-file expressions for the request. The path
+// related variables always start with a slash, even if the base path was stripped including its trailing slash.
+func tryFileVariable(name string, r *http.Request) string {
+	uri := "/" + strings.TrimPrefix(r.URL.Path, "/")
+	dir, file := path.Split(uri)
+
+	switch name {
+	case "uri":
+		return uri
+	case "host":
+		return normalizeHostName(r.Host)
+	case "query":
+		return r.URL.RawQuery
+	case "lang":
+		for _, lang := range utils.ParseLanguageHeader(r.Header.Get("Accept-Language")) {
+			if len(lang.Lang) > 0 && lang.Pref > 0 {
+				return strings.ToLower(lang.Lang)
+			}
+		}
+	case "dir":
+		return dir
+	case "basename":
+		return strings.TrimSuffix(file, path.Ext(file))
+	case "ext":
+		return path.Ext(file)
+	default:
+		slog.Warn("unknown variable in tryfile", slog.String("name", name))
+	}
+
+	return ""
+}
+
+// statusOverrideWriter sends successful responses with the given status code instead.
+type statusOverrideWriter struct {
+	http.ResponseWriter
+
+	status  int
+	written bool
+}
+
+// Unwrap gives the underlying response writer.
+func (sw *statusOverrideWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// WriteHeader writes the response header, replacing a successful status code.
+func (sw *statusOverrideWriter) WriteHeader(status int) {
+	if !sw.written && status == http.StatusOK {
+		status = sw.status
+	}
+
+	sw.written = true
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the response header, if not already done, and the data.
+func (sw *statusOverrideWriter) Write(data []byte) (int, error) {
+	if !sw.written {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	n, err := sw.ResponseWriter.Write(data)
+
+	if err != nil {
+		return n, fmt.Errorf("could not write response: %w", err)
+	}
+
+	return n, nil
+}
+
+// serveTryFileFallback answers a request, for which none of the try-files matched, according to the fallback.
+// Successful fallbacks are only used for paths without file extension, so that missing assets still give a 404
+// instead of, e.g., the page of a single-page application.
+func serveTryFileFallback(fallback *tryFileFallback, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case fallback.status < http.StatusBadRequest && len(path.Ext(r.URL.Path)) > 0:
+		next.ServeHTTP(w, r)
+	case len(fallback.path) == 0:
+		http.Error(w, http.StatusText(fallback.status), fallback.status)
+	case fallback.status == http.StatusOK:
+		r.URL.Path = fallback.path
+		next.ServeHTTP(w, r)
+	default:
+		// conditional and range requests make no sense for a replacement of the requested content
+		fallbackRequest := r.Clone(r.Context())
+		fallbackRequest.URL.Path = fallback.path
+
+		for _, header := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+			"If-Range", "Range"} {
+
+			fallbackRequest.Header.Del(header)
+		}
+
+		next.ServeHTTP(&statusOverrideWriter{ResponseWriter: w, status: fallback.status}, fallbackRequest)
+	}
 }
 
 // addTryFiles looks if the given URI matches an existing file.
-// If there is no file, a series of other files is tried instead.
-func addTryFiles(tries []string, fileSystem fs.StatFS) func(http.Handler) http.Handler {
-	tryFiles := preprocessTryFiles(tries)
+// If there is no file, a series of other files is tried instead. If none of them exists
+// either, the fallback, if given, determines the response.
+func addTryFiles(tries []string, fileSystem fs.StatFS) (func(http.Handler) http.Handler, error) {
+	tryFiles, fallback, err := preprocessTryFiles(tries)
+
+	if err != nil {
+		return nil, err
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			expandFunc := func(s string) string {
-				switch s {
-				case "uri":
-					return r.URL.Path
-				// case "query_params":
-				//		return r.URL.RawQuery
-				default:
-					slog.Warn("unknown variable in tryfile", slog.String("name", s))
-				}
-
-				return ""
+				return tryFileVariable(s, r)
 			}
 
 			for _, filename := range tryFiles {
@@ -227,10 +384,20 @@ func addTryFiles(tries []string, fileSystem fs.StatFS) func(http.Handler) http.H
 				return
 			}
 
+			if fallback != nil {
+				slog.Debug("no try-files matched, using fallback",
+					slog.Int("status", fallback.status),
+					slog.String("path", fallback.path))
+
+				serveTryFileFallback(fallback, next, w, r)
+
+				return
+			}
+
 			slog.Debug("no try-files matched")
 			next.ServeHTTP(w, r)
 		})
-	}
+	}, nil
 }
 
 // checkValidFilePath validates incoming request file paths for length and format, ensuring they are safe and compliant.
@@ -275,3 +442,179 @@ func checkValidFilePath() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// precompressedEncodings lists the content encodings of precompressed sidecar files together with their file
+// extension, in the order of server preference.
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{encoding: "br", extension: ".br"},
+	{encoding: "zstd", extension: ".zst"},
+	{encoding: "gzip", extension: ".gz"},
+}
+
+// negotiateEncoding selects the content encoding to use out of the available ones, based on the Accept-Encoding
+// header. Available encodings are given in order of server preference, that decides between equally preferred
+// encodings. If none of the available encodings is acceptable, the empty string is returned.
+func negotiateEncoding(acceptEncoding string, available []string) string {
+	prefs := utils.ParseEncodingHeader(acceptEncoding)
+
+	best := ""
+	bestPref := float32(0)
+
+	for _, encoding := range available {
+		pref := float32(0)
+
+		// an explicit entry for the encoding takes precedence over the wildcard
+		if i := slices.IndexFunc(prefs, func(p utils.EncodingPref) bool { return p.Encoding == encoding }); i >= 0 {
+			pref = prefs[i].Pref
+		} else if i := slices.IndexFunc(prefs, func(p utils.EncodingPref) bool { return p.Encoding == "*" }); i >= 0 {
+			pref = prefs[i].Pref
+		}
+
+		if pref > bestPref {
+			best, bestPref = encoding, pref
+		}
+	}
+
+	return best
+}
+
+// requestedFile determines the regular file served by the file handler for the given request path. Directories
+// are served by their index.html. Requests for index.html itself are not resolved, as the file handler redirects
+// them to the directory.
+func requestedFile(fileSystem fs.StatFS, urlPath string) (string, fs.FileInfo, bool) {
+	if strings.HasSuffix(urlPath, "/index.html") {
+		return "", nil, false
+	}
+
+	name := strings.TrimPrefix(urlPath, "/")
+
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+
+	info, statErr := fileSystem.Stat(name)
+
+	if statErr != nil || !info.Mode().IsRegular() {
+		return "", nil, false
+	}
+
+	return name, info, true
+}
+
+// addVary adds the field name to the Vary header, if it is not already listed.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for field := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", name)
+}
+
+// variantETag generates the entity tag of an encoded variant of a file. It identifies the compressed variant, so
+// that conditional and range requests match it instead of the uncompressed file.
+func variantETag(modTime time.Time, size int64, encoding string) string {
+	return `"` + strconv.FormatInt(modTime.UnixNano(), 36) + "-" + strconv.FormatInt(size, 36) + "-" + encoding + `"`
+}
+
+// originalContentType determines the content type of the uncompressed file, first by its extension, then by
+// sniffing its content.
+func originalContentType(fileSystem fs.FS, name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+
+	const SniffLength = 512
+
+	fh, err := fileSystem.Open(name)
+
+	if err != nil {
+		return "application/octet-stream"
+	}
+
+	defer func() { _ = fh.Close() }()
+
+	buf := make([]byte, SniffLength)
+	n, _ := io.ReadFull(fh, buf)
+
+	return http.DetectContentType(buf[:n])
+}
+
+// precompressedFiles serves precompressed sidecar files, e.g. app.js.br next to app.js, to clients accepting
+// their encoding. The sidecar is served with the content type of the original file, so that range and
+// conditional requests operate on the compressed variant.
+func precompressedFiles(fileSystem fs.StatFS) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, _, found := requestedFile(fileSystem, r.URL.Path)
+
+			if !found {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			available := make([]string, 0, len(precompressedEncodings))
+			sidecars := make(map[string]string, len(precompressedEncodings))
+
+			for _, p := range precompressedEncodings {
+				if info, statErr := fileSystem.Stat(name + p.extension); statErr == nil && info.Mode().IsRegular() {
+					available = append(available, p.encoding)
+					sidecars[p.encoding] = name + p.extension
+				}
+			}
+
+			if len(available) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addVary(w.Header(), "Accept-Encoding")
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), available)
+
+			if encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			fh, openErr := fileSystem.Open(sidecars[encoding])
+
+			if openErr != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			defer func() { _ = fh.Close() }()
+
+			info, infoErr := fh.Stat()
+			content, seekable := fh.(io.ReadSeeker)
+
+			if infoErr != nil || !seekable {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			slog.Debug("serving precompressed file",
+				slog.String("path", utils.CutLog(name)),
+				slog.String("encoding", encoding))
+
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", originalContentType(fileSystem, name))
+			}
+
+			if w.Header().Get("ETag") == "" {
+				w.Header().Set("ETag", variantETag(info.ModTime(), info.Size(), encoding))
+			}
+
+			w.Header().Set("Content-Encoding", encoding)
+
+			http.ServeContent(w, r, name, info.ModTime(), content)
+		})
+	}
+}
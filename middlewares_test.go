@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+
+	available := []string{"br", "zstd", "gzip"}
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "gzip, deflate, br, zstd", want: "br"},
+		{acceptEncoding: "gzip, zstd", want: "zstd"},
+		{acceptEncoding: "br;q=0.5, gzip", want: "gzip"},
+		{acceptEncoding: "br;q=0, *", want: "zstd"},
+		{acceptEncoding: "identity", want: ""},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestNegotiateEncoding-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.want, negotiateEncoding(test.acceptEncoding, available), test.acceptEncoding)
+		})
+	}
+}
+
+func TestPrecompressedFiles(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	files := map[string]string{
+		"app.js":    "plain content",
+		"app.js.br": "brotli content",
+		"app.js.gz": "gzip content",
+		"plain.txt": "no sidecars",
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{basePath: "/", rootPath: root})
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	request := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, uri, nil)
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := request("/app.js", map[string]string{"Accept-Encoding": "gzip, br"})
+
+	assert.Equal(t, http.StatusOK, rec.Code, "precompressed file served")
+	assert.Equal(t, "brotli content", rec.Body.String(), "preferred encoding served")
+	assert.Equal(t, "br", rec.Header().Get("Content-Encoding"), "content encoding set")
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "vary set")
+	assert.Contains(t, rec.Header().Get("Content-Type"), "javascript", "original content type kept")
+
+	etag := rec.Header().Get("ETag")
+
+	rec = request("/app.js", map[string]string{"Accept-Encoding": "gzip"})
+
+	assert.Equal(t, "gzip content", rec.Body.String(), "available encoding served")
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"), "variants have different entity tags")
+
+	rec = request("/app.js", map[string]string{"Accept-Encoding": "br", "If-None-Match": etag})
+
+	assert.Equal(t, http.StatusNotModified, rec.Code, "conditional request matches compressed variant")
+
+	rec = request("/app.js", map[string]string{"Accept-Encoding": "br", "Range": "bytes=0-5"})
+
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "range request served")
+	assert.Equal(t, "brotli", rec.Body.String(), "range of compressed variant")
+
+	rec = request("/app.js", map[string]string{"Accept-Encoding": "zstd"})
+
+	assert.Equal(t, "plain content", rec.Body.String(), "uncompressed file without acceptable sidecar")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "no content encoding")
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "vary set for files with sidecars")
+
+	rec = request("/plain.txt", map[string]string{"Accept-Encoding": "br"})
+
+	assert.Equal(t, "no sidecars", rec.Body.String(), "uncompressed file without sidecars")
+	assert.Empty(t, rec.Header().Get("Vary"), "no vary for files without sidecars")
+}
+
+func TestTryFileVariables(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "http://Example.com:8080/docs/intro.min.js?v=2",
+		nil)
+	req.Header.Set("Accept-Language", "fr;q=0, de-CH;q=0.9, en;q=0.8")
+
+	tests := map[string]string{
+		"uri":      "/docs/intro.min.js",
+		"host":     "example.com",
+		"query":    "v=2",
+		"lang":     "de",
+		"dir":      "/docs/",
+		"basename": "intro.min",
+		"ext":      ".js",
+		"unknown":  "",
+	}
+
+	for name, want := range tests {
+		assert.Equal(t, want, tryFileVariable(name, req), "value of $%s", name)
+	}
+}
+
+func TestTryFileFallback(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	files := map[string]string{
+		"spa.html":        "single page",
+		"de/about.html":   "über uns",
+		"errors/404.html": "not here",
+	}
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		tryFiles []string
+		uri      string
+		status   int
+		content  string
+	}{
+		{tryFiles: []string{"/$lang$uri", "$uri", "=200:/spa.html"}, uri: "/about.html", status: 200,
+			content: "über uns"},
+		{tryFiles: []string{"/$lang$uri", "$uri", "=200:/spa.html"}, uri: "/settings/profile", status: 200,
+			content: "single page"},
+		{tryFiles: []string{"/$lang$uri", "$uri", "=200:/spa.html"}, uri: "/app.1234.js", status: 404},
+		{tryFiles: []string{"$uri", "=404"}, uri: "/missing", status: 404},
+		{tryFiles: []string{"$uri", "=404"}, uri: "/spa.html", status: 200, content: "single page"},
+		{tryFiles: []string{"$uri", "=404:/errors/404.html"}, uri: "/missing.css", status: 404, content: "not here"},
+		{tryFiles: []string{"$uri", "=503"}, uri: "/missing", status: 503},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestTryFileFallback-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			handler, cleanup, handlerErr := generateFileHandler(fileHandlerSettings{
+				basePath: "/",
+				rootPath: root,
+				tryFiles: test.tryFiles,
+			})
+
+			if !assert.NoError(t, handlerErr, "handler should be generated") {
+				return
+			}
+
+			defer cleanup()
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil)
+			req.Header.Set("Accept-Language", "de")
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.status, rec.Code, "status of %v with %v", test.uri, test.tryFiles)
+
+			if len(test.content) > 0 {
+				assert.Equal(t, test.content, rec.Body.String(), "content of %v with %v", test.uri, test.tryFiles)
+			}
+		})
+	}
+
+	for _, invalid := range [][]string{{"=404", "$uri"}, {"$uri", "=301:/new"}, {"$uri", "=200"}, {"$uri", "=x"}} {
+		_, _, err := generateFileHandler(fileHandlerSettings{basePath: "/", rootPath: root, tryFiles: invalid})
+
+		assert.ErrorIs(t, err, ErrInvalidTryFile, "invalid try-files %v", invalid)
+	}
+}
@@ -0,0 +1,658 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlphaOne1/sonicred/utils"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.yaml.in/yaml/v3"
+)
+
+// configOIDCKey is the key in the configuration file holding the OpenID Connect settings.
+const configOIDCKey = "oidc"
+
+// Names of the cookies holding the state of a running login and the session after a successful login.
+const (
+	OIDCLoginCookie   = "sonicred_login"
+	OIDCSessionCookie = "sonicred_session"
+)
+
+// OIDCRequestTimeout is the timeout of the requests to the OpenID provider.
+const OIDCRequestTimeout = 10 * time.Second
+
+// OIDCLoginTimeout is the time a user has to complete the login at the OpenID provider.
+const OIDCLoginTimeout = 10 * time.Minute
+
+// OIDCDefaultSessionDuration is the validity of a session, if none is configured.
+const OIDCDefaultSessionDuration = 8 * time.Hour
+
+// oidcMinSessionKeySize is the minimum size of the secret the session key is derived from.
+const oidcMinSessionKeySize = 32
+
+// oidcSessionClaims lists the claims kept in the session in addition to those needed by the claim rules.
+var oidcSessionClaims = []string{"sub", "name", "email", "preferred_username"}
+
+// ErrInvalidOIDC indicates that the OpenID Connect settings could not be parsed.
+var ErrInvalidOIDC = errors.New("invalid oidc settings")
+
+// ErrInvalidSession indicates that a session or login cookie is missing, manipulated or expired.
+var ErrInvalidSession = errors.New("invalid session")
+
+// oidcConfig holds the OpenID Connect settings of a host.
+type oidcConfig struct {
+	issuer           string
+	clientID         string
+	clientSecretFile string
+	redirectURL      string
+	scopes           []string
+	sessionKeyFile   string
+	sessionDuration  time.Duration
+	protect          []claimProtection
+}
+
+// parseOIDCConfig reads the OpenID Connect settings of the configuration file.
+func parseOIDCConfig(node *yaml.Node, fileName string) (*oidcConfig, error) {
+	config, err := parseOIDCSettings(node)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s:%d: %w", ErrConfigFile, fileName, node.Line, err)
+	}
+
+	return config, nil
+}
+
+// parseOIDCSettings reads the mapping of the OpenID Connect settings.
+func parseOIDCSettings(node *yaml.Node) (*oidcConfig, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%w: expected a mapping of settings", ErrInvalidOIDC)
+	}
+
+	config := oidcConfig{scopes: []string{"openid", "profile", "email"}, sessionDuration: OIDCDefaultSessionDuration}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		var err error
+
+		switch key.Value {
+		case "issuer":
+			config.issuer = value.Value
+		case "clientid":
+			config.clientID = value.Value
+		case "clientsecretfile":
+			config.clientSecretFile = value.Value
+		case "redirecturl":
+			config.redirectURL = value.Value
+		case "scope":
+			if config.scopes, err = decodeStringList(value); err == nil && !slices.Contains(config.scopes, "openid") {
+				config.scopes = append([]string{"openid"}, config.scopes...)
+			}
+		case "sessionkeyfile":
+			config.sessionKeyFile = value.Value
+		case "sessionduration":
+			if config.sessionDuration, err = time.ParseDuration(value.Value); err == nil && config.sessionDuration <= 0 {
+				err = fmt.Errorf("non-positive duration %v", value.Value)
+			}
+		case "protect":
+			config.protect, err = parseClaimProtections(value)
+		default:
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidOIDC, key.Value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %v: %w", ErrInvalidOIDC, key.Value, err)
+		}
+	}
+
+	if len(config.issuer) == 0 || len(config.clientID) == 0 || len(config.redirectURL) == 0 ||
+		len(config.protect) == 0 {
+
+		return nil, fmt.Errorf("%w: expected issuer, clientid, redirecturl and protected paths", ErrInvalidOIDC)
+	}
+
+	if redirect, err := url.Parse(config.redirectURL); err != nil || !redirect.IsAbs() || len(redirect.Path) == 0 {
+		return nil, fmt.Errorf("%w: redirecturl %q is not an absolute URL", ErrInvalidOIDC, config.redirectURL)
+	}
+
+	return &config, nil
+}
+
+// oidcDiscovery holds the endpoints of the OpenID provider, as given by its discovery document.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is the state of a running login, kept in the login cookie.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Target   string `json:"target"`
+	Expiry   int64  `json:"exp"`
+}
+
+// oidcSession is the session of a logged-in user, kept in the session cookie.
+type oidcSession struct {
+	Claims jwtClaims `json:"claims"`
+	Expiry int64     `json:"exp"`
+}
+
+// oidcProvider performs the logins of a host at an OpenID provider and keeps the sessions in encrypted cookies.
+type oidcProvider struct {
+	config       oidcConfig
+	clientSecret string
+	callbackPath string
+	secure       bool
+	cookieCipher cipher.AEAD
+	client       *http.Client
+	counter      metric.Int64Counter
+
+	lock      sync.Mutex
+	discovery *oidcDiscovery
+	keys      *remoteKeys
+}
+
+// readSecretFile reads a file holding a secret, ignoring surrounding whitespace.
+func readSecretFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Clean(name))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret file: %w", err)
+	}
+
+	return bytes.TrimSpace(data), nil
+}
+
+// newOIDCProvider prepares the logins using the settings. The OpenID provider is contacted on the first login.
+func newOIDCProvider(config oidcConfig) (*oidcProvider, error) {
+	redirect, err := url.Parse(config.redirectURL)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid redirecturl: %w", ErrInvalidOIDC, err)
+	}
+
+	provider := &oidcProvider{
+		config:       config,
+		callbackPath: redirect.Path,
+		secure:       redirect.Scheme == "https",
+		client:       &http.Client{Timeout: OIDCRequestTimeout},
+		counter:      authFailureCounter(),
+	}
+
+	if len(config.clientSecretFile) > 0 {
+		secret, err := readSecretFile(config.clientSecretFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: client secret: %w", ErrInvalidOIDC, err)
+		}
+
+		provider.clientSecret = string(secret)
+	}
+
+	var sessionSecret []byte
+
+	if len(config.sessionKeyFile) > 0 {
+		if sessionSecret, err = readSecretFile(config.sessionKeyFile); err != nil {
+			return nil, fmt.Errorf("%w: session key: %w", ErrInvalidOIDC, err)
+		}
+
+		if len(sessionSecret) < oidcMinSessionKeySize {
+			return nil, fmt.Errorf("%w: session key needs at least %d bytes", ErrInvalidOIDC, oidcMinSessionKeySize)
+		}
+	} else {
+		slog.Warn("no oidc session key file configured, sessions end on restart and configuration reload")
+
+		sessionSecret = make([]byte, oidcMinSessionKeySize)
+		_, _ = rand.Read(sessionSecret)
+	}
+
+	key, err := hkdf.Key(sha256.New, sessionSecret, nil, "sonicred oidc session", 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not derive session key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create session cipher: %w", err)
+	}
+
+	if provider.cookieCipher, err = cipher.NewGCM(block); err != nil {
+		return nil, fmt.Errorf("could not create session cipher: %w", err)
+	}
+
+	return provider, nil
+}
+
+// discover fetches the discovery document of the OpenID provider, if not already done.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, *remoteKeys, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, p.keys, nil
+	}
+
+	data, err := fetchLimited(ctx, p.client, strings.TrimSuffix(p.config.issuer, "/")+"/.well-known/openid-configuration")
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var discovery oidcDiscovery
+
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return nil, nil, fmt.Errorf("invalid discovery document: %w", err)
+	}
+
+	if discovery.Issuer != p.config.issuer {
+		return nil, nil, fmt.Errorf("discovery document of unexpected issuer %q", discovery.Issuer)
+	}
+
+	if len(discovery.AuthorizationEndpoint) == 0 || len(discovery.TokenEndpoint) == 0 || len(discovery.JWKSURI) == 0 {
+		return nil, nil, errors.New("discovery document lacks endpoints")
+	}
+
+	slog.Info("discovered oidc provider",
+		slog.String("issuer", discovery.Issuer),
+		slog.String("authorization", discovery.AuthorizationEndpoint))
+
+	p.discovery = &discovery
+	p.keys = &remoteKeys{url: discovery.JWKSURI, client: p.client}
+
+	return p.discovery, p.keys, nil
+}
+
+// seal encrypts the value into a cookie. The cookie name is authenticated as well, so that the value cannot be
+// used in another cookie.
+func (p *oidcProvider) seal(w http.ResponseWriter, name string, value any, expiry time.Time) error {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return fmt.Errorf("could not encode cookie: %w", err)
+	}
+
+	nonce := make([]byte, p.cookieCipher.NonceSize())
+	_, _ = rand.Read(nonce)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(p.cookieCipher.Seal(nonce, nonce, data, []byte(name))),
+		Path:     "/",
+		Expires:  expiry,
+		Secure:   p.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// open decrypts the value of the cookie.
+func (p *oidcProvider) open(r *http.Request, name string, value any) error {
+	cookie, err := r.Cookie(name)
+
+	if err != nil {
+		return fmt.Errorf("%w: no %v cookie", ErrInvalidSession, name)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+
+	if err != nil || len(sealed) < p.cookieCipher.NonceSize() {
+		return fmt.Errorf("%w: malformed %v cookie", ErrInvalidSession, name)
+	}
+
+	nonceSize := p.cookieCipher.NonceSize()
+	data, err := p.cookieCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+
+	if err != nil {
+		return fmt.Errorf("%w: manipulated %v cookie", ErrInvalidSession, name)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSession, err)
+	}
+
+	return nil
+}
+
+// clear removes the cookie.
+func (p *oidcProvider) clear(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, Secure: p.secure, HttpOnly: true})
+}
+
+// randomToken generates a random URL-safe token, e.g., for the state or the PKCE verifier.
+func randomToken() string {
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// startLogin redirects the client to the OpenID provider, using the authorization code flow with PKCE. The
+// requested URL is kept in the login cookie to return to after the login.
+func (p *oidcProvider) startLogin(w http.ResponseWriter, r *http.Request) {
+	discovery, _, err := p.discover(r.Context())
+
+	if err != nil {
+		slog.Error("could not discover oidc provider",
+			slog.String("issuer", p.config.issuer),
+			slog.String("error", err.Error()))
+
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+		return
+	}
+
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Target:   r.URL.RequestURI(),
+		Expiry:   time.Now().Add(OIDCLoginTimeout).Unix(),
+	}
+
+	if err := p.seal(w, OIDCLoginCookie, login, time.Unix(login.Expiry, 0)); err != nil {
+		slog.Error("could not start login", slog.String("error", err.Error()))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.clientID},
+		"redirect_uri":          {p.config.redirectURL},
+		"scope":                 {strings.Join(p.config.scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// exchangeCode exchanges the authorization code for the tokens and gives the ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, tokenEndpoint, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.redirectURL},
+		"code_verifier": {verifier},
+	}
+
+	if len(p.clientSecret) == 0 {
+		form.Set("client_id", p.config.clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return "", fmt.Errorf("could not create token request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if len(p.clientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(p.config.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("could not request token: %w", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxSize)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("invalid token response with status %v: %w", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(tokens.IDToken) == 0 {
+		return "", fmt.Errorf("token request failed with status %v: %v %v",
+			resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// handleCallback completes the login, when the OpenID provider redirects the client back. The ID token is
+// verified and the claims needed are kept in the session cookie.
+func (p *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, reason string, err error) {
+		reportAuthFailure(r.Context(), p.counter, r, "oidc", reason, slog.String("error", err.Error()))
+		http.Error(w, http.StatusText(status), status)
+	}
+
+	var login oidcLogin
+
+	if err := p.open(r, OIDCLoginCookie, &login); err != nil {
+		fail(http.StatusBadRequest, AuthFailureInvalid, err)
+		return
+	}
+
+	p.clear(w, OIDCLoginCookie)
+
+	query := r.URL.Query()
+
+	if time.Now().Unix() > login.Expiry ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+
+		fail(http.StatusBadRequest, AuthFailureInvalid, fmt.Errorf("%w: expired login or state mismatch",
+			ErrInvalidSession))
+
+		return
+	}
+
+	if providerErr := query.Get("error"); len(providerErr) > 0 {
+		fail(http.StatusForbidden, AuthFailureInvalid, fmt.Errorf("provider denied login: %v %v",
+			utils.CutLog(providerErr), utils.CutLog(query.Get("error_description"))))
+
+		return
+	}
+
+	discovery, keys, err := p.discover(r.Context())
+
+	if err != nil {
+		fail(http.StatusBadGateway, AuthFailureInvalid, err)
+		return
+	}
+
+	idToken, err := p.exchangeCode(r.Context(), discovery.TokenEndpoint, query.Get("code"), login.Verifier)
+
+	if err != nil {
+		fail(http.StatusBadGateway, AuthFailureInvalid, err)
+		return
+	}
+
+	claims, err := verifyJWT(r.Context(), idToken, keys)
+
+	if err == nil {
+		err = jwtValidation{issuer: p.config.issuer, audiences: []string{p.config.clientID}}.check(claims, time.Now())
+	}
+
+	if nonce, _ := claims["nonce"].(string); err == nil && nonce != login.Nonce {
+		err = fmt.Errorf("%w: nonce mismatch", ErrInvalidClaims)
+	}
+
+	if err != nil {
+		fail(http.StatusForbidden, AuthFailureInvalid, err)
+		return
+	}
+
+	session := oidcSession{Claims: make(jwtClaims), Expiry: time.Now().Add(p.config.sessionDuration).Unix()}
+
+	for _, name := range p.sessionClaims() {
+		if value, found := claims[name]; found {
+			session.Claims[name] = value
+		}
+	}
+
+	if err := p.seal(w, OIDCSessionCookie, session, time.Unix(session.Expiry, 0)); err != nil {
+		fail(http.StatusInternalServerError, AuthFailureInvalid, err)
+		return
+	}
+
+	slog.Info("oidc login",
+		slog.String("client", r.RemoteAddr),
+		slog.String("user", utils.CutLog(claims.subject())),
+		slog.String("correlation_id", r.Header.Get("X-Correlation-ID")))
+
+	target := login.Target
+
+	// only return to local paths, never to other sites
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// sessionClaims gives the names of the claims kept in the session.
+func (p *oidcProvider) sessionClaims() []string {
+	names := slices.Clone(oidcSessionClaims)
+
+	for _, protection := range p.config.protect {
+		for name := range protection.claims {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// session gives the valid session of the request.
+func (p *oidcProvider) session(r *http.Request) (oidcSession, error) {
+	var session oidcSession
+
+	if err := p.open(r, OIDCSessionCookie, &session); err != nil {
+		return session, err
+	}
+
+	if time.Now().Unix() > session.Expiry {
+		return session, fmt.Errorf("%w: session expired", ErrInvalidSession)
+	}
+
+	return session, nil
+}
+
+// middleware generates the middleware requiring a login for the protected paths. Clients without a valid session
+// are sent to the OpenID provider, users lacking the required claims are denied. The protected paths match the
+// path as requested by the client and, using pathAuthorization, the one it is resolved to.
+func (p *oidcProvider) middleware() func(http.Handler) http.Handler {
+	for _, protection := range p.config.protect {
+		slog.Info("adding oidc protection",
+			slog.String("matcher", protection.matcher.kind),
+			slog.String("pattern", protection.matcher.pattern),
+			slog.Int("claims", len(protection.claims)))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == p.callbackPath {
+				p.handleCallback(w, r)
+				return
+			}
+
+			index := slices.IndexFunc(p.config.protect, func(protection claimProtection) bool {
+				return protection.matcher.matches(r.URL.Path)
+			})
+
+			if index < 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			session, err := p.session(r)
+
+			if err != nil {
+				reportAuthFailure(r.Context(), p.counter, r, "oidc", AuthFailureMissing,
+					slog.String("error", err.Error()))
+				p.startLogin(w, r)
+
+				return
+			}
+
+			if !p.config.protect[index].claims.matches(session.Claims) {
+				reportAuthFailure(r.Context(), p.counter, r, "oidc", AuthFailureForbidden,
+					slog.String("user", utils.CutLog(session.Claims.subject())))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// oidcAuthentication generates the middleware performing OpenID Connect logins, if configured.
+func oidcAuthentication(config *oidcConfig, basePath string) (func(http.Handler) http.Handler, error) {
+	if config == nil {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+
+	provider, err := newOIDCProvider(*config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(provider.callbackPath, basePath) {
+		return nil, fmt.Errorf("%w: redirecturl path %q is not below the base path %q",
+			ErrInvalidOIDC, provider.callbackPath, basePath)
+	}
+
+	return provider.middleware(), nil
+}
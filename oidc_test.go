@@ -0,0 +1,300 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testOIDCIssuer is a minimal OpenID provider, logging in every user as the given subject.
+type testOIDCIssuer struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	subject string
+	groups  []string
+
+	lock  sync.Mutex
+	codes map[string]url.Values
+}
+
+// newTestOIDCIssuer starts the OpenID provider, it is stopped at the end of the test.
+func newTestOIDCIssuer(t *testing.T, subject string, groups []string) *testOIDCIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	issuer := &testOIDCIssuer{key: key, subject: subject, groups: groups, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.server.URL,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JWKSURI:               issuer.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(testJWKS(t, map[string]crypto.Signer{"issuer": key}))
+	})
+
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code := randomToken()
+
+		issuer.lock.Lock()
+		issuer.codes[code] = query
+		issuer.lock.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{
+			"code":  {code},
+			"state": {query.Get("state")},
+		}.Encode(), http.StatusFound)
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.lock.Lock()
+		query, found := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.lock.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		clientID, secret, _ := r.BasicAuth()
+
+		if !found || query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+			clientID != "sonicred" || secret != "client-secret" {
+
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+
+			return
+		}
+
+		idToken := signTestJWT(t, key, "issuer", map[string]any{
+			"iss":    issuer.server.URL,
+			"aud":    "sonicred",
+			"sub":    issuer.subject,
+			"groups": issuer.groups,
+			"nonce":  query.Get("nonce"),
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+// cookieOf gives the value of the cookie set by the response.
+func cookieOf(rec *httptest.ResponseRecorder, name string) string {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+func TestOIDCAuthentication(t *testing.T) {
+	t.Parallel()
+
+	issuer := newTestOIDCIssuer(t, "alice", []string{"docs"})
+	root := t.TempDir()
+
+	for _, name := range []string{"index.html", "private/doc.txt", "admin/panel.html"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700); err != nil {
+			t.Fatalf("could not create test directory: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o600); err != nil {
+			t.Fatalf("could not write test file: %v", err)
+		}
+	}
+
+	secretDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(secretDir, "client"), []byte("client-secret\n"), 0o600); err != nil {
+		t.Fatalf("could not write secret file: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(secretDir, "session"), []byte(strings.Repeat("k", 32)), 0o600); err != nil {
+		t.Fatalf("could not write secret file: %v", err)
+	}
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: %s
+oidc:
+  issuer: %s
+  clientid: sonicred
+  clientsecretfile: %s
+  redirecturl: http://localhost/oidc/callback
+  sessionkeyfile: %s
+  protect:
+    - path: /admin/
+      claims:
+        groups: admins
+    - path: /private/
+`, root, issuer.server.URL, filepath.Join(secretDir, "client"), filepath.Join(secretDir, "session")))
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "handler should be generated") {
+		return
+	}
+
+	defer cleanup()
+
+	serve := func(uri string, cookies map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, uri, nil)
+
+		for name, value := range cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	// unprotected paths need no login
+	assert.Equal(t, http.StatusOK, serve("/", nil).Code, "unprotected path")
+
+	// protected paths start the login at the provider
+	rec := serve("/private/doc.txt", nil)
+
+	if !assert.Equal(t, http.StatusFound, rec.Code, "login redirect") {
+		return
+	}
+
+	loginCookie := cookieOf(rec, OIDCLoginCookie)
+	authorize := rec.Header().Get("Location")
+
+	assert.True(t, strings.HasPrefix(authorize, issuer.server.URL+"/authorize?"), "redirect to provider")
+	assert.NotEmpty(t, loginCookie, "login cookie")
+
+	// the provider sends the client back with the code
+	client := issuer.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	req, _ := http.NewRequestWithContext(t.Context(), http.MethodGet, authorize, nil)
+	resp, err := client.Do(req)
+
+	if !assert.NoError(t, err, "authorization request") {
+		return
+	}
+
+	_ = resp.Body.Close()
+
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	// a callback with an unexpected state is rejected
+	badState := serve(callback.Path+"?code=x&state=other", map[string]string{OIDCLoginCookie: loginCookie})
+	assert.Equal(t, http.StatusBadRequest, badState.Code, "callback with wrong state")
+
+	rec = serve(callback.RequestURI(), map[string]string{OIDCLoginCookie: loginCookie})
+
+	if !assert.Equal(t, http.StatusFound, rec.Code, "callback redirect") {
+		return
+	}
+
+	assert.Equal(t, "/private/doc.txt", rec.Header().Get("Location"), "return to requested path")
+
+	session := cookieOf(rec, OIDCSessionCookie)
+	assert.NotEmpty(t, session, "session cookie")
+
+	// the session grants access to the protected paths, depending on the claims
+	assert.Equal(t, http.StatusOK, serve("/private/doc.txt", map[string]string{OIDCSessionCookie: session}).Code,
+		"access with session")
+	assert.Equal(t, http.StatusForbidden, serve("/admin/panel.html",
+		map[string]string{OIDCSessionCookie: session}).Code, "access without required claims")
+
+	// manipulated sessions start a new login
+	tampered := session[:len(session)-4] + "AAAA"
+	assert.Equal(t, http.StatusFound, serve("/private/doc.txt", map[string]string{OIDCSessionCookie: tampered}).Code,
+		"access with manipulated session")
+
+	// the login cookie cannot be used as session
+	assert.Equal(t, http.StatusFound, serve("/private/doc.txt",
+		map[string]string{OIDCSessionCookie: loginCookie}).Code, "login cookie as session")
+}
+
+func TestOIDCConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		settings string
+		line     int
+	}{
+		{settings: "  - issuer: https://idp.example.com\n", line: 3},
+		{settings: "  clientid: sonicred\n  redirecturl: https://example.com/cb\n  protect:\n    - path: /a/\n",
+			line: 3},
+		{settings: "  issuer: https://idp.example.com\n  clientid: sonicred\n  redirecturl: /cb\n" +
+			"  protect:\n    - path: /a/\n", line: 3},
+		{settings: "  issuer: https://idp.example.com\n  clientid: sonicred\n" +
+			"  redirecturl: https://example.com/cb\n", line: 3},
+		{settings: "  issuer: https://idp.example.com\n  clientid: sonicred\n" +
+			"  redirecturl: https://example.com/cb\n  protect:\n    - regex: \"(\"\n", line: 3},
+		{settings: "  issuer: https://idp.example.com\n  clientid: sonicred\n" +
+			"  redirecturl: https://example.com/cb\n  protect:\n    - path: /a/\n      claims: [groups]\n", line: 3},
+		{settings: "  issuer: https://idp.example.com\n  clientid: sonicred\n" +
+			"  redirecturl: https://example.com/cb\n  sessionduration: -1h\n  protect:\n    - path: /a/\n", line: 3},
+		{settings: "  issuer: https://idp.example.com\n  other: x\n", line: 3},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestOIDCConfigErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			fileName := writeConfigFile(t, "version: 1\noidc:\n"+test.settings)
+
+			_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+			assert.ErrorIs(t, err, ErrConfigFile, "expected configuration file error")
+			assert.ErrorContains(t, err, fmt.Sprintf("%s:%d", fileName, test.line), "expected error location")
+		})
+	}
+
+	_, _, err := generateFileHandler(fileHandlerSettings{
+		basePath: "/site/",
+		rootPath: t.TempDir(),
+		oidc:     &oidcConfig{redirectURL: "https://example.com/callback"},
+	})
+
+	assert.ErrorIs(t, err, ErrInvalidOIDC, "callback outside of base path")
+}
@@ -0,0 +1,290 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrReloadTLSToggle indicates that a reload tried to enable or disable TLS, what requires a restart.
+var ErrReloadTLSToggle = errors.New("enabling or disabling TLS requires a restart")
+
+// restartOnlyOptions lists the options whose changes only take effect after a restart.
+var restartOnlyOptions = []string{
+	"address", "httpport", "iaddress", "iport", "log", "logstyle", "port", "pprof", "telemetry", "trace-endpoint",
+	"tlsticketrotation", "watchconfig",
+}
+
+// handlerGeneration is one instance of the handler chain together with its cleanup function.
+// The lock is held shared by every request served by this generation, so that the cleanup can wait
+// for all in-flight requests to complete.
+type handlerGeneration struct {
+	handler http.Handler
+	cleanup func()
+	lock    sync.RWMutex
+	retired bool
+}
+
+// retire marks the generation as no longer in use, waits for the in-flight requests and cleans up.
+func (g *handlerGeneration) retire() {
+	g.lock.Lock()
+	g.retired = true
+	g.lock.Unlock()
+
+	g.cleanup()
+}
+
+// reloadableHandler is an http.Handler whose handler chain can be atomically replaced. New requests are served
+// by the newest chain, in-flight requests finish on the chain they started with.
+type reloadableHandler struct {
+	current atomic.Pointer[handlerGeneration]
+}
+
+// ServeHTTP serves the request using the currently active handler chain.
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		gen := h.current.Load()
+
+		gen.lock.RLock()
+
+		if !gen.retired {
+			defer gen.lock.RUnlock()
+
+			gen.handler.ServeHTTP(w, r)
+
+			return
+		}
+
+		// the generation was replaced in the meantime, retry with the new one
+		gen.lock.RUnlock()
+	}
+}
+
+// swap installs the new handler chain. The previous one is cleaned up in the background as soon as all its
+// in-flight requests are finished.
+func (h *reloadableHandler) swap(handler http.Handler, cleanup func()) {
+	old := h.current.Swap(&handlerGeneration{handler: handler, cleanup: cleanup})
+
+	if old != nil {
+		go old.retire()
+	}
+}
+
+// close retires the currently active handler chain.
+func (h *reloadableHandler) close() {
+	if gen := h.current.Load(); gen != nil {
+		gen.retire()
+	}
+}
+
+// reloadableTLSConfig holds the active TLS configuration that is handed out to new connections.
+type reloadableTLSConfig struct {
+	current atomic.Pointer[tls.Config]
+	tickets *ticketKeyRotator
+}
+
+// newReloadableTLSConfig creates a new reloadableTLSConfig, initially holding the given configuration. If the
+// ticketRotation interval is set, the session ticket keys are rotated accordingly, otherwise the automatic
+// rotation of crypto/tls is used. The keys are kept across reloads.
+func newReloadableTLSConfig(config *tls.Config, ticketRotation time.Duration) *reloadableTLSConfig {
+	result := &reloadableTLSConfig{}
+	result.swap(config)
+
+	if ticketRotation > 0 {
+		result.tickets = &ticketKeyRotator{interval: ticketRotation}
+	}
+
+	return result
+}
+
+// swap installs the new TLS configuration for all subsequent handshakes.
+func (c *reloadableTLSConfig) swap(config *tls.Config) {
+	config = config.Clone()
+
+	// the server only adds its protocols to its own configuration, not to the one returned per client
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	c.current.Store(config)
+}
+
+// serverConfig gives the TLS configuration to use in the http.Server. It delegates every handshake to the
+// currently active configuration, or the configuration it derives for the client, e.g., with reloaded client
+// certificate authorities. The session tickets are encrypted using the keys of the server configuration.
+func (c *reloadableTLSConfig) serverConfig() *tls.Config {
+	server := &tls.Config{
+		// the versions are given by the configuration of the handshake, see tlsSettings
+		MinVersion: tls.VersionTLS12,
+	}
+
+	server.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if c.tickets != nil {
+			if err := c.tickets.rotate(server, time.Now()); err != nil {
+				slog.Error("could not rotate session ticket key, keeping previous key",
+					slog.String("error", err.Error()))
+			}
+		}
+
+		config := c.current.Load()
+
+		if config.GetConfigForClient != nil {
+			if derived, err := config.GetConfigForClient(hello); derived != nil || err != nil {
+				return derived, err
+			}
+		}
+
+		return config, nil
+	}
+
+	return server
+}
+
+// configReloader re-reads the configuration and replaces the handler chain and TLS configuration of the
+// running server.
+type configReloader struct {
+	lock        sync.Mutex
+	args        []string
+	config      ServerConfig
+	handler     *reloadableHandler
+	httpHandler *reloadableHandler
+	tlsConfig   *reloadableTLSConfig
+	certManager *autocert.Manager
+}
+
+// reload reads the configuration anew and swaps in the new handler chain and TLS configuration. If anything
+// fails, the previous configuration stays active.
+func (c *configReloader) reload() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+
+	config, configErr := parseConfig(flagSet, c.args, os.Environ())
+
+	if configErr != nil {
+		return configErr
+	}
+
+	if err := checkConfigConsistency(config); err != nil {
+		return err
+	}
+
+	// the manager keeps renewing its certificates, so a new one is only created for changed settings
+	certManager := c.certManager
+
+	if !reflect.DeepEqual(config.acmeSettings(), c.config.acmeSettings()) {
+		var certManagerErr error
+
+		if certManager, certManagerErr = newSharedACMEManager(config.acmeSettings()); certManagerErr != nil {
+			return fmt.Errorf("invalid TLS configuration: %w", certManagerErr)
+		}
+	}
+
+	tlsConfig, tlsConfigErr := generateServerTLSConfig(config, certManager)
+
+	if tlsConfigErr != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", tlsConfigErr)
+	}
+
+	if (tlsConfig == nil) != (c.tlsConfig == nil) {
+		return ErrReloadTLSToggle
+	}
+
+	handler, handlerCleanup, handlerErr := generateServerHandler(config)
+
+	if handlerErr != nil {
+		return handlerErr
+	}
+
+	var httpHandler http.Handler
+
+	if c.httpHandler != nil {
+		// the redirects lead to the port still listened on, as it only changes with a restart
+		httpConfig := config
+		httpConfig.ListenPort = c.config.ListenPort
+
+		httpHandler = generateHTTPHandler(httpConfig, certManager)
+	}
+
+	for _, name := range restartOnlyOptions {
+		if fmt.Sprint(config.Values[name]) != fmt.Sprint(c.config.Values[name]) {
+			slog.Warn("changed option requires a restart, keeping previous value",
+				slog.String("name", name),
+				slog.Any("value", c.config.reportedValue(name)))
+		}
+	}
+
+	if c.tlsConfig != nil {
+		c.tlsConfig.swap(tlsConfig)
+	}
+
+	c.handler.swap(handler, handlerCleanup)
+
+	if c.httpHandler != nil {
+		c.httpHandler.swap(httpHandler, func() {})
+	}
+
+	// the options requiring a restart keep their values, so that further warnings relate to the running values
+	for _, name := range restartOnlyOptions {
+		config.Values[name] = c.config.Values[name]
+	}
+
+	c.config = config
+	c.certManager = certManager
+
+	return nil
+}
+
+// handleReloads reloads the configuration on every reload signal and, if enabled, when the configuration
+// file changes. It blocks until the context is cancelled.
+func (c *configReloader) handleReloads(ctx context.Context, reloadSignal <-chan os.Signal, fileChanged <-chan []string) {
+	for {
+		var reason string
+
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-reloadSignal:
+			reason = "signal " + sig.String()
+		case files := <-fileChanged:
+			reason = fmt.Sprintf("changed files %v", files)
+		}
+
+		slog.Info("reloading configuration", slog.String("reason", reason))
+
+		if err := c.reload(); err != nil {
+			slog.Error("failed to reload configuration, keeping previous configuration",
+				slog.String("error", err.Error()))
+
+			continue
+		}
+
+		slog.Info("configuration reloaded")
+	}
+}
+
+// watchedConfigFiles gives the files that trigger a reload when changed.
+func watchedConfigFiles(config ServerConfig) []string {
+	if len(config.ConfigFile) == 0 {
+		return nil
+	}
+
+	return []string{config.ConfigFile}
+}
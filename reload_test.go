@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadableHandlerInFlight(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var oldCleanedUp atomic.Bool
+
+	handler := &reloadableHandler{}
+	handler.swap(
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			w.Header().Set("X-Generation", "old")
+		}),
+		func() { oldCleanedUp.Store(true) })
+
+	oldRec := httptest.NewRecorder()
+	oldDone := make(chan struct{})
+
+	go func() {
+		handler.ServeHTTP(oldRec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil))
+		close(oldDone)
+	}()
+
+	<-started
+
+	handler.swap(
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("X-Generation", "new")
+		}),
+		func() {})
+
+	newRec := httptest.NewRecorder()
+	handler.ServeHTTP(newRec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil))
+
+	assert.Equal(t, "new", newRec.Header().Get("X-Generation"), "new requests use the new handler")
+	assert.False(t, oldCleanedUp.Load(), "old handler must not be cleaned up while in use")
+
+	close(release)
+	<-oldDone
+
+	assert.Equal(t, "old", oldRec.Header().Get("X-Generation"), "in-flight request finishes on old handler")
+	assert.Eventually(t, oldCleanedUp.Load, time.Second, 10*time.Millisecond, "old handler cleaned up")
+}
+
+func TestConfigReloader(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nheader:\n  - \"X-Reload: first\"\n")
+	args := []string{"-config", fileName}
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, nil)
+
+	if !assert.NoError(t, configErr, "initial configuration should be valid") {
+		return
+	}
+
+	handler, cleanup, handlerErr := generateServerHandler(config)
+
+	if !assert.NoError(t, handlerErr, "initial handler should be generated") {
+		return
+	}
+
+	reloader := configReloader{args: args, config: config, handler: &reloadableHandler{}}
+	reloader.handler.swap(handler, cleanup)
+
+	defer reloader.handler.close()
+
+	headerOf := func() string {
+		rec := httptest.NewRecorder()
+		reloader.handler.ServeHTTP(rec,
+			httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/index.html", nil))
+
+		return rec.Header().Get("X-Reload")
+	}
+
+	assert.Equal(t, "first", headerOf(), "initial header")
+
+	if err := os.WriteFile(fileName,
+		[]byte("version: 1\nroot: testroot\nheader:\n  - \"X-Reload: second\"\n"), 0o600); err != nil {
+		t.Fatalf("could not update configuration file: %v", err)
+	}
+
+	assert.NoError(t, reloader.reload(), "reload should succeed")
+	assert.Equal(t, "second", headerOf(), "header after reload")
+
+	if err := os.WriteFile(fileName,
+		[]byte("version: 1\nroot: testroot\nwafcfg:\n  - /noexist\nheader:\n  - \"X-Reload: third\"\n"),
+		0o600); err != nil {
+		t.Fatalf("could not update configuration file: %v", err)
+	}
+
+	assert.Error(t, reloader.reload(), "reload with invalid waf configuration should fail")
+	assert.Equal(t, "second", headerOf(), "previous configuration kept after failed reload")
+}
+
+func TestReloadableTLSConfigDerived(t *testing.T) {
+	t.Parallel()
+
+	derived := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: "derived"}
+
+	var deriving atomic.Bool
+
+	reloadable := newReloadableTLSConfig(&tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if deriving.Load() {
+				return derived, nil
+			}
+
+			return nil, nil
+		},
+	}, 0)
+
+	serverConfig := reloadable.serverConfig()
+
+	config, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+
+	if assert.NoError(t, err, "configuration should be given") {
+		assert.Same(t, reloadable.current.Load(), config, "current configuration without derived one")
+	}
+
+	deriving.Store(true)
+
+	config, err = serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+
+	if assert.NoError(t, err, "configuration should be given") {
+		assert.Same(t, derived, config, "derived configuration")
+	}
+}
+
+func TestConfigReloaderACMEManager(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+
+	configContent := func(header, domain string) string {
+		return fmt.Sprintf(`version: 1
+root: testroot
+header:
+  - "X-Reload: %s"
+acmedomain: %s
+certcache: %s
+acmeendpoint: https://acme.invalid/directory
+`, header, domain, cacheDir)
+	}
+
+	fileName := writeConfigFile(t, configContent("first", "shop.example.com"))
+	args := []string{"-config", fileName}
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, nil)
+
+	if !assert.NoError(t, configErr, "initial configuration should be valid") {
+		return
+	}
+
+	certManager, err := newSharedACMEManager(config.acmeSettings())
+
+	if !assert.NoError(t, err, "manager should be created") {
+		return
+	}
+
+	tlsConfig, err := generateServerTLSConfig(config, certManager)
+
+	if !assert.NoError(t, err, "initial TLS configuration should be generated") {
+		return
+	}
+
+	reloader := configReloader{
+		args:        args,
+		config:      config,
+		handler:     &reloadableHandler{},
+		tlsConfig:   newReloadableTLSConfig(tlsConfig, 0),
+		certManager: certManager,
+	}
+
+	defer reloader.handler.close()
+
+	if err := os.WriteFile(fileName, []byte(configContent("second", "shop.example.com")), 0o600); err != nil {
+		t.Fatalf("could not update configuration file: %v", err)
+	}
+
+	if assert.NoError(t, reloader.reload(), "reload with unchanged ACME settings should succeed") {
+		assert.Same(t, certManager, reloader.certManager, "manager kept with unchanged ACME settings")
+	}
+
+	if err := os.WriteFile(fileName, []byte(configContent("third", "store.example.com")), 0o600); err != nil {
+		t.Fatalf("could not update configuration file: %v", err)
+	}
+
+	if assert.NoError(t, reloader.reload(), "reload with changed ACME settings should succeed") {
+		assert.NotSame(t, certManager, reloader.certManager, "new manager with changed ACME settings")
+	}
+}
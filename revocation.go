@@ -0,0 +1,547 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/crypto/ocsp"
+)
+
+// CRLCheckInterval is the interval in which the CRL files are checked for changes.
+const CRLCheckInterval = time.Minute
+
+// OCSPRequestTimeout is the timeout of the requests to OCSP responders.
+const OCSPRequestTimeout = 5 * time.Second
+
+// OCSPCheckWait is the time the check of a client certificate waits for the response of its OCSP responder if
+// none is cached. Slower responses are still cached for the following checks.
+const OCSPCheckWait = 500 * time.Millisecond
+
+// ocspDefaultValidity is the time OCSP responses without next update time are cached.
+const ocspDefaultValidity = time.Hour
+
+// ocspMaxResponseSize is the maximum size of an OCSP response.
+const ocspMaxResponseSize = 64 << 10
+
+// ocspMaxCacheEntries is the number of cached OCSP responses, above which expired responses are removed.
+const ocspMaxCacheEntries = 10000
+
+// RevocationChecksMetric is the name of the counter of revocation checks of client certificates, by source and
+// result.
+const RevocationChecksMetric = "sonicred.tls.revocation.checks"
+
+// Policies for client certificates whose revocation status cannot be determined.
+const (
+	RevocationPolicySoft = "soft"
+	RevocationPolicyHard = "hard"
+)
+
+// Sources and results of revocation checks, reported in the log and the metric.
+const (
+	RevocationSourceCRL  = "crl"
+	RevocationSourceOCSP = "ocsp"
+	RevocationGood       = "good"
+	RevocationRevoked    = "revoked"
+	RevocationUnknown    = "unknown"
+)
+
+// ErrCertificateRevoked indicates that a client certificate is revoked.
+var ErrCertificateRevoked = errors.New("client certificate revoked")
+
+// ErrRevocationUnknown indicates that the revocation status of a client certificate could not be determined.
+var ErrRevocationUnknown = errors.New("revocation status of client certificate unknown")
+
+// ErrInvalidCRL indicates that a CRL file could not be parsed.
+var ErrInvalidCRL = errors.New("invalid certificate revocation list")
+
+// ErrInvalidRevocationPolicy indicates an unknown revocation policy.
+var ErrInvalidRevocationPolicy = errors.New("invalid revocation policy")
+
+// ErrRevocationWithoutCA indicates that revocation checks are configured, but no client certificate authority.
+var ErrRevocationWithoutCA = errors.New("revocation checks require a client certificate authority")
+
+// revocationSettings holds the revocation checks of client certificates.
+type revocationSettings struct {
+	crlFiles []string
+	ocsp     bool
+	policy   string
+}
+
+// enabled reports if any revocation check is configured.
+func (s revocationSettings) enabled() bool {
+	return len(s.crlFiles) > 0 || s.ocsp
+}
+
+// parseCRLs parses the revocation lists, given PEM encoded or as a single DER encoded list.
+func parseCRLs(data []byte, fileName string) ([]*x509.RevocationList, error) {
+	var lists []*x509.RevocationList
+
+	rest := bytes.TrimSpace(data)
+
+	if !bytes.HasPrefix(rest, []byte("-----BEGIN")) {
+		list, err := x509.ParseRevocationList(data)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidCRL, fileName, err)
+		}
+
+		return []*x509.RevocationList{list}, nil
+	}
+
+	for block, rest := pem.Decode(rest); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		list, err := x509.ParseRevocationList(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidCRL, fileName, err)
+		}
+
+		lists = append(lists, list)
+	}
+
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("%w: %s: no revocation list found", ErrInvalidCRL, fileName)
+	}
+
+	return lists, nil
+}
+
+// crlFile holds the revocation lists of a file. The file is read again when it changes, checked at most every
+// CRLCheckInterval.
+type crlFile struct {
+	name string
+
+	lock    sync.Mutex
+	lists   []*x509.RevocationList
+	size    int64
+	modTime time.Time
+	checked time.Time
+}
+
+// loadCRLFile reads the CRL file with the given name.
+func loadCRLFile(name string) (*crlFile, error) {
+	c := &crlFile{name: name}
+
+	info, err := os.Stat(name)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not stat CRL file: %w", err)
+	}
+
+	if err := c.read(info); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// read reads the file, replacing the revocation lists only if it is valid.
+func (c *crlFile) read(info os.FileInfo) error {
+	data, err := os.ReadFile(filepath.Clean(c.name))
+
+	if err != nil {
+		return fmt.Errorf("could not read CRL file: %w", err)
+	}
+
+	lists, err := parseCRLs(data, c.name)
+
+	if err != nil {
+		return err
+	}
+
+	c.lists, c.size, c.modTime = lists, info.Size(), info.ModTime()
+
+	return nil
+}
+
+// refresh reads the file again if it changed since the last check. Invalid files are reported, keeping the
+// previous revocation lists.
+func (c *crlFile) refresh(now time.Time) {
+	if now.Sub(c.checked) < CRLCheckInterval {
+		return
+	}
+
+	c.checked = now
+
+	info, err := os.Stat(c.name)
+
+	if err != nil || (info.Size() == c.size && info.ModTime().Equal(c.modTime)) {
+		return
+	}
+
+	if err := c.read(info); err != nil {
+		slog.Error("could not reload CRL file, keeping previous revocation lists",
+			slog.String("file", c.name),
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	slog.Info("reloaded CRL file",
+		slog.String("file", c.name),
+		slog.Int("lists", len(c.lists)))
+}
+
+// status gives the revocation status of the certificate according to the lists of the file that are issued by
+// the issuer. Lists that are expired or not signed by the issuer are ignored.
+func (c *crlFile) status(cert, issuer *x509.Certificate, now time.Time) string {
+	c.lock.Lock()
+	c.refresh(now)
+	lists := c.lists
+	c.lock.Unlock()
+
+	result := RevocationUnknown
+
+	for _, list := range lists {
+		if !bytes.Equal(list.RawIssuer, issuer.RawSubject) || list.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return RevocationRevoked
+			}
+		}
+
+		if list.NextUpdate.IsZero() || now.Before(list.NextUpdate) {
+			result = RevocationGood
+		}
+	}
+
+	return result
+}
+
+// ocspEntry is a cached OCSP response.
+type ocspEntry struct {
+	status  string
+	expiry  time.Time
+	refresh time.Time
+	pending chan struct{}
+}
+
+// revocationChecker checks client certificates against CRL files and OCSP responders.
+type revocationChecker struct {
+	crls     []*crlFile
+	ocsp     bool
+	hardFail bool
+	client   *http.Client
+	counter  metric.Int64Counter
+
+	lock      sync.Mutex
+	ocspCache map[string]*ocspEntry
+}
+
+// newRevocationChecker loads the CRL files and prepares the OCSP checks.
+func newRevocationChecker(settings revocationSettings) (*revocationChecker, error) {
+	if settings.policy != RevocationPolicySoft && settings.policy != RevocationPolicyHard {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRevocationPolicy, settings.policy)
+	}
+
+	checker := &revocationChecker{
+		ocsp:      settings.ocsp,
+		hardFail:  settings.policy == RevocationPolicyHard,
+		client:    &http.Client{Timeout: OCSPRequestTimeout},
+		ocspCache: make(map[string]*ocspEntry),
+	}
+
+	for _, name := range settings.crlFiles {
+		file, err := loadCRLFile(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		checker.crls = append(checker.crls, file)
+
+		slog.Info("adding CRL file", slog.String("file", name), slog.Int("lists", len(file.lists)))
+	}
+
+	counter, err := otel.Meter(ServerName).Int64Counter(RevocationChecksMetric,
+		metric.WithDescription("Number of revocation checks of client certificates, by source and result."),
+		metric.WithUnit("{check}"))
+
+	if err != nil {
+		slog.Warn("could not create revocation checks metric", slog.String("error", err.Error()))
+	} else {
+		checker.counter = counter
+	}
+
+	return checker, nil
+}
+
+// count adds the result of a check to the metric.
+func (c *revocationChecker) count(source, result string) {
+	if c.counter != nil {
+		c.counter.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("source", source),
+			attribute.String("result", result)))
+	}
+}
+
+// crlStatus gives the revocation status of the certificate according to all CRL files.
+func (c *revocationChecker) crlStatus(cert, issuer *x509.Certificate, now time.Time) string {
+	result := RevocationUnknown
+
+	for _, file := range c.crls {
+		switch file.status(cert, issuer, now) {
+		case RevocationRevoked:
+			return RevocationRevoked
+		case RevocationGood:
+			result = RevocationGood
+		}
+	}
+
+	return result
+}
+
+// ocspStatus gives the revocation status of the certificate according to its OCSP responder. Responses are
+// cached until their next update time and refreshed in the background halfway to it. Without a cached response,
+// the check waits for the responder at most OCSPCheckWait, so that slow responders do not stall the handshakes.
+func (c *revocationChecker) ocspStatus(cert, issuer *x509.Certificate, now time.Time) string {
+	if len(cert.OCSPServer) == 0 {
+		return RevocationUnknown
+	}
+
+	key := string(issuer.RawSubject) + cert.SerialNumber.String()
+
+	c.lock.Lock()
+
+	entry, found := c.ocspCache[key]
+
+	if !found {
+		entry = &ocspEntry{status: RevocationUnknown}
+		c.add(key, entry, now)
+	}
+
+	if entry.pending == nil && !now.Before(entry.refresh) {
+		entry.pending = make(chan struct{})
+
+		go c.fetch(entry, cert, issuer)
+	}
+
+	pending := entry.pending
+	valid := now.Before(entry.expiry)
+	status := entry.status
+
+	c.lock.Unlock()
+
+	if valid {
+		return status
+	}
+
+	timer := time.NewTimer(OCSPCheckWait)
+	defer timer.Stop()
+
+	select {
+	case <-pending:
+	case <-timer.C:
+		slog.Warn("OCSP responder did not answer in time, checking client certificate in the background",
+			slog.String("subject", cert.Subject.String()),
+			slog.String("responder", cert.OCSPServer[0]))
+
+		return RevocationUnknown
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !now.Before(entry.expiry) {
+		return RevocationUnknown
+	}
+
+	return entry.status
+}
+
+// add puts the entry in place. If the cache is full, the expired entries are removed first.
+func (c *revocationChecker) add(key string, entry *ocspEntry, now time.Time) {
+	if len(c.ocspCache) >= ocspMaxCacheEntries {
+		for k, e := range c.ocspCache {
+			if e.pending == nil && !now.Before(e.expiry) {
+				delete(c.ocspCache, k)
+			}
+		}
+	}
+
+	c.ocspCache[key] = entry
+}
+
+// fetch retrieves the status of the certificate from its OCSP responder into the entry. On failure, the previous
+// status is kept as long as it is valid and the retrieval is retried on the next check.
+func (c *revocationChecker) fetch(entry *ocspEntry, cert, issuer *x509.Certificate) {
+	response, _, err := queryOCSP(c.client, cert, issuer)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	defer close(entry.pending)
+
+	entry.pending = nil
+
+	if err != nil {
+		slog.Warn("could not check client certificate using OCSP",
+			slog.String("subject", cert.Subject.String()),
+			slog.String("responder", cert.OCSPServer[0]),
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	now := time.Now()
+
+	entry.status, entry.expiry = RevocationUnknown, response.NextUpdate
+
+	switch response.Status {
+	case ocsp.Good:
+		entry.status = RevocationGood
+	case ocsp.Revoked:
+		entry.status = RevocationRevoked
+	}
+
+	if entry.expiry.IsZero() {
+		entry.expiry = now.Add(ocspDefaultValidity)
+	}
+
+	entry.refresh = now.Add(entry.expiry.Sub(now) / 2)
+}
+
+// queryOCSP requests the status of the certificate from its OCSP responder, giving the parsed and the raw response.
+func queryOCSP(client *http.Client, cert, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create OCSP request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), OCSPRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(request))
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create OCSP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not send OCSP request: %w", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder answered with status %v", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read OCSP response: %w", err)
+	}
+
+	response, err := ocsp.ParseResponseForCert(data, cert, issuer)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+
+	return response, data, nil
+}
+
+// check checks the revocation status of the certificate. Revoked certificates are rejected, certificates of
+// unknown status only with the hard policy.
+func (c *revocationChecker) check(cert, issuer *x509.Certificate, now time.Time) error {
+	determined := false
+
+	if len(c.crls) > 0 {
+		status := c.crlStatus(cert, issuer, now)
+		c.count(RevocationSourceCRL, status)
+
+		if status == RevocationRevoked {
+			return fmt.Errorf("%w: %v by CRL", ErrCertificateRevoked, cert.Subject)
+		}
+
+		determined = status == RevocationGood
+	}
+
+	if c.ocsp {
+		status := c.ocspStatus(cert, issuer, now)
+		c.count(RevocationSourceOCSP, status)
+
+		if status == RevocationRevoked {
+			return fmt.Errorf("%w: %v by OCSP", ErrCertificateRevoked, cert.Subject)
+		}
+
+		determined = determined || status == RevocationGood
+	}
+
+	if !determined && c.hardFail {
+		return fmt.Errorf("%w: %v", ErrRevocationUnknown, cert.Subject)
+	}
+
+	return nil
+}
+
+// verifyPeerCertificate checks the client certificate of a verified chain, to be used as
+// tls.Config.VerifyPeerCertificate. Only the client certificate itself is checked, not the intermediate
+// certificates.
+func (c *revocationChecker) verifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	// unverified certificates, e.g., in the request mode, are not trusted anyway
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) < 2 {
+		return nil
+	}
+
+	cert, issuer := verifiedChains[0][0], verifiedChains[0][1]
+
+	if err := c.check(cert, issuer, time.Now()); err != nil {
+		slog.Warn("rejected client certificate",
+			slog.String("subject", cert.Subject.String()),
+			slog.String("serial", cert.SerialNumber.String()),
+			slog.String("error", err.Error()))
+
+		return err
+	}
+
+	return nil
+}
+
+// configureRevocation adds the revocation checks of client certificates to the TLS configuration.
+func configureRevocation(config *tls.Config, settings revocationSettings) error {
+	if !settings.enabled() {
+		return nil
+	}
+
+	checker, err := newRevocationChecker(settings)
+
+	if err != nil {
+		return err
+	}
+
+	config.VerifyPeerCertificate = checker.verifyPeerCertificate
+
+	return nil
+}
@@ -0,0 +1,442 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeCRL writes a revocation list of the authority, revoking the certificates, to a PEM file and gives its name.
+func (a testCertAuthority) writeCRL(t *testing.T, nextUpdate time.Time, revoked ...tls.Certificate) string {
+	t.Helper()
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+
+	for _, cert := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   leafOf(t, cert).SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, a.cert, a.key)
+
+	if err != nil {
+		t.Fatalf("could not create revocation list: %v", err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "ca.crl")
+
+	if err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("could not write revocation list: %v", err)
+	}
+
+	return fileName
+}
+
+// leafOf parses the first certificate of the chain.
+func leafOf(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+
+	return leaf
+}
+
+// newTestOCSPResponder starts an OCSP responder of the authority, answering revoked for the serial numbers in the
+// revoked set and good for all others. The set may be filled until the first request. The number of requests is
+// counted.
+func newTestOCSPResponder(t *testing.T, authority testCertAuthority, requests *atomic.Int32,
+	revokedSerials map[string]bool) *httptest.Server {
+
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+
+		if revokedSerials[request.SerialNumber.String()] {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now().Add(-time.Minute)
+		}
+
+		response, err := ocsp.CreateResponse(authority.cert, authority.cert, template, authority.key)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(response)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestCRLRevocation(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+	otherAuthority := newTestCertAuthority(t, "Other CA")
+
+	goodCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"}})
+	revokedCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}})
+	laterCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "later"}})
+	otherCert := otherAuthority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+
+	crlFile := authority.writeCRL(t, time.Now().Add(time.Hour), revokedCert)
+	expiredFile := otherAuthority.writeCRL(t, time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		policy    string
+		authority testCertAuthority
+		cert      tls.Certificate
+		want      error
+	}{
+		{policy: RevocationPolicySoft, authority: authority, cert: goodCert},
+		{policy: RevocationPolicySoft, authority: authority, cert: revokedCert, want: ErrCertificateRevoked},
+		{policy: RevocationPolicyHard, authority: authority, cert: goodCert},
+		{policy: RevocationPolicyHard, authority: authority, cert: revokedCert, want: ErrCertificateRevoked},
+		{policy: RevocationPolicySoft, authority: otherAuthority, cert: otherCert},
+		{policy: RevocationPolicyHard, authority: otherAuthority, cert: otherCert, want: ErrRevocationUnknown},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestCRLRevocation-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			checker, err := newRevocationChecker(revocationSettings{
+				crlFiles: []string{crlFile, expiredFile},
+				policy:   test.policy,
+			})
+
+			if !assert.NoError(t, err, "checker should be created") {
+				return
+			}
+
+			err = checker.verifyPeerCertificate(nil, [][]*x509.Certificate{{leafOf(t, test.cert), test.authority.cert}})
+
+			if test.want == nil {
+				assert.NoError(t, err, "certificate should be accepted")
+			} else {
+				assert.ErrorIs(t, err, test.want, "certificate should be rejected")
+			}
+		})
+	}
+
+	t.Run("TestCRLRevocation-reload", func(t *testing.T) {
+		t.Parallel()
+
+		fileName := authority.writeCRL(t, time.Now().Add(time.Hour))
+
+		checker, err := newRevocationChecker(revocationSettings{crlFiles: []string{fileName}, policy: RevocationPolicyHard})
+
+		if !assert.NoError(t, err, "checker should be created") {
+			return
+		}
+
+		chain := [][]*x509.Certificate{{leafOf(t, laterCert), authority.cert}}
+
+		assert.NoError(t, checker.verifyPeerCertificate(nil, chain), "certificate should be accepted")
+
+		data, _ := os.ReadFile(authority.writeCRL(t, time.Now().Add(time.Hour), laterCert))
+
+		if err := os.WriteFile(fileName, data, 0o600); err != nil {
+			t.Fatalf("could not replace revocation list: %v", err)
+		}
+
+		assert.NoError(t, checker.verifyPeerCertificate(nil, chain), "revocation list is checked after interval")
+
+		checker.crls[0].checked = time.Time{}
+
+		assert.ErrorIs(t, checker.verifyPeerCertificate(nil, chain), ErrCertificateRevoked,
+			"certificate should be revoked by the reloaded list")
+
+		if err := os.WriteFile(fileName, []byte("invalid"), 0o600); err != nil {
+			t.Fatalf("could not replace revocation list: %v", err)
+		}
+
+		checker.crls[0].checked = time.Time{}
+
+		assert.ErrorIs(t, checker.verifyPeerCertificate(nil, chain), ErrCertificateRevoked,
+			"previous revocation list should be kept")
+	})
+}
+
+func TestOCSPRevocation(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+
+	var requests atomic.Int32
+
+	revoked := make(map[string]bool)
+	responder := newTestOCSPResponder(t, authority, &requests, revoked)
+
+	goodCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"},
+		OCSPServer: []string{responder.URL}})
+	revokedCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"},
+		OCSPServer: []string{responder.URL}})
+	unreachableCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "unreachable"},
+		OCSPServer: []string{"http://127.0.0.1:1/ocsp"}})
+	noResponderCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "none"}})
+
+	revoked[leafOf(t, revokedCert).SerialNumber.String()] = true
+
+	soft, softErr := newRevocationChecker(revocationSettings{ocsp: true, policy: RevocationPolicySoft})
+	hard, hardErr := newRevocationChecker(revocationSettings{ocsp: true, policy: RevocationPolicyHard})
+
+	if !assert.NoError(t, softErr, "soft checker should be created") ||
+		!assert.NoError(t, hardErr, "hard checker should be created") {
+
+		return
+	}
+
+	chain := func(cert tls.Certificate) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{leafOf(t, cert), authority.cert}}
+	}
+
+	assert.NoError(t, soft.verifyPeerCertificate(nil, chain(goodCert)), "good certificate")
+	assert.NoError(t, soft.verifyPeerCertificate(nil, chain(goodCert)), "cached good certificate")
+	assert.Equal(t, int32(1), requests.Load(), "response should be cached")
+
+	assert.ErrorIs(t, soft.verifyPeerCertificate(nil, chain(revokedCert)), ErrCertificateRevoked, "revoked certificate")
+	assert.ErrorIs(t, hard.verifyPeerCertificate(nil, chain(revokedCert)), ErrCertificateRevoked, "revoked certificate")
+
+	assert.NoError(t, soft.verifyPeerCertificate(nil, chain(unreachableCert)), "unreachable responder, soft policy")
+	assert.ErrorIs(t, hard.verifyPeerCertificate(nil, chain(unreachableCert)), ErrRevocationUnknown,
+		"unreachable responder, hard policy")
+
+	assert.NoError(t, soft.verifyPeerCertificate(nil, chain(noResponderCert)), "no responder, soft policy")
+	assert.ErrorIs(t, hard.verifyPeerCertificate(nil, chain(noResponderCert)), ErrRevocationUnknown,
+		"no responder, hard policy")
+
+	assert.NoError(t, hard.verifyPeerCertificate(nil, nil), "unverified certificates are not checked")
+}
+
+func TestOCSPRevocationSlowResponder(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+
+	var requests atomic.Int32
+
+	responder := newTestOCSPResponder(t, authority, &requests, nil)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		responder.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	t.Cleanup(slow.Close)
+
+	cert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "slow"},
+		OCSPServer: []string{slow.URL}})
+	chain := [][]*x509.Certificate{{leafOf(t, cert), authority.cert}}
+
+	checker, err := newRevocationChecker(revocationSettings{ocsp: true, policy: RevocationPolicyHard})
+
+	if !assert.NoError(t, err, "checker should be created") {
+		return
+	}
+
+	start := time.Now()
+
+	assert.ErrorIs(t, checker.verifyPeerCertificate(nil, chain), ErrRevocationUnknown, "responder not answering")
+	assert.Less(t, time.Since(start), OCSPRequestTimeout/2, "handshake not waiting for the request timeout")
+
+	close(release)
+
+	assert.Eventually(t, func() bool { return checker.verifyPeerCertificate(nil, chain) == nil },
+		5*time.Second, 10*time.Millisecond, "response of the background retrieval cached")
+	assert.Equal(t, int32(1), requests.Load(), "single retrieval")
+}
+
+func TestRevocationMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+
+	var requests atomic.Int32
+
+	responder := newTestOCSPResponder(t, authority, &requests, nil)
+
+	goodCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"},
+		OCSPServer: []string{responder.URL}})
+	revokedCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}})
+
+	checker, err := newRevocationChecker(revocationSettings{
+		crlFiles: []string{authority.writeCRL(t, time.Now().Add(time.Hour), revokedCert)},
+		ocsp:     true,
+		policy:   RevocationPolicySoft,
+	})
+
+	if !assert.NoError(t, err, "checker should be created") {
+		return
+	}
+
+	_ = checker.verifyPeerCertificate(nil, [][]*x509.Certificate{{leafOf(t, goodCert), authority.cert}})
+	_ = checker.verifyPeerCertificate(nil, [][]*x509.Certificate{{leafOf(t, revokedCert), authority.cert}})
+
+	var data metricdata.ResourceMetrics
+
+	if !assert.NoError(t, reader.Collect(t.Context(), &data), "metrics should be collected") {
+		return
+	}
+
+	counts := make(map[string]int64)
+
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if sum, isSum := m.Data.(metricdata.Sum[int64]); isSum && m.Name == RevocationChecksMetric {
+				for _, point := range sum.DataPoints {
+					source, _ := point.Attributes.Value(attribute.Key("source"))
+					result, _ := point.Attributes.Value(attribute.Key("result"))
+					counts[source.AsString()+"/"+result.AsString()] += point.Value
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]int64{
+		RevocationSourceCRL + "/" + RevocationGood:    1,
+		RevocationSourceOCSP + "/" + RevocationGood:   1,
+		RevocationSourceCRL + "/" + RevocationRevoked: 1,
+	}, counts, "revocation check results")
+}
+
+func TestClientCertificateRevocation(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Client CA")
+
+	goodCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"}})
+	revokedCert := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+
+	if !assert.NoError(t, configureClientCAs(server.TLS, []string{authority.writePEM(t)}, ClientAuthRequire),
+		"client certificate authorities should be configured") ||
+		!assert.NoError(t, configureRevocation(server.TLS, revocationSettings{
+			crlFiles: []string{authority.writeCRL(t, time.Now().Add(time.Hour), revokedCert)},
+			policy:   RevocationPolicyHard,
+		}), "revocation checks should be configured") {
+
+		return
+	}
+
+	server.StartTLS()
+	defer server.Close()
+
+	for _, test := range []struct {
+		cert  tls.Certificate
+		valid bool
+	}{
+		{cert: goodCert, valid: true},
+		{cert: revokedCert},
+	} {
+		transport, _ := server.Client().Transport.(*http.Transport)
+		transport = transport.Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{test.cert}
+		client := &http.Client{Transport: transport}
+
+		req, _ := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+
+		if !test.valid {
+			assert.Error(t, err, "revoked certificate should be rejected")
+			continue
+		}
+
+		if assert.NoError(t, err, "valid certificate should be accepted") {
+			_ = resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode, "status with valid certificate")
+		}
+	}
+}
+
+func TestRevocationConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, "version: 1\nroot: testroot\nclientocsp: true\nrevocationpolicy: strict\n")
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrInvalidRevocationPolicy, "expected invalid revocation policy")
+	assert.ErrorIs(t, checkErr, ErrRevocationWithoutCA, "expected missing client certificate authority")
+	assert.ErrorContains(t, checkErr, fileName+":4", "expected location of revocation policy")
+
+	invalidFile := filepath.Join(t.TempDir(), "invalid.crl")
+
+	if err := os.WriteFile(invalidFile, []byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"),
+		0o600); err != nil {
+
+		t.Fatalf("could not write revocation list: %v", err)
+	}
+
+	_, err = newRevocationChecker(revocationSettings{crlFiles: []string{invalidFile}, policy: RevocationPolicySoft})
+	assert.ErrorIs(t, err, ErrInvalidCRL, "invalid revocation list")
+
+	_, err = newRevocationChecker(revocationSettings{crlFiles: []string{"missing.crl"}, policy: RevocationPolicySoft})
+	assert.Error(t, err, "missing revocation list")
+}
@@ -0,0 +1,602 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AlphaOne1/sonicred/utils"
+)
+
+// Rewrite stages, determining if the rewrite rules see the request path before or after the base path is
+// stripped.
+const (
+	RewriteStageBefore = "before"
+	RewriteStageAfter  = "after"
+)
+
+// Fields of the request a rewrite rule can match.
+const (
+	RewriteFieldPath  = "path"
+	RewriteFieldHost  = "host"
+	RewriteFieldQuery = "query"
+)
+
+// RewriteActionRewrite is the action of rules that rewrite the request internally, instead of redirecting it.
+const RewriteActionRewrite = "rewrite"
+
+// Flags of rewrite rules, ending the processing of the following rules.
+const (
+	// RewriteFlagLast restarts the processing with the first rule, using the rewritten request.
+	RewriteFlagLast = "last"
+	// RewriteFlagBreak stops the processing, serving the rewritten request.
+	RewriteFlagBreak = "break"
+)
+
+// MaxRewriteCycles is the number of times the rule processing may be restarted by last rules, protecting against
+// rewrite loops.
+const MaxRewriteCycles = 10
+
+// ErrInvalidRewriteRule indicates that a line of a rewrite file could not be parsed.
+var ErrInvalidRewriteRule = errors.New("invalid rewrite rule")
+
+// ErrInvalidRewriteStage indicates that the rewrite stage is neither before nor after.
+var ErrInvalidRewriteStage = errors.New("rewrite stage must be before or after")
+
+// ErrRewriteLoop indicates that the rule processing was restarted too often.
+var ErrRewriteLoop = errors.New("rewrite cycle limit exceeded")
+
+// redirectStatusCodes are the status codes allowed for redirect rules.
+var redirectStatusCodes = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// captureReferenceRegex matches the references to capture groups in rewrite targets, e.g., $1 or ${1}.
+var captureReferenceRegex = regexp.MustCompile(`\$(\d|\{\d+\})`)
+
+// rewriteMatcher matches one field of the request against a glob pattern or, if prefixed with ~, a regular
+// expression. Glob patterns are converted to regular expressions, capturing the parts matched by wildcards.
+type rewriteMatcher struct {
+	field   string
+	pattern string
+	regex   *regexp.Regexp
+}
+
+// rewriteRule is a single entry of a rewrite file. If all matchers match, the request is either redirected with
+// the status code or, for a zero status, internally rewritten to the target.
+type rewriteRule struct {
+	location string
+	status   int
+	matchers []rewriteMatcher
+	target   string
+	flag     string
+}
+
+// String gives the rule as written in the rewrite file, prefixed with its location.
+func (rule rewriteRule) String() string {
+	parts := []string{RewriteActionRewrite}
+
+	if rule.status != 0 {
+		parts[0] = strconv.Itoa(rule.status)
+	}
+
+	for _, m := range rule.matchers {
+		parts = append(parts, m.field, m.pattern)
+	}
+
+	parts = append(parts, rule.target)
+
+	if len(rule.flag) > 0 {
+		parts = append(parts, rule.flag)
+	}
+
+	return rule.location + ": " + strings.Join(parts, " ")
+}
+
+// rewriteSettings holds the rewrite rules of a host and the stage they run in.
+type rewriteSettings struct {
+	rules []rewriteRule
+	stage string
+}
+
+// middleware gives the rewrite middleware for the stage, doing nothing if the rules run in the other stage.
+func (s rewriteSettings) middleware(stage string) func(http.Handler) http.Handler {
+	if s.stage != stage {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return rewriteRequests(s.rules)
+}
+
+// globToRegexp converts a glob pattern into an anchored regular expression. The wildcards * and ? do not match
+// the separator and each of them and each character class forms a capture group.
+func globToRegexp(pattern string, separator string) (*regexp.Regexp, error) {
+	notSeparator := "."
+
+	if len(separator) > 0 {
+		notSeparator = "[^" + regexp.QuoteMeta(separator) + "]"
+	}
+
+	var expr strings.Builder
+
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString("(" + notSeparator + "*)")
+		case '?':
+			expr.WriteString("(" + notSeparator + ")")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated character class in %q", ErrInvalidRewriteRule, pattern)
+			}
+
+			class := pattern[i+1 : i+1+end]
+
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("([" + class + "])")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	regex, err := regexp.Compile(expr.String())
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid glob pattern %q: %w", ErrInvalidRewriteRule, pattern, err)
+	}
+
+	return regex, nil
+}
+
+// newRewriteMatcher creates the matcher of the request field.
+func newRewriteMatcher(field, pattern string) (rewriteMatcher, error) {
+	matcher := rewriteMatcher{field: field, pattern: pattern}
+
+	if expr, isRegex := strings.CutPrefix(pattern, "~"); isRegex {
+		regex, err := regexp.Compile(expr)
+
+		if err != nil {
+			return matcher, fmt.Errorf("%w: invalid regular expression %q: %w", ErrInvalidRewriteRule, expr, err)
+		}
+
+		matcher.regex = regex
+
+		return matcher, nil
+	}
+
+	separators := map[string]string{
+		RewriteFieldPath:  "/",
+		RewriteFieldHost:  ".",
+		RewriteFieldQuery: "",
+	}
+
+	regex, err := globToRegexp(pattern, separators[field])
+	matcher.regex = regex
+
+	return matcher, err
+}
+
+// parseRewriteRule parses a line of a rewrite file of the form
+//
+//	<action> <field> <pattern> [<field> <pattern>...] <target> [last|break]
+//
+// The action is either rewrite or the status code of the redirect.
+func parseRewriteRule(line string, location string) (rewriteRule, error) {
+	tokens := strings.Fields(line)
+	rule := rewriteRule{location: location}
+
+	if len(tokens) < 4 {
+		return rule, fmt.Errorf("%w: expected action, matchers and target", ErrInvalidRewriteRule)
+	}
+
+	if tokens[0] != RewriteActionRewrite {
+		status, err := strconv.Atoi(tokens[0])
+
+		if err != nil || !slices.Contains(redirectStatusCodes, status) {
+			return rule, fmt.Errorf("%w: unknown action %q, expected %v or one of the status codes %v",
+				ErrInvalidRewriteRule, tokens[0], RewriteActionRewrite, redirectStatusCodes)
+		}
+
+		rule.status = status
+	}
+
+	i := 1
+
+	for ; i+1 < len(tokens) && slices.Contains(
+		[]string{RewriteFieldPath, RewriteFieldHost, RewriteFieldQuery}, tokens[i]); i += 2 {
+
+		matcher, err := newRewriteMatcher(tokens[i], tokens[i+1])
+
+		if err != nil {
+			return rule, err
+		}
+
+		rule.matchers = append(rule.matchers, matcher)
+	}
+
+	if len(rule.matchers) == 0 || i >= len(tokens) {
+		return rule, fmt.Errorf("%w: expected at least one matcher of %v, %v or %v and a target",
+			ErrInvalidRewriteRule, RewriteFieldPath, RewriteFieldHost, RewriteFieldQuery)
+	}
+
+	rule.target = tokens[i]
+	i++
+
+	if rule.status == 0 && !strings.HasPrefix(rule.target, "/") {
+		return rule, fmt.Errorf("%w: rewrite target %q must start with /", ErrInvalidRewriteRule, rule.target)
+	}
+
+	if i < len(tokens) {
+		if rule.status != 0 || (tokens[i] != RewriteFlagLast && tokens[i] != RewriteFlagBreak) {
+			return rule, fmt.Errorf("%w: unexpected %q, only rewrites can end with %v or %v",
+				ErrInvalidRewriteRule, tokens[i], RewriteFlagLast, RewriteFlagBreak)
+		}
+
+		rule.flag = tokens[i]
+		i++
+	}
+
+	if i < len(tokens) {
+		return rule, fmt.Errorf("%w: unexpected %q after the target", ErrInvalidRewriteRule, tokens[i])
+	}
+
+	return rule, nil
+}
+
+// parseRewriteRules reads the rewrite rules from the reader, ignoring empty lines and comments starting with #.
+func parseRewriteRules(reader io.Reader, fileName string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	var errs []error
+
+	scanner := bufio.NewScanner(reader)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		location := fmt.Sprintf("%s:%d", fileName, lineNumber)
+		rule, err := parseRewriteRule(line, location)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", location, err))
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("could not read rewrite file %v: %w", fileName, err))
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// readRewriteFiles reads the rewrite rules of all given files, keeping their order.
+func readRewriteFiles(files []string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+
+	for _, filePath := range files {
+		slog.Info("reading rewrite file", slog.String("file", filePath))
+
+		fh, err := os.Open(filepath.Clean(filePath))
+
+		if err != nil {
+			return nil, fmt.Errorf("could not open rewrite file %v: %w", filePath, err)
+		}
+
+		fileRules, err := parseRewriteRules(fh, filePath)
+		_ = fh.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, fileRules...)
+	}
+
+	return rules, nil
+}
+
+// match checks if all matchers of the rule match the request. It gives the captured groups of all matchers in
+// their order.
+func (rule rewriteRule) match(host, urlPath, query string) ([]string, bool) {
+	var captures []string
+
+	for _, m := range rule.matchers {
+		value := map[string]string{
+			RewriteFieldPath:  urlPath,
+			RewriteFieldHost:  host,
+			RewriteFieldQuery: query,
+		}[m.field]
+
+		groups := m.regex.FindStringSubmatch(value)
+
+		if groups == nil {
+			return nil, false
+		}
+
+		captures = append(captures, groups[1:]...)
+	}
+
+	return captures, true
+}
+
+// expandTarget replaces the references $1 to $9, or ${n} for any n, with the captured groups. References to
+// groups that do not exist are replaced by an empty string.
+func expandTarget(target string, captures []string) string {
+	return captureReferenceRegex.ReplaceAllStringFunc(target, func(ref string) string {
+		index, _ := strconv.Atoi(strings.Trim(ref, "${}"))
+
+		if index < 1 || index > len(captures) {
+			return ""
+		}
+
+		return captures[index-1]
+	})
+}
+
+// rewriteResult is the outcome of applying the rewrite rules to a request.
+type rewriteResult struct {
+	// matched holds the rules that matched, in the order they were applied.
+	matched []rewriteRule
+	// status is the status code of the redirect, zero if the request is served.
+	status int
+	// url is the location of the redirect or the rewritten URL of the request.
+	url *url.URL
+}
+
+// targetURL gives the URL of the expanded target. The query of the request is kept, unless the target has its
+// own one.
+func targetURL(target string, query string) (*url.URL, error) {
+	result, err := url.Parse(target)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid target %q: %w", ErrInvalidRewriteRule, target, err)
+	}
+
+	if !strings.Contains(target, "?") {
+		result.RawQuery = query
+	}
+
+	return result, nil
+}
+
+// applyRewriteRules applies the rules in their order to the request URL. Each matching rewrite changes the URL
+// seen by the following rules, a matching redirect ends the processing.
+func applyRewriteRules(rules []rewriteRule, host string, requestURL *url.URL) (rewriteResult, error) {
+	current := *requestURL
+	result := rewriteResult{url: &current}
+	cycles := 0
+
+	for i := 0; i < len(rules); i++ {
+		rule := rules[i]
+		captures, matched := rule.match(host, current.Path, current.RawQuery)
+
+		if !matched {
+			continue
+		}
+
+		result.matched = append(result.matched, rule)
+
+		target, err := targetURL(expandTarget(rule.target, captures), current.RawQuery)
+
+		if err != nil {
+			return result, fmt.Errorf("%v: %w", rule.location, err)
+		}
+
+		if rule.status != 0 {
+			result.status = rule.status
+			result.url = target
+
+			return result, nil
+		}
+
+		current.Path = target.Path
+		current.RawPath = ""
+		current.RawQuery = target.RawQuery
+
+		switch rule.flag {
+		case RewriteFlagBreak:
+			return result, nil
+		case RewriteFlagLast:
+			if cycles++; cycles > MaxRewriteCycles {
+				return result, fmt.Errorf("%w: %v", ErrRewriteLoop, rule.location)
+			}
+
+			i = -1
+		}
+	}
+
+	return result, nil
+}
+
+// rewriteRequests generates the middleware applying the rewrite rules. Redirects are answered directly, rewritten
+// requests are passed on with their new URL. Paths are matched with a leading slash, also if the base path was
+// already stripped.
+func rewriteRequests(rules []rewriteRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestURL := *r.URL
+			requestURL.Path = "/" + strings.TrimPrefix(requestURL.Path, "/")
+
+			result, err := applyRewriteRules(rules, normalizeHostName(r.Host), &requestURL)
+
+			if err != nil {
+				slog.Error("could not apply rewrite rules",
+					slog.String("path", utils.CutLog(r.URL.Path)),
+					slog.String("error", err.Error()))
+
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+				return
+			}
+
+			if len(result.matched) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if result.status != 0 {
+				http.Redirect(w, r, result.url.String(), result.status)
+				return
+			}
+
+			slog.Debug("rewriting request",
+				slog.String("from", utils.CutLog(r.URL.Path)),
+				slog.String("to", utils.CutLog(result.url.Path)))
+
+			// the file server redirects requests for index.html files to their directory, so we
+			// rewrite to the directory right away
+			if strings.HasSuffix(result.url.Path, "/index.html") {
+				result.url.Path = strings.TrimSuffix(result.url.Path, "index.html")
+			}
+
+			rewritten := new(http.Request)
+			*rewritten = *r
+			rewritten.URL = result.url
+
+			next.ServeHTTP(w, rewritten)
+		})
+	}
+}
+
+// hostForURL gives the configuration of the host serving the URL, as the virtual host dispatching would select it.
+func hostForURL(config ServerConfig, requestURL *url.URL) HostConfig {
+	var defaultHost *HostConfig
+
+	for i, host := range config.Hosts {
+		for _, name := range host.Names {
+			if normalizeHostName(name) == normalizeHostName(requestURL.Host) {
+				return host
+			}
+
+			if normalizeHostName(name) == normalizeHostName(config.DefaultHost) {
+				defaultHost = &config.Hosts[i]
+			}
+		}
+	}
+
+	if defaultHost != nil {
+		return *defaultHost
+	}
+
+	return config.mainHost()
+}
+
+// testRewrites applies the rewrite rules to each of the URLs given by the -rewritetest option, without starting
+// the server. For each URL, the matching rules and the resulting redirect or rewritten URL are written to out.
+// It returns the desired process exit code.
+func testRewrites(config ServerConfig, out io.Writer) int {
+	// the report goes to out, so the log must not
+	if err := setupLogging(os.Stderr, config.LogLevel, config.LogStyle); err != nil {
+		slog.Warn("could not set up logging, using defaults", slog.String("error", err.Error()))
+	}
+
+	exitCode := 0
+
+	for _, testURL := range *config.RewriteTests {
+		var report strings.Builder
+
+		report.WriteString(testURL + "\n")
+
+		if err := testRewrite(config, testURL, &report); err != nil {
+			_, _ = fmt.Fprintf(&report, "  error: %v\n", err)
+			exitCode = 1
+		}
+
+		if _, err := io.WriteString(out, report.String()); err != nil {
+			slog.Error("could not write rewrite report", slog.String("error", err.Error()))
+			return 1
+		}
+	}
+
+	return exitCode
+}
+
+// testRewrite applies the rewrite rules of the responsible host to the URL and adds the outcome to the report.
+func testRewrite(config ServerConfig, testURL string, report *strings.Builder) error {
+	requestURL, err := url.Parse(testURL)
+
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+
+	host := hostForURL(config, requestURL)
+
+	rules, err := readRewriteFiles(*host.RewriteFiles)
+
+	if err != nil {
+		return err
+	}
+
+	matchURL := *requestURL
+	matchURL.Path = "/" + strings.TrimPrefix(matchURL.Path, "/")
+
+	if host.RewriteStage == RewriteStageAfter {
+		if !strings.HasPrefix(matchURL.Path, host.BasePath) {
+			_, _ = fmt.Fprintf(report, "  not below base path %s\n", host.BasePath)
+			return nil
+		}
+
+		matchURL.Path = "/" + strings.TrimPrefix(matchURL.Path, host.BasePath)
+	}
+
+	result, err := applyRewriteRules(rules, normalizeHostName(requestURL.Host), &matchURL)
+
+	for _, rule := range result.matched {
+		_, _ = fmt.Fprintf(report, "  matched %v\n", rule)
+	}
+
+	switch {
+	case err != nil:
+		return err
+	case len(result.matched) == 0:
+		report.WriteString("  no rule matched\n")
+	case result.status != 0:
+		_, _ = fmt.Fprintf(report, "  redirect %d to %v\n", result.status, result.url)
+	default:
+		_, _ = fmt.Fprintf(report, "  rewrite to %v\n", result.url)
+	}
+
+	return nil
+}
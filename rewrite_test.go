@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRewriteFile(t *testing.T, content string) string {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), "rewrite.conf")
+
+	if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write rewrite file: %v", err)
+	}
+
+	return fileName
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		line  string
+		valid bool
+	}{
+		{line: "301 path /old/*.html /new/$1.html", valid: true},
+		{line: "rewrite host *.example.com path ~^/(.*)$ /sites/$1/$2 last", valid: true},
+		{line: "rewrite query lang=* /index.$1.html break", valid: true},
+		{line: "303 path /old /new", valid: false},
+		{line: "moved path /old /new", valid: false},
+		{line: "301 path /old", valid: false},
+		{line: "301 path /old /new last", valid: false},
+		{line: "rewrite path /old new", valid: false},
+		{line: "rewrite path /old /new again", valid: false},
+		{line: "rewrite path ~( /new", valid: false},
+		{line: "rewrite path /[a /new", valid: false},
+		{line: "rewrite path /old /new break extra", valid: false},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestParseRewriteRules-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseRewriteRule(test.line, "test:1")
+
+			if test.valid {
+				assert.NoError(t, err, "valid rule %q", test.line)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidRewriteRule, "invalid rule %q", test.line)
+			}
+		})
+	}
+
+	_, err := parseRewriteRules(strings.NewReader("# comment\n\n301 path /a /b\nrewrite path /a\n"), "rules.conf")
+
+	assert.ErrorContains(t, err, "rules.conf:4", "error location")
+}
+
+func TestApplyRewriteRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseRewriteRules(strings.NewReader(`
+308 host old.example.com path ~^/(.*)$ https://new.example.com/$1
+301 path /blog/*/*.html /articles/$1-$2
+rewrite path /docs/* /documentation/$1
+302 path /documentation/moved /documentation/new?from=moved
+rewrite path /app/* /app/index.html break
+rewrite path /loop /loop last
+rewrite path /v1/* /v2/$1 last
+rewrite path /v2/* /v3/${1}
+`), "rules.conf")
+
+	if !assert.NoError(t, err, "rules should be valid") {
+		return
+	}
+
+	tests := []struct {
+		host    string
+		uri     string
+		status  int
+		want    string
+		matched int
+		err     error
+	}{
+		{host: "old.example.com", uri: "/some/page?x=1", status: 308, want: "https://new.example.com/some/page?x=1",
+			matched: 1},
+		{host: "example.com", uri: "/blog/2024/hello.html", status: 301, want: "/articles/2024-hello", matched: 1},
+		{host: "example.com", uri: "/docs/intro", status: 0, want: "/documentation/intro", matched: 1},
+		{host: "example.com", uri: "/docs/moved?a=b", status: 302, want: "/documentation/new?from=moved", matched: 2},
+		{host: "example.com", uri: "/app/settings", status: 0, want: "/app/index.html", matched: 1},
+		{host: "example.com", uri: "/v1/data", status: 0, want: "/v3/data", matched: 2},
+		{host: "example.com", uri: "/other", status: 0, want: "/other", matched: 0},
+		{host: "example.com", uri: "/loop", err: ErrRewriteLoop},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestApplyRewriteRules-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			requestURL, _ := url.Parse(test.uri)
+			result, err := applyRewriteRules(rules, test.host, requestURL)
+
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err, "expected error for %v", test.uri)
+				return
+			}
+
+			if assert.NoError(t, err, "rules should apply to %v", test.uri) {
+				assert.Equal(t, test.status, result.status, "status of %v", test.uri)
+				assert.Equal(t, test.want, result.url.String(), "result of %v", test.uri)
+				assert.Len(t, result.matched, test.matched, "matched rules of %v", test.uri)
+			}
+		})
+	}
+}
+
+func TestRewriteRequests(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "app"), 0o700); err != nil {
+		t.Fatalf("could not create test directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "app", "index.html"), []byte("app"), 0o600); err != nil {
+		t.Fatalf("could not write test file: %v", err)
+	}
+
+	rewriteFile := writeRewriteFile(t, `
+301 path /old/* /site/new/$1
+rewrite path /app/* /app/index.html
+`)
+
+	tests := []struct {
+		stage   string
+		uri     string
+		status  int
+		content string
+	}{
+		{stage: RewriteStageAfter, uri: "/site/app/settings", status: http.StatusOK, content: "app"},
+		{stage: RewriteStageAfter, uri: "/site/old/page", status: http.StatusMovedPermanently},
+		{stage: RewriteStageBefore, uri: "/site/app/settings", status: http.StatusNotFound},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestRewriteRequests-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+				"-root", root, "-base", "/site/", "-rewritefile", rewriteFile, "-rewritestage", test.stage}, nil)
+
+			if !assert.NoError(t, configErr, "configuration should be valid") {
+				return
+			}
+
+			handler, cleanup, handlerErr := generateServerHandler(config)
+
+			if !assert.NoError(t, handlerErr, "handler should be generated") {
+				return
+			}
+
+			defer cleanup()
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, test.uri, nil))
+
+			assert.Equal(t, test.status, rec.Code, "status of %v", test.uri)
+
+			if len(test.content) > 0 {
+				assert.Equal(t, test.content, rec.Body.String(), "content of %v", test.uri)
+			}
+
+			if test.status == http.StatusMovedPermanently {
+				assert.Equal(t, "/site/new/page", rec.Header().Get("Location"), "location of %v", test.uri)
+			}
+		})
+	}
+}
+
+func TestTestRewrites(t *testing.T) {
+	rewriteFile := writeRewriteFile(t, "301 path /old/* /new/$1\nrewrite path /loop /loop last\n")
+
+	config, configErr := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-root", "testroot", "-rewritefile", rewriteFile,
+		"-rewritetest", "http://example.com/old/page?x=1",
+		"-rewritetest", "http://example.com/other"}, nil)
+
+	if !assert.NoError(t, configErr, "configuration should be valid") {
+		return
+	}
+
+	out := bytes.Buffer{}
+
+	assert.Equal(t, 0, testRewrites(config, &out), "exit code")
+	assert.Equal(t, fmt.Sprintf(`http://example.com/old/page?x=1
+  matched %s:1: 301 path /old/* /new/$1
+  redirect 301 to /new/page?x=1
+http://example.com/other
+  no rule matched
+`, rewriteFile), out.String(), "rewrite report")
+
+	*config.RewriteTests = MultiStringValue{"http://example.com/loop"}
+	out.Reset()
+
+	assert.Equal(t, 1, testRewrites(config, &out), "exit code of rewrite loop")
+	assert.Contains(t, out.String(), ErrRewriteLoop.Error(), "loop reported")
+}
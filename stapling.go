@@ -0,0 +1,301 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPStaplingMetric is the name of the counter of OCSP response retrievals for stapling, by result.
+const OCSPStaplingMetric = "sonicred.tls.ocsp.stapling"
+
+// OCSPStapleRetryInterval is the time after which a failed retrieval of an OCSP response is retried.
+const OCSPStapleRetryInterval = 5 * time.Minute
+
+// ocspStapleSweepInterval is the interval in which the responses of expired certificates are removed.
+const ocspStapleSweepInterval = time.Hour
+
+// OCSPStapleDir is the directory in the certificate cache holding the OCSP responses.
+const OCSPStapleDir = "ocsp"
+
+// Results of the OCSP response retrievals, reported in the log and the metric.
+const (
+	OCSPStapleFetched = "fetched"
+	OCSPStapleFailed  = "failed"
+)
+
+// stapleEntry is the OCSP response of a certificate.
+type stapleEntry struct {
+	staple     []byte
+	nextUpdate time.Time
+	refresh    time.Time
+	notAfter   time.Time
+	refreshing bool
+}
+
+// valid checks if the response may still be stapled.
+func (e *stapleEntry) valid(now time.Time) bool {
+	return len(e.staple) > 0 && (e.nextUpdate.IsZero() || now.Before(e.nextUpdate))
+}
+
+// update takes the response, to be refreshed halfway to its next update.
+func (e *stapleEntry) update(response *ocsp.Response, raw []byte, now time.Time) {
+	e.staple, e.nextUpdate = raw, response.NextUpdate
+
+	if response.NextUpdate.IsZero() {
+		e.refresh = now.Add(ocspDefaultValidity)
+	} else {
+		e.refresh = response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	}
+}
+
+// ocspStapler staples OCSP responses to the certificates of the server. The responses are retrieved in the
+// background, refreshed before their next update and kept in a directory, so they are available right after a
+// restart. Certificates without an OCSP responder or issuer in their chain are served as they are.
+type ocspStapler struct {
+	dir     string
+	client  *http.Client
+	counter metric.Int64Counter
+
+	lock    sync.Mutex
+	entries map[string]*stapleEntry
+	swept   time.Time
+}
+
+// newOCSPStapler creates a stapler keeping its responses in the OCSP directory of the certificate cache.
+func newOCSPStapler(certCache string) *ocspStapler {
+	stapler := &ocspStapler{
+		dir:     filepath.Join(certCache, OCSPStapleDir),
+		client:  &http.Client{Timeout: OCSPRequestTimeout},
+		entries: make(map[string]*stapleEntry),
+	}
+
+	counter, err := otel.Meter(ServerName).Int64Counter(OCSPStaplingMetric,
+		metric.WithDescription("Number of OCSP response retrievals for stapling, by result."),
+		metric.WithUnit("{retrieval}"))
+
+	if err != nil {
+		slog.Warn("could not create OCSP stapling metric", slog.String("error", err.Error()))
+	} else {
+		stapler.counter = counter
+	}
+
+	return stapler
+}
+
+// count adds the result of a retrieval to the metric.
+func (s *ocspStapler) count(result string) {
+	if s.counter != nil {
+		s.counter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("result", result)))
+	}
+}
+
+// wrap changes the certificate selection of the configuration to staple the OCSP responses.
+func (s *ocspStapler) wrap(config *tls.Config) {
+	getCertificate := config.GetCertificate
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+
+		if err != nil || cert == nil {
+			return cert, err
+		}
+
+		return s.staple(cert, time.Now()), nil
+	}
+}
+
+// staple gives the certificate with its current OCSP response. A retrieval is started if the response is missing
+// or due to be refreshed.
+func (s *ocspStapler) staple(cert *tls.Certificate, now time.Time) *tls.Certificate {
+	if len(cert.Certificate) < 2 {
+		return cert
+	}
+
+	leaf := cert.Leaf
+
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+
+		if err != nil {
+			return cert
+		}
+
+		leaf = parsed
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		return cert
+	}
+
+	sum := sha256.Sum256(leaf.Raw)
+	key := hex.EncodeToString(sum[:])
+
+	s.lock.Lock()
+	entry, found := s.entries[key]
+	s.lock.Unlock()
+
+	// the stored response is read without holding the lock, so that other handshakes are not delayed
+	if !found {
+		entry = s.add(key, s.load(key, cert, leaf, now), now)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !entry.refreshing && !now.Before(entry.refresh) {
+		entry.refreshing = true
+
+		go s.fetch(key, entry, cert, leaf)
+	}
+
+	if !entry.valid(now) {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = entry.staple
+
+	return &stapled
+}
+
+// add puts the entry in place, unless another handshake added one meanwhile, and gives the entry in place. The
+// entries of expired certificates are removed at most every ocspStapleSweepInterval.
+func (s *ocspStapler) add(key string, entry *stapleEntry, now time.Time) *stapleEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, found := s.entries[key]; found {
+		return existing
+	}
+
+	if now.Sub(s.swept) >= ocspStapleSweepInterval {
+		s.swept = now
+
+		for other, otherEntry := range s.entries {
+			if now.After(otherEntry.notAfter) {
+				delete(s.entries, other)
+			}
+		}
+	}
+
+	s.entries[key] = entry
+
+	return entry
+}
+
+// load creates the entry of the certificate, using the response of the directory if it is still valid.
+func (s *ocspStapler) load(key string, cert *tls.Certificate, leaf *x509.Certificate, now time.Time) *stapleEntry {
+	entry := &stapleEntry{notAfter: leaf.NotAfter, refresh: now}
+
+	raw, err := os.ReadFile(filepath.Join(s.dir, key+".ocsp"))
+
+	if err != nil {
+		return entry
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+
+	if err != nil {
+		return entry
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+
+	if err != nil {
+		slog.Warn("ignoring invalid cached OCSP response",
+			slog.String("subject", leaf.Subject.String()),
+			slog.String("error", err.Error()))
+
+		return entry
+	}
+
+	if !response.NextUpdate.IsZero() && !now.Before(response.NextUpdate) {
+		return entry
+	}
+
+	entry.update(response, raw, now)
+
+	return entry
+}
+
+// fetch retrieves the response of the certificate and keeps it in the entry and the directory. On failure, the
+// previous response is kept as long as it is valid and the retrieval is retried later.
+func (s *ocspStapler) fetch(key string, entry *stapleEntry, cert *tls.Certificate, leaf *x509.Certificate) {
+	response, raw, err := s.query(cert, leaf)
+
+	s.lock.Lock()
+
+	now := time.Now()
+
+	entry.refreshing = false
+
+	if err != nil {
+		entry.refresh = now.Add(OCSPStapleRetryInterval)
+
+		if !entry.nextUpdate.IsZero() && entry.nextUpdate.Before(entry.refresh) {
+			entry.refresh = entry.nextUpdate
+		}
+
+		slog.Error("could not retrieve OCSP response for stapling",
+			slog.String("subject", leaf.Subject.String()),
+			slog.String("error", err.Error()),
+			slog.Bool("stapled", entry.valid(now)))
+
+		s.lock.Unlock()
+		s.count(OCSPStapleFailed)
+
+		return
+	}
+
+	if response.Status == ocsp.Revoked {
+		slog.Error("TLS certificate revoked according to OCSP responder",
+			slog.String("subject", leaf.Subject.String()),
+			slog.Time("revoked", response.RevokedAt))
+	}
+
+	entry.update(response, raw, now)
+
+	// the handshakes only use the entry, so the response is stored without holding the lock
+	s.lock.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		slog.Warn("could not create OCSP response directory", slog.String("error", err.Error()))
+	} else if err := os.WriteFile(filepath.Join(s.dir, key+".ocsp"), raw, 0o600); err != nil {
+		slog.Warn("could not store OCSP response", slog.String("error", err.Error()))
+	}
+
+	slog.Info("retrieved OCSP response for stapling",
+		slog.String("subject", leaf.Subject.String()),
+		slog.Time("next_update", response.NextUpdate))
+
+	s.count(OCSPStapleFetched)
+}
+
+// query requests the response of the certificate from its OCSP responder.
+func (s *ocspStapler) query(cert *tls.Certificate, leaf *x509.Certificate) (*ocsp.Response, []byte, error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse issuer certificate: %w", err)
+	}
+
+	return queryOCSP(s.client, leaf, issuer)
+}
@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/crypto/ocsp"
+)
+
+// issueTestServerCertificate creates a server certificate for localhost of the authority, naming the OCSP
+// responder. The chain includes the certificate of the authority.
+func issueTestServerCertificate(t *testing.T, authority testCertAuthority, ocspServer string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ocspServer},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.cert, key.Public(), authority.key)
+
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der, authority.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// stapledStatus gives the status of the stapled OCSP response of the certificate, -1 if there is none.
+func stapledStatus(t *testing.T, cert *tls.Certificate, authority testCertAuthority) int {
+	t.Helper()
+
+	if len(cert.OCSPStaple) == 0 {
+		return -1
+	}
+
+	response, err := ocsp.ParseResponseForCert(cert.OCSPStaple, cert.Leaf, authority.cert)
+
+	if err != nil {
+		t.Errorf("invalid stapled OCSP response: %v", err)
+		return -1
+	}
+
+	return response.Status
+}
+
+func TestOCSPStapling(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Server CA")
+
+	var requests atomic.Int32
+
+	responder := newTestOCSPResponder(t, authority, &requests, nil)
+	cert := issueTestServerCertificate(t, authority, responder.URL)
+	certCache := t.TempDir()
+	stapler := newOCSPStapler(certCache)
+
+	assert.Empty(t, stapler.staple(&cert, time.Now()).OCSPStaple, "no response before the first retrieval")
+	assert.Eventually(t, func() bool {
+		return stapledStatus(t, stapler.staple(&cert, time.Now()), authority) == ocsp.Good
+	}, 5*time.Second, 10*time.Millisecond, "response stapled after the retrieval")
+	assert.Equal(t, int32(1), requests.Load(), "single retrieval")
+	assert.Empty(t, cert.OCSPStaple, "original certificate unchanged")
+
+	files, _ := filepath.Glob(filepath.Join(certCache, OCSPStapleDir, "*.ocsp"))
+	assert.Len(t, files, 1, "response stored in the certificate cache")
+
+	restarted := newOCSPStapler(certCache)
+
+	assert.Equal(t, ocsp.Good, stapledStatus(t, restarted.staple(&cert, time.Now()), authority),
+		"stored response stapled right away")
+	assert.Equal(t, int32(1), requests.Load(), "stored response not retrieved again")
+
+	// the responses of the test responder are valid for an hour, so they are refreshed after half an hour
+	assert.Equal(t, ocsp.Good, stapledStatus(t, restarted.staple(&cert, time.Now().Add(45*time.Minute)), authority),
+		"previous response stapled while refreshing")
+	assert.Eventually(t, func() bool { return requests.Load() == 2 }, 5*time.Second, 10*time.Millisecond,
+		"response refreshed before its next update")
+
+	selfSigned := tls.Certificate{Certificate: [][]byte{authority.cert.Raw}}
+
+	assert.Same(t, &selfSigned, stapler.staple(&selfSigned, time.Now()), "certificate without issuer unchanged")
+
+	withoutResponder := authority.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+	withoutResponder.Certificate = append(withoutResponder.Certificate, authority.cert.Raw)
+
+	assert.Same(t, &withoutResponder, stapler.staple(&withoutResponder, time.Now()),
+		"certificate without OCSP responder unchanged")
+}
+
+func TestOCSPStaplingEntries(t *testing.T) {
+	t.Parallel()
+
+	stapler := newOCSPStapler(t.TempDir())
+	now := time.Now()
+	first := &stapleEntry{notAfter: now.Add(time.Minute)}
+
+	assert.Same(t, first, stapler.add("first", first, now), "entry added")
+	assert.Same(t, first, stapler.add("first", &stapleEntry{}, now), "entry added meanwhile kept")
+
+	stapler.add("second", &stapleEntry{notAfter: now.Add(2 * time.Hour)}, now.Add(2*time.Minute))
+
+	assert.Contains(t, stapler.entries, "first", "expired entry kept until the next sweep")
+
+	stapler.add("third", &stapleEntry{notAfter: now.Add(2 * time.Hour)}, now.Add(ocspStapleSweepInterval))
+
+	assert.NotContains(t, stapler.entries, "first", "expired entry removed")
+	assert.Len(t, stapler.entries, 2, "other entries kept")
+}
+
+func TestOCSPStaplingMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	authority := newTestCertAuthority(t, "Test Server CA")
+
+	var requests atomic.Int32
+
+	responder := newTestOCSPResponder(t, authority, &requests, nil)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	stapler := newOCSPStapler(t.TempDir())
+	good := issueTestServerCertificate(t, authority, responder.URL)
+	unavailable := issueTestServerCertificate(t, authority, failing.URL)
+
+	_ = stapler.staple(&good, time.Now())
+	_ = stapler.staple(&unavailable, time.Now())
+
+	counts := func() map[string]int64 {
+		var data metricdata.ResourceMetrics
+
+		result := make(map[string]int64)
+
+		if err := reader.Collect(t.Context(), &data); err != nil {
+			return result
+		}
+
+		for _, scope := range data.ScopeMetrics {
+			for _, m := range scope.Metrics {
+				if sum, isSum := m.Data.(metricdata.Sum[int64]); isSum && m.Name == OCSPStaplingMetric {
+					for _, point := range sum.DataPoints {
+						value, _ := point.Attributes.Value(attribute.Key("result"))
+						result[value.AsString()] += point.Value
+					}
+				}
+			}
+		}
+
+		return result
+	}
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]int64{OCSPStapleFetched: 1, OCSPStapleFailed: 1}, counts())
+	}, 5*time.Second, 10*time.Millisecond, "retrieval results")
+
+	assert.Empty(t, stapler.staple(&unavailable, time.Now()).OCSPStaple, "no response after failed retrieval")
+
+	_ = stapler.staple(&unavailable, time.Now().Add(time.Minute))
+
+	assert.Equal(t, map[string]int64{OCSPStapleFetched: 1, OCSPStapleFailed: 1}, counts(),
+		"failed retrieval not retried right away")
+}
+
+func TestOCSPStaplingHandshake(t *testing.T) {
+	t.Parallel()
+
+	authority := newTestCertAuthority(t, "Test Server CA")
+
+	var requests atomic.Int32
+
+	responder := newTestOCSPResponder(t, authority, &requests, nil)
+	cert := issueTestServerCertificate(t, authority, responder.URL)
+	dir := t.TempDir()
+	pair := certKeyPair{cert: filepath.Join(dir, "cert.pem"), key: filepath.Join(dir, "key.pem")}
+
+	keyDER, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	certPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[1]})...)
+
+	writeTestFile(t, pair.cert, certPEM, time.Now())
+	writeTestFile(t, pair.key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), time.Now())
+
+	config, err := generateTLSConfig([]certKeyPair{pair}, acmeSettings{certCache: t.TempDir()},
+		tlsSettings{profile: TLSProfileModern}, nil, "", revocationSettings{}, nil, nil, true)
+
+	if !assert.NoError(t, err, "configuration should be generated") {
+		return
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+
+	if !assert.NoError(t, err, "listener should be started") {
+		return
+	}
+
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.cert)
+
+	stapled := func() []byte {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS13})
+
+		if err != nil {
+			t.Errorf("handshake failed: %v", err)
+			return nil
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		return conn.ConnectionState().OCSPResponse
+	}
+
+	assert.Eventually(t, func() bool { return len(stapled()) > 0 }, 5*time.Second, 10*time.Millisecond,
+		"OCSP response stapled in the handshake")
+}
@@ -8,8 +8,10 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -17,46 +19,101 @@ import (
 
 var errTLSConfig = errors.New("invalid tls configuration")
 
+// ErrInvalidTLSPair indicates a certificate and key pair not given as certificate and key file separated by comma.
+var ErrInvalidTLSPair = errors.New("invalid certificate and key pair")
+
+// ErrUnknownDefaultCert indicates that the default certificate is not one of the configured certificates.
+var ErrUnknownDefaultCert = errors.New("default certificate is not one of the configured certificates")
+
+// certKeyPair names the certificate and the corresponding key file of a TLS certificate, and where they are
+// configured.
+type certKeyPair struct {
+	cert   string
+	key    string
+	source ValueSource
+}
+
+// sameFiles reports if both pairs name the same certificate and key files.
+func (p certKeyPair) sameFiles(other certKeyPair) bool {
+	return p.cert == other.cert && p.key == other.key
+}
+
 // generateTLSConfig generates a new TLS configuration if the parameters are set accordingly.
-// To use a user-supplied cert- and key file, only specify those two parameters. Specifying
-// the acmeDomains will lead to an error in this case.
-// To use the Let's Encrypt feature, cert and key are to be left empty and acmeDomains must
-// be specified.
+// To use user-supplied cert- and key files, specify the certs parameter. The certificate presented to a client
+// is selected using the server name it sends, see certificateStore. The first certificate is used for clients
+// not sending a server name matching any of the certificates.
+// To use the Let's Encrypt feature, specify the domains of the retrieval. Both can be combined, these domains are
+// then served using the retrieved certificates, all other names using the user-supplied ones. Given the
+// certManager of the plain HTTP server, the certificates may also be retrieved using the HTTP-01 challenges, see
+// newSharedACMEManager.
+// With stapling, the OCSP responses of the certificates are stapled, see ocspStapler.
+// The versions, cipher suites, curves and application protocols are set according to the policy.
+// Expired and overlapping certificates and hostNames without a certificate are logged as warnings.
 // If nothing is specified, no TLS configuration is generated.
 func generateTLSConfig(
-	cert string,
-	key string,
-	acmeDomains []string,
-	certCache string,
-	acmeEndpoint string,
-	clientCAs []string) (*tls.Config, error) {
-
-	if err := validateTLSParams(cert, key, acmeDomains, clientCAs); err != nil {
+	certs []certKeyPair,
+	retrieval acmeSettings,
+	policy tlsSettings,
+	clientCAs []string,
+	clientAuth string,
+	revocation revocationSettings,
+	hostNames []string,
+	certManager *autocert.Manager,
+	stapling bool) (*tls.Config, error) {
+
+	acmeDomains := retrieval.domains
+
+	if err := validateTLSParams(certs, acmeDomains, clientCAs); err != nil {
 		return nil, err
 	}
 
 	// completely valid, we do not have a TLS configuration
-	if len(cert) == 0 && len(acmeDomains) == 0 {
+	if len(certs) == 0 && len(acmeDomains) == 0 {
 		return nil, nil
 	}
 
 	var config *tls.Config
-	var err error
 
-	if len(cert) > 0 {
-		config, err = createCertificateConfig(cert, key)
+	store, err := loadCertificateStore(certs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	warnCertificateCoverage(slog.Default(), store, acmeDomains, hostNames, time.Now())
+
+	if len(certs) > 0 {
+		config = createCertificateConfig(store)
+	}
+
+	if len(acmeDomains) > 0 {
+		acmeConfig, err := createACMEConfig(retrieval, certManager)
 
 		if err != nil {
 			return nil, err
 		}
+
+		if config == nil {
+			config = acmeConfig
+		} else {
+			combineACMEConfig(config, acmeConfig, acmeDomains)
+		}
 	}
 
-	if len(acmeDomains) > 0 {
-		config = createACMEConfig(acmeDomains, certCache, acmeEndpoint)
+	if stapling {
+		newOCSPStapler(retrieval.certCache).wrap(config)
 	}
 
-	if config != nil && len(clientCAs) > 0 {
-		if err := configureClientCAs(config, clientCAs); err != nil {
+	if err := policy.apply(config); err != nil {
+		return nil, err
+	}
+
+	if len(clientCAs) > 0 {
+		if err := configureClientCAs(config, clientCAs, clientAuth); err != nil {
+			return nil, err
+		}
+
+		if err := configureRevocation(config, revocation); err != nil {
 			return nil, err
 		}
 	}
@@ -65,81 +122,149 @@ func generateTLSConfig(
 }
 
 // validateTLSParams validates the provided TLS configuration parameters according to specific constraints.
-// Ensures cert and key are both set or unset, acmeDomains mutually exclude cert/key, and clientCAs require TLS setup.
+// Ensures cert and key are both set and clientCAs require TLS setup.
 // Returns an error if parameters are invalid, otherwise nil.
-func validateTLSParams(cert, key string, acmeDomains, clientCAs []string) error {
-	if (len(cert) > 0) != (len(key) > 0) {
-		return fmt.Errorf("cert and key must both be given or not given: %w", errTLSConfig)
-	}
-
-	if len(cert) > 0 && len(acmeDomains) > 0 {
-		return fmt.Errorf("either cert+key or acmeDomains are to be given: %w", errTLSConfig)
+func validateTLSParams(certs []certKeyPair, acmeDomains, clientCAs []string) error {
+	for _, pair := range certs {
+		if len(pair.cert) == 0 || len(pair.key) == 0 {
+			return fmt.Errorf("cert and key must both be given or not given (%v): %w", pair.source, errTLSConfig)
+		}
 	}
 
-	if len(cert) == 0 && len(acmeDomains) == 0 && len(clientCAs) > 0 {
+	if len(certs) == 0 && len(acmeDomains) == 0 && len(clientCAs) > 0 {
 		return fmt.Errorf("clientCAs are only valid if cert+key or acmeDomains are given: %w", errTLSConfig)
 	}
 
 	return nil
 }
 
-// createCertificateConfig loads a TLS certificate and private key and returns a configured TLS configuration.
-// certFile is the path to the certificate file. keyFile is the path to the private key file.
-// Returns a tls.Config instance on success or an error if loading the certificate or key fails.
-func createCertificateConfig(certFile, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// createCertificateConfig returns a TLS configuration presenting the certificates of the store. Changed
+// certificate and key files are loaded again, see watchedCertificate.
+func createCertificateConfig(store certificateStore) *tls.Config {
+	return &tls.Config{
+		GetCertificate: store.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS13,
+	}
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("could not load certificate: %w", err)
+// combineACMEConfig changes the configuration to serve the acmeDomains, and the challenges to retrieve their
+// certificates, using the certificates of the ACME configuration. All other server names keep being served by
+// the certificates of the configuration.
+func combineACMEConfig(config, acmeConfig *tls.Config, acmeDomains []string) {
+	getCertificate, getACMECertificate := config.GetCertificate, acmeConfig.GetCertificate
+
+	config.NextProtos = acmeConfig.NextProtos
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) ||
+			slices.ContainsFunc(acmeDomains, func(domain string) bool {
+				return normalizeHostName(domain) == normalizeHostName(hello.ServerName)
+			}) {
+
+			return getACMECertificate(hello)
+		}
+
+		return getCertificate(hello)
 	}
+}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS13,
-	}, nil
+// certificateCovers checks if the certificate is valid for the name. Wildcard names are only covered by the same
+// wildcard name.
+func certificateCovers(cert *x509.Certificate, name string) bool {
+	if strings.HasPrefix(name, "*.") {
+		return slices.ContainsFunc(cert.DNSNames, func(n string) bool { return strings.EqualFold(n, name) })
+	}
+
+	return cert.VerifyHostname(normalizeHostName(name)) == nil
 }
 
-// createACMEConfig initializes and returns a TLS configuration for handling ACME-based certificate management.
-// acmeDomains specifies the list of allowed domains for certificate provisioning.
-// certCache defines the file path where certificates are cached.
-// acmeEndpoint is the optional URL for a custom ACME directory endpoint. If empty, the default endpoint is used.
-func createACMEConfig(acmeDomains []string, certCache, acmeEndpoint string) *tls.Config {
-	var acmeClient *acme.Client
+// warnCertificateCoverage logs expired certificates, names covered by multiple certificates, and host names not
+// covered by any certificate or ACME domain as warnings to the logger.
+func warnCertificateCoverage(logger *slog.Logger, store certificateStore, acmeDomains, hostNames []string,
+	now time.Time) {
 
-	if len(acmeEndpoint) > 0 {
-		acmeClient = &acme.Client{
-			DirectoryURL: acmeEndpoint,
+	for i, watched := range store {
+		leaf := watched.cert.Leaf
+
+		if now.After(leaf.NotAfter) {
+			logger.Warn("TLS certificate expired",
+				slog.String("file", watched.pair.cert),
+				slog.Time("expiry", leaf.NotAfter))
 		}
-	}
 
-	certManager := autocert.Manager{
-		Cache:      autocert.DirCache(certCache),
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(acmeDomains...),
-		Client:     acmeClient,
+		for _, other := range store[i+1:] {
+			var overlap []string
+
+			for _, name := range leaf.DNSNames {
+				if certificateCovers(other.cert.Leaf, name) {
+					overlap = append(overlap, name)
+				}
+			}
+
+			for _, name := range other.cert.Leaf.DNSNames {
+				if certificateCovers(leaf, name) && !slices.Contains(overlap, name) {
+					overlap = append(overlap, name)
+				}
+			}
+
+			if len(overlap) > 0 {
+				logger.Warn("TLS certificates overlap, using the exactly matching or else the first one",
+					slog.String("file", watched.pair.cert),
+					slog.String("other", other.pair.cert),
+					slog.Any("names", overlap))
+			}
+		}
+
+		for _, domain := range acmeDomains {
+			if certificateCovers(leaf, domain) {
+				logger.Warn("TLS certificate overlaps ACME domain, using the retrieved certificate",
+					slog.String("file", watched.pair.cert),
+					slog.String("domain", domain))
+			}
+		}
 	}
 
-	return certManager.TLSConfig()
+	for _, name := range hostNames {
+		covered := slices.ContainsFunc(acmeDomains, func(domain string) bool {
+			return normalizeHostName(domain) == normalizeHostName(name)
+		}) || slices.ContainsFunc(store, func(watched *watchedCertificate) bool {
+			return certificateCovers(watched.cert.Leaf, name)
+		})
+
+		if !covered {
+			logger.Warn("no TLS certificate covers host name", slog.String("name", name))
+		}
+	}
 }
 
 // configureClientCAs sets up the ClientCA pool in the provided tls.Config using the
 // provided list of CA file paths. It reads each file, appends its certificates to a
-// new cert pool, and configures the config for client certificate auth.
-func configureClientCAs(config *tls.Config, clientCAs []string) error {
-	clientCAPool := x509.NewCertPool()
+// new cert pool, and configures the config for client certificate auth using the
+// given mode, see clientAuthModes. Changed files are loaded again, see watchedCertPool.
+func configureClientCAs(config *tls.Config, clientCAs []string, clientAuth string) error {
+	mode, found := clientAuthModes[clientAuth]
 
-	for _, ca := range clientCAs {
-		caFile, err := os.ReadFile(filepath.Clean(ca))
+	if !found {
+		return fmt.Errorf("%w: %q", ErrInvalidClientAuth, clientAuth)
+	}
 
-		if err != nil {
-			return fmt.Errorf("could not read client CA file: %w", err)
-		}
+	versions, err := fileVersions(clientCAs...)
 
-		clientCAPool.AppendCertsFromPEM(caFile)
+	if err != nil {
+		return fmt.Errorf("could not read client CA file: %w", err)
 	}
 
+	clientCAPool, err := loadCertPool(clientCAs)
+
+	if err != nil {
+		return err
+	}
+
+	watched := &watchedCertPool{files: clientCAs, base: config, versions: versions, checked: time.Now()}
+
 	config.ClientCAs = clientCAPool
-	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientAuth = mode
+	config.GetConfigForClient = watched.getConfigForClient
 
 	return nil
 }
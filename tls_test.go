@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a new self-signed certificate for the DNS names and its key to the directory.
+func writeTestCertificate(t *testing.T, dir, name string, notAfter time.Time, dnsNames ...string) certKeyPair {
+	t.Helper()
+
+	cert := newTestServerCertificate(t, notAfter, dnsNames...)
+	pair := certKeyPair{cert: filepath.Join(dir, name+".pem"), key: filepath.Join(dir, name+".key")}
+
+	writeTestFile(t, pair.cert, cert.cert, time.Now())
+	writeTestFile(t, pair.key, cert.key, time.Now())
+
+	return pair
+}
+
+// testHello creates the hello message of a TLS 1.3 client supporting ECDSA certificates.
+func testHello(serverName string, protos ...string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedProtos:   protos,
+	}
+}
+
+func TestCertificateSelection(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hour := time.Now().Add(time.Hour)
+
+	store, err := loadCertificateStore([]certKeyPair{
+		writeTestCertificate(t, dir, "default", hour, "default.example.org"),
+		writeTestCertificate(t, dir, "wildcard", hour, "*.example.com"),
+		writeTestCertificate(t, dir, "www", hour, "www.example.com", "example.com"),
+	})
+
+	if !assert.NoError(t, err, "certificates should be loaded") {
+		return
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "", want: "default.example.org"},
+		{serverName: "default.example.org", want: "default.example.org"},
+		{serverName: "www.example.com", want: "www.example.com"},
+		{serverName: "example.com", want: "www.example.com"},
+		{serverName: "docs.example.com", want: "*.example.com"},
+		{serverName: "API.Example.Com", want: "*.example.com"},
+		{serverName: "a.b.example.com", want: "default.example.org"},
+		{serverName: "example.net", want: "default.example.org"},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestCertificateSelection-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			cert, err := store.getCertificate(testHello(test.serverName))
+
+			if assert.NoError(t, err, "certificate should be selected") {
+				assert.Equal(t, test.want, cert.Leaf.DNSNames[0], "certificate for %q", test.serverName)
+			}
+		})
+	}
+}
+
+func TestCombineACMEConfig(t *testing.T) {
+	t.Parallel()
+
+	store, err := loadCertificateStore([]certKeyPair{
+		writeTestCertificate(t, t.TempDir(), "wildcard", time.Now().Add(time.Hour), "*.example.com"),
+	})
+
+	if !assert.NoError(t, err, "certificates should be loaded") {
+		return
+	}
+
+	acmeCert := &tls.Certificate{}
+
+	config := createCertificateConfig(store)
+	combineACMEConfig(config, &tls.Config{
+		NextProtos: []string{"h2", "http/1.1", "acme-tls/1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return acmeCert, nil
+		},
+	}, []string{"shop.example.com"})
+
+	tests := []struct {
+		hello *tls.ClientHelloInfo
+		acme  bool
+	}{
+		{hello: testHello("shop.example.com"), acme: true},
+		{hello: testHello("SHOP.example.com."), acme: true},
+		{hello: testHello("docs.example.com")},
+		{hello: testHello("")},
+		{hello: testHello("docs.example.com", "acme-tls/1"), acme: true},
+	}
+
+	for _, test := range tests {
+		cert, err := config.GetCertificate(test.hello)
+
+		if assert.NoError(t, err, "certificate should be selected") {
+			assert.Equal(t, test.acme, cert == acmeCert, "ACME certificate for %q", test.hello.ServerName)
+		}
+	}
+
+	assert.Contains(t, config.NextProtos, "acme-tls/1", "protocol of the ACME challenges")
+}
+
+func TestWarnCertificateCoverage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hour := time.Now().Add(time.Hour)
+
+	store, err := loadCertificateStore([]certKeyPair{
+		writeTestCertificate(t, dir, "wildcard", hour, "*.example.com"),
+		writeTestCertificate(t, dir, "www", hour, "www.example.com"),
+		writeTestCertificate(t, dir, "expired", time.Now().Add(-time.Hour), "old.example.org"),
+	})
+
+	if !assert.NoError(t, err, "expired certificates should be loaded") {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	warnCertificateCoverage(slog.New(slog.NewTextHandler(&buf, nil)), store,
+		[]string{"shop.example.com", "example.net"},
+		[]string{"docs.example.com", "example.net", "example.org"}, time.Now())
+
+	warnings := buf.String()
+
+	assert.Contains(t, warnings, `msg="TLS certificate expired" file=`+filepath.Join(dir, "expired.pem"),
+		"expired certificate")
+	assert.Contains(t, warnings, `msg="TLS certificates overlap, using the exactly matching or else the first one" `+
+		"file="+filepath.Join(dir, "wildcard.pem")+" other="+filepath.Join(dir, "www.pem")+" names=[www.example.com]",
+		"overlapping certificates")
+	assert.Contains(t, warnings, `msg="TLS certificate overlaps ACME domain, using the retrieved certificate" `+
+		"file="+filepath.Join(dir, "wildcard.pem")+" domain=shop.example.com", "certificate overlapping ACME domain")
+	assert.Contains(t, warnings, `msg="no TLS certificate covers host name" name=example.org`, "uncovered host name")
+	assert.NotContains(t, warnings, "name=docs.example.com", "host name covered by wildcard")
+	assert.NotContains(t, warnings, "name=example.net", "host name covered by ACME domain")
+}
+
+func TestTLSPairs(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hour := time.Now().Add(time.Hour)
+
+	mainPair := writeTestCertificate(t, dir, "main", hour, "example.com")
+	wildcard := writeTestCertificate(t, dir, "wildcard", hour, "*.example.com")
+	api := writeTestCertificate(t, dir, "api", hour, "api.example.org")
+
+	fileName := writeConfigFile(t, fmt.Sprintf(`version: 1
+root: testroot
+tlscert: %s
+tlskey: %s
+tlspair:
+  - %s,%s
+  - %s,%s
+tlsdefault: %s
+acmedomain: shop.example.com
+`, mainPair.cert, mainPair.key, wildcard.cert, wildcard.key, api.cert, api.key, wildcard.cert))
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration should be valid") ||
+		!assert.NoError(t, checkConfigConsistency(config), "configuration should be consistent") {
+
+		return
+	}
+
+	withSource := func(pair certKeyPair, line int) certKeyPair {
+		pair.source = ValueSource{Kind: SourceFile, Location: fmt.Sprintf("%s:%d", fileName, line)}
+		return pair
+	}
+
+	assert.Equal(t, []certKeyPair{withSource(wildcard, 5), withSource(mainPair, 3), withSource(api, 5)},
+		config.certKeyPairs(), "default certificate first")
+
+	tlsConfig, err := generateServerTLSConfig(config, nil)
+
+	if !assert.NoError(t, err, "certificates and ACME domains should be combined") {
+		return
+	}
+
+	cert, err := tlsConfig.GetCertificate(testHello(""))
+
+	if assert.NoError(t, err, "default certificate should be selected") {
+		assert.Equal(t, []string{"*.example.com"}, cert.Leaf.DNSNames, "default certificate")
+	}
+
+	fileName = writeConfigFile(t, "version: 1\nroot: testroot\ntlspair:\n  - cert.pem\ntlsdefault: other.pem\n")
+
+	config, err = parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrInvalidTLSPair, "expected invalid certificate and key pair")
+	assert.ErrorIs(t, checkErr, ErrUnknownDefaultCert, "expected unknown default certificate")
+	assert.ErrorContains(t, checkErr, fileName+":5", "expected location of default certificate")
+}
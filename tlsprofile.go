@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profiles of the TLS settings offered to the clients.
+const (
+	// TLSProfileModern only allows TLS 1.3.
+	TLSProfileModern = "modern"
+	// TLSProfileIntermediate additionally allows TLS 1.2 with forward secret AEAD cipher suites.
+	TLSProfileIntermediate = "intermediate"
+	// TLSProfileCustom uses the configured versions, cipher suites and curves.
+	TLSProfileCustom = "custom"
+)
+
+// ErrInvalidTLSProfile indicates an unknown TLS profile.
+var ErrInvalidTLSProfile = errors.New("invalid TLS profile")
+
+// ErrInvalidTLSVersion indicates an unknown or insecure TLS version or a minimum version above the maximum version.
+var ErrInvalidTLSVersion = errors.New("invalid TLS version")
+
+// ErrInvalidCipherSuite indicates an unknown, insecure or not configurable cipher suite.
+var ErrInvalidCipherSuite = errors.New("invalid TLS cipher suite")
+
+// ErrInvalidCurve indicates an unknown key exchange curve.
+var ErrInvalidCurve = errors.New("invalid TLS curve")
+
+// ErrInvalidALPN indicates an application protocol not served by SonicRed.
+var ErrInvalidALPN = errors.New("invalid TLS application protocol")
+
+// ErrCustomTLSOptions indicates TLS version, cipher suite or curve options given for a profile other than custom.
+var ErrCustomTLSOptions = errors.New("TLS version, cipher suite and curve options require the custom profile")
+
+// ErrInvalidTicketRotation indicates a negative session ticket key rotation interval.
+var ErrInvalidTicketRotation = errors.New("session ticket key rotation interval must not be negative")
+
+// tlsVersions maps the configurable names of the TLS versions to their values.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// insecureTLSVersions lists the names of the TLS versions that are deprecated, see RFC 8996.
+var insecureTLSVersions = []string{"1.0", "1.1"}
+
+// tlsCurves maps the configurable names of the key exchange curves to their values.
+var tlsCurves = map[string]tls.CurveID{
+	"x25519mlkem768":    tls.X25519MLKEM768,
+	"secp256r1mlkem768": tls.SecP256r1MLKEM768,
+	"x25519":            tls.X25519,
+	"p256":              tls.CurveP256,
+	"p384":              tls.CurveP384,
+	"p521":              tls.CurveP521,
+}
+
+// tlsALPNProtocols lists the application protocols that can be offered to the clients.
+var tlsALPNProtocols = []string{"h2", "http/1.1"}
+
+// intermediateCipherSuites are the TLS 1.2 cipher suites of the intermediate profile, see
+// https://wiki.mozilla.org/Security/Server_Side_TLS.
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// intermediateCurves are the key exchange curves of the intermediate profile.
+var intermediateCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+
+// tlsSettings holds the TLS versions, cipher suites, curves and application protocols offered to the clients.
+type tlsSettings struct {
+	profile    string
+	minVersion string
+	maxVersion string
+	ciphers    []string
+	curves     []string
+	alpn       []string
+}
+
+// tlsSettings gives the TLS profile configuration.
+func (c ServerConfig) tlsSettings() tlsSettings {
+	return tlsSettings{
+		profile:    c.TLSProfile,
+		minVersion: c.TLSMinVersion,
+		maxVersion: c.TLSMaxVersion,
+		ciphers:    *c.TLSCiphers,
+		curves:     *c.TLSCurves,
+		alpn:       *c.TLSALPN,
+	}
+}
+
+// custom checks if any of the options only valid for the custom profile is given.
+func (s tlsSettings) custom() bool {
+	return len(s.minVersion) > 0 || len(s.maxVersion) > 0 || len(s.ciphers) > 0 || len(s.curves) > 0
+}
+
+// parseTLSVersion gives the value of the named TLS version, the default value for an empty name.
+func parseTLSVersion(name string, defaultVersion uint16) (uint16, error) {
+	if len(name) == 0 {
+		return defaultVersion, nil
+	}
+
+	if slices.Contains(insecureTLSVersions, name) {
+		return 0, fmt.Errorf("%w: %q is insecure, use 1.2 or above", ErrInvalidTLSVersion, name)
+	}
+
+	version, found := tlsVersions[name]
+
+	if !found {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidTLSVersion, name)
+	}
+
+	return version, nil
+}
+
+// parseCipherSuites gives the values of the named cipher suites. Only the secure TLS 1.2 cipher suites can be
+// configured, the ones of TLS 1.3 are always enabled.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var result []uint16
+
+	for _, name := range names {
+		index := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool {
+			return strings.EqualFold(suite.Name, name) && slices.Contains(suite.SupportedVersions, tls.VersionTLS12)
+		})
+
+		if index < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCipherSuite, name)
+		}
+
+		result = append(result, tls.CipherSuites()[index].ID)
+	}
+
+	return result, nil
+}
+
+// parseCurves gives the values of the named key exchange curves.
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	var result []tls.CurveID
+
+	for _, name := range names {
+		curve, found := tlsCurves[strings.ToLower(name)]
+
+		if !found {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCurve, name)
+		}
+
+		result = append(result, curve)
+	}
+
+	return result, nil
+}
+
+// apply sets the versions, cipher suites, curves and application protocols of the profile in the configuration.
+// The ACME challenge protocol is kept if the configuration offers it.
+func (s tlsSettings) apply(config *tls.Config) error {
+	if s.profile != TLSProfileCustom && s.custom() {
+		return fmt.Errorf("%w: %q", ErrCustomTLSOptions, s.profile)
+	}
+
+	switch s.profile {
+	case TLSProfileModern:
+		config.MinVersion, config.MaxVersion = tls.VersionTLS13, tls.VersionTLS13
+		config.CipherSuites, config.CurvePreferences = nil, nil
+	case TLSProfileIntermediate:
+		config.MinVersion, config.MaxVersion = tls.VersionTLS12, tls.VersionTLS13
+		config.CipherSuites = slices.Clone(intermediateCipherSuites)
+		config.CurvePreferences = slices.Clone(intermediateCurves)
+	case TLSProfileCustom:
+		if err := s.applyCustom(config); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidTLSProfile, s.profile)
+	}
+
+	if len(s.alpn) == 0 {
+		return nil
+	}
+
+	protos := make([]string, 0, len(s.alpn)+len(config.NextProtos))
+
+	for _, proto := range s.alpn {
+		if !slices.Contains(tlsALPNProtocols, proto) {
+			return fmt.Errorf("%w: %q", ErrInvalidALPN, proto)
+		}
+
+		protos = append(protos, proto)
+	}
+
+	for _, proto := range config.NextProtos {
+		if !slices.Contains(tlsALPNProtocols, proto) {
+			protos = append(protos, proto)
+		}
+	}
+
+	config.NextProtos = protos
+
+	return nil
+}
+
+// applyCustom sets the configured versions, cipher suites and curves in the configuration.
+func (s tlsSettings) applyCustom(config *tls.Config) error {
+	minVersion, minErr := parseTLSVersion(s.minVersion, tls.VersionTLS12)
+	maxVersion, maxErr := parseTLSVersion(s.maxVersion, tls.VersionTLS13)
+	ciphers, cipherErr := parseCipherSuites(s.ciphers)
+	curves, curveErr := parseCurves(s.curves)
+
+	if err := errors.Join(minErr, maxErr, cipherErr, curveErr); err != nil {
+		return err
+	}
+
+	if minVersion > maxVersion {
+		return fmt.Errorf("%w: minimum %v above maximum %v", ErrInvalidTLSVersion,
+			tls.VersionName(minVersion), tls.VersionName(maxVersion))
+	}
+
+	config.MinVersion, config.MaxVersion = minVersion, maxVersion
+	config.CipherSuites, config.CurvePreferences = ciphers, curves
+
+	return nil
+}
+
+// checkTLSConsistency checks the TLS profile options, giving all errors found together with their sources.
+func checkTLSConsistency(config ServerConfig) error {
+	var errs []error
+
+	settings := config.tlsSettings()
+
+	if !slices.Contains([]string{TLSProfileModern, TLSProfileIntermediate, TLSProfileCustom}, settings.profile) {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidTLSProfile, settings.profile,
+			config.source("tlsprofile")))
+	} else if settings.profile != TLSProfileCustom && settings.custom() {
+		errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrCustomTLSOptions, settings.profile,
+			config.source("tlsprofile")))
+	}
+
+	minVersion, minErr := parseTLSVersion(settings.minVersion, tls.VersionTLS12)
+	maxVersion, maxErr := parseTLSVersion(settings.maxVersion, tls.VersionTLS13)
+
+	if minErr != nil {
+		errs = append(errs, fmt.Errorf("%w (%v)", minErr, config.source("tlsminversion")))
+	}
+
+	if maxErr != nil {
+		errs = append(errs, fmt.Errorf("%w (%v)", maxErr, config.source("tlsmaxversion")))
+	}
+
+	if minErr == nil && maxErr == nil && minVersion > maxVersion {
+		errs = append(errs, fmt.Errorf("%w: minimum %v above maximum %v (%v)", ErrInvalidTLSVersion,
+			tls.VersionName(minVersion), tls.VersionName(maxVersion), config.source("tlsminversion")))
+	}
+
+	if _, err := parseCipherSuites(settings.ciphers); err != nil {
+		errs = append(errs, fmt.Errorf("%w (%v)", err, config.source("tlscipher")))
+	}
+
+	if _, err := parseCurves(settings.curves); err != nil {
+		errs = append(errs, fmt.Errorf("%w (%v)", err, config.source("tlscurve")))
+	}
+
+	for _, proto := range settings.alpn {
+		if !slices.Contains(tlsALPNProtocols, proto) {
+			errs = append(errs, fmt.Errorf("%w: %q (%v)", ErrInvalidALPN, proto, config.source("tlsalpn")))
+		}
+	}
+
+	if config.TLSTicketRotation < 0 {
+		errs = append(errs, fmt.Errorf("%w: %v (%v)",
+			ErrInvalidTicketRotation, config.TLSTicketRotation, config.source("tlsticketrotation")))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ticketKeyRotator replaces the session ticket keys of a TLS configuration every interval. Tickets encrypted
+// using the previous key are still accepted, so they are valid for up to two intervals.
+type ticketKeyRotator struct {
+	interval time.Duration
+
+	lock    sync.Mutex
+	keys    [][32]byte
+	created time.Time
+}
+
+// rotate installs a new key in the configuration if the current one is older than the interval.
+func (r *ticketKeyRotator) rotate(config *tls.Config, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.keys) > 0 && now.Sub(r.created) < r.interval {
+		return nil
+	}
+
+	var key [32]byte
+
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("could not create session ticket key: %w", err)
+	}
+
+	r.keys = append([][32]byte{key}, r.keys[:min(len(r.keys), 1)]...)
+	r.created = now
+
+	config.SetSessionTicketKeys(r.keys)
+
+	return nil
+}
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSProfiles(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		settings   tlsSettings
+		minVersion uint16
+		maxVersion uint16
+		ciphers    []uint16
+		curves     []tls.CurveID
+		protos     []string
+	}{
+		{
+			settings:   tlsSettings{profile: TLSProfileModern},
+			minVersion: tls.VersionTLS13,
+			maxVersion: tls.VersionTLS13,
+			protos:     []string{"h2", "http/1.1", "acme-tls/1"},
+		},
+		{
+			settings:   tlsSettings{profile: TLSProfileIntermediate, alpn: []string{"http/1.1"}},
+			minVersion: tls.VersionTLS12,
+			maxVersion: tls.VersionTLS13,
+			ciphers:    intermediateCipherSuites,
+			curves:     intermediateCurves,
+			protos:     []string{"http/1.1", "acme-tls/1"},
+		},
+		{
+			settings:   tlsSettings{profile: TLSProfileCustom},
+			minVersion: tls.VersionTLS12,
+			maxVersion: tls.VersionTLS13,
+			protos:     []string{"h2", "http/1.1", "acme-tls/1"},
+		},
+		{
+			settings: tlsSettings{
+				profile:    TLSProfileCustom,
+				minVersion: "1.2",
+				maxVersion: "1.2",
+				ciphers:    []string{"tls_ecdhe_rsa_with_aes_256_gcm_sha384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+				curves:     []string{"P384", "x25519"},
+				alpn:       []string{"http/1.1", "h2"},
+			},
+			minVersion: tls.VersionTLS12,
+			maxVersion: tls.VersionTLS12,
+			ciphers:    []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			curves:     []tls.CurveID{tls.CurveP384, tls.X25519},
+			protos:     []string{"http/1.1", "h2", "acme-tls/1"},
+		},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestTLSProfiles-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			config := &tls.Config{MinVersion: tls.VersionTLS13, NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}}
+
+			if !assert.NoError(t, test.settings.apply(config), "profile should be applied") {
+				return
+			}
+
+			assert.Equal(t, test.minVersion, config.MinVersion, "minimum version")
+			assert.Equal(t, test.maxVersion, config.MaxVersion, "maximum version")
+			assert.Equal(t, test.ciphers, config.CipherSuites, "cipher suites")
+			assert.Equal(t, test.curves, config.CurvePreferences, "curves")
+			assert.Equal(t, test.protos, config.NextProtos, "application protocols")
+		})
+	}
+}
+
+func TestTLSProfileErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		settings tlsSettings
+		want     error
+	}{
+		{settings: tlsSettings{profile: "strict"}, want: ErrInvalidTLSProfile},
+		{settings: tlsSettings{profile: TLSProfileModern, minVersion: "1.2"}, want: ErrCustomTLSOptions},
+		{settings: tlsSettings{profile: TLSProfileCustom, minVersion: "1.4"}, want: ErrInvalidTLSVersion},
+		{settings: tlsSettings{profile: TLSProfileCustom, minVersion: "1.0"}, want: ErrInvalidTLSVersion},
+		{settings: tlsSettings{profile: TLSProfileCustom, minVersion: "1.1", maxVersion: "1.1"},
+			want: ErrInvalidTLSVersion},
+		{settings: tlsSettings{profile: TLSProfileCustom, minVersion: "1.3", maxVersion: "1.2"},
+			want: ErrInvalidTLSVersion},
+		{settings: tlsSettings{profile: TLSProfileCustom, ciphers: []string{"TLS_AES_128_GCM_SHA256"}},
+			want: ErrInvalidCipherSuite},
+		{settings: tlsSettings{profile: TLSProfileCustom, ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			want: ErrInvalidCipherSuite},
+		{settings: tlsSettings{profile: TLSProfileCustom, curves: []string{"p224"}}, want: ErrInvalidCurve},
+		{settings: tlsSettings{profile: TLSProfileModern, alpn: []string{"spdy/3"}}, want: ErrInvalidALPN},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestTLSProfileErrors-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			assert.ErrorIs(t, test.settings.apply(&tls.Config{MinVersion: tls.VersionTLS13}), test.want,
+				"invalid settings %v", test.settings)
+		})
+	}
+}
+
+func TestTLSProfileHandshake(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		profile string
+		success bool
+	}{
+		{profile: TLSProfileModern, success: false},
+		{profile: TLSProfileIntermediate, success: true},
+	}
+
+	for testIndex, test := range tests {
+		t.Run(fmt.Sprintf("TestTLSProfileHandshake-%d", testIndex), func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			server.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+
+			if !assert.NoError(t, tlsSettings{profile: test.profile}.apply(server.TLS), "profile should be applied") {
+				return
+			}
+
+			server.StartTLS()
+			defer server.Close()
+
+			// a client only speaking TLS 1.2
+			transport, _ := server.Client().Transport.(*http.Transport)
+			transport = transport.Clone()
+			transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+
+			request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+
+			if !assert.NoError(t, err, "request should be created") {
+				return
+			}
+
+			response, err := (&http.Client{Transport: transport}).Do(request)
+
+			if err == nil {
+				_ = response.Body.Close()
+			}
+
+			assert.Equal(t, test.success, err == nil, "TLS 1.2 handshake with profile %v: %v", test.profile, err)
+		})
+	}
+}
+
+func TestTicketKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	rotator := &ticketKeyRotator{interval: time.Hour}
+	config := &tls.Config{MinVersion: tls.VersionTLS13}
+	start := time.Now()
+
+	if !assert.NoError(t, rotator.rotate(config, start), "first key should be created") {
+		return
+	}
+
+	first := rotator.keys[0]
+
+	assert.NoError(t, rotator.rotate(config, start.Add(30*time.Minute)), "key should be kept")
+	assert.Equal(t, [][32]byte{first}, rotator.keys, "key kept within interval")
+
+	assert.NoError(t, rotator.rotate(config, start.Add(time.Hour)), "key should be rotated")
+
+	if assert.Len(t, rotator.keys, 2, "new and previous key") {
+		assert.NotEqual(t, first, rotator.keys[0], "new key first")
+		assert.Equal(t, first, rotator.keys[1], "previous key still accepted")
+	}
+
+	second := rotator.keys[0]
+
+	assert.NoError(t, rotator.rotate(config, start.Add(2*time.Hour)), "key should be rotated again")
+
+	if assert.Len(t, rotator.keys, 2, "oldest key dropped") {
+		assert.Equal(t, second, rotator.keys[1], "previous key still accepted")
+	}
+}
+
+func TestTLSProfileConfig(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeConfigFile(t, `version: 1
+root: testroot
+tlsprofile: modern
+tlsminversion: "1.4"
+tlscipher:
+  - TLS_NOT_A_SUITE
+tlscurve:
+  - p224
+tlsalpn:
+  - spdy/3
+tlsticketrotation: -1h
+`)
+
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", fileName}, nil)
+
+	if !assert.NoError(t, err, "configuration file should be readable") {
+		return
+	}
+
+	checkErr := checkConfigConsistency(config)
+
+	assert.ErrorIs(t, checkErr, ErrCustomTLSOptions, "expected options of the custom profile")
+	assert.ErrorIs(t, checkErr, ErrInvalidTLSVersion, "expected invalid version")
+	assert.ErrorIs(t, checkErr, ErrInvalidCipherSuite, "expected invalid cipher suite")
+	assert.ErrorIs(t, checkErr, ErrInvalidCurve, "expected invalid curve")
+	assert.ErrorIs(t, checkErr, ErrInvalidALPN, "expected invalid application protocol")
+	assert.ErrorIs(t, checkErr, ErrInvalidTicketRotation, "expected negative ticket rotation")
+	assert.ErrorContains(t, checkErr, fileName+":3", "expected location of profile")
+	assert.ErrorContains(t, checkErr, fileName+":4", "expected location of minimum version")
+	assert.ErrorContains(t, checkErr, fileName+":11", "expected location of ticket rotation")
+
+	config, err = parseConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-root", "testroot", "-tlsprofile", "custom", "-tlsminversion", "1.2", "-tlscurve", "x25519"}, nil)
+
+	if assert.NoError(t, err, "arguments should be valid") {
+		assert.NoError(t, checkConfigConsistency(config), "custom profile")
+	}
+}
@@ -69,6 +69,57 @@ func ParseLanguageHeader(langHeader string) []LangPref {
 	return langs
 }
 
+// EncodingPref represents a content encoding with its quality factor (preference value).
+type EncodingPref struct {
+	Encoding string
+	Pref     float32
+}
+
+// acceptEncodingHeaderRegex is a regular expression for parsing the HTTP "Accept-Encoding" header values
+// and quality factors.
+var acceptEncodingHeaderRegex = regexp.MustCompile(
+	`^([A-Za-z0-9!#$%&'*+.^_\x60|~-]+)(?:;q=(1(?:\.0{0,3})?|0(?:\.[0-9]{0,3})?))?$`)
+
+// ParseEncodingHeader parses the Accept-Encoding header and returns a sorted slice of EncodingPref by preference
+// value. Encodings are given in lower case, entries with invalid syntax are ignored.
+func ParseEncodingHeader(encodingHeader string) []EncodingPref {
+	const EncodingPrefMatch = 3
+
+	encodingHeader = strings.ReplaceAll(encodingHeader, " ", "")
+
+	encodings := make([]EncodingPref, 0, strings.Count(encodingHeader, ",")+1)
+
+	for part := range strings.SplitSeq(encodingHeader, ",") {
+		matches := acceptEncodingHeaderRegex.FindStringSubmatch(part)
+
+		if len(matches) == EncodingPrefMatch {
+			pref, prefErr := strconv.ParseFloat(matches[2], 32)
+
+			// this occurs in the case of an empty match
+			if prefErr != nil {
+				pref = 1
+			}
+
+			encodings = append(encodings, EncodingPref{
+				Encoding: strings.ToLower(matches[1]),
+				Pref:     float32(pref),
+			})
+		}
+	}
+
+	slices.SortStableFunc(encodings, func(a, b EncodingPref) int {
+		if a.Pref > b.Pref {
+			return -1
+		} else if a.Pref < b.Pref {
+			return 1
+		}
+
+		return 0
+	})
+
+	return encodings
+}
+
 // CutLog truncates a string to ensure it does not exceed a specified length, appending a suffix if truncation occurs.
 func CutLog(s string) string {
 	const MaxLogStringLength = 64 // must be smaller than the MaxPathPartLength!!!
@@ -5,9 +5,12 @@ package utils_test
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/AlphaOne1/sonicred/utils"
 )
@@ -54,6 +57,49 @@ func TestParseLanguageHeader(t *testing.T) {
 	}
 }
 
+func TestParseEncodingHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want []utils.EncodingPref
+	}{
+		{
+			in:   "",
+			want: []utils.EncodingPref{},
+		},
+		{
+			in: "gzip, deflate, br, zstd",
+			want: []utils.EncodingPref{
+				{Encoding: "gzip", Pref: 1},
+				{Encoding: "deflate", Pref: 1},
+				{Encoding: "br", Pref: 1},
+				{Encoding: "zstd", Pref: 1},
+			},
+		},
+		{
+			in: "GZIP;q=0.5, br;q=1.0, *;q=0, bad;q=2",
+			want: []utils.EncodingPref{
+				{Encoding: "br", Pref: 1},
+				{Encoding: "gzip", Pref: 0.5},
+				{Encoding: "*", Pref: 0},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("TestParseEncodingHeader-%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			got := utils.ParseEncodingHeader(test.in)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
 func TestCutLog(t *testing.T) {
 	t.Parallel()
 
@@ -83,3 +129,35 @@ func TestCutLog(t *testing.T) {
 		})
 	}
 }
+
+func TestWatchFiles(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "watched")
+
+	if err := os.WriteFile(fileName, []byte("initial"), 0o600); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	changes := make(chan []string, 1)
+
+	go utils.WatchFiles(t.Context(), 10*time.Millisecond, []string{fileName}, func(changed []string) {
+		changes <- changed
+	})
+
+	// give the watcher the chance to record the initial state
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(fileName, []byte("changed content"), 0o600); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	select {
+	case changed := <-changes:
+		if !reflect.DeepEqual(changed, []string{fileName}) {
+			t.Errorf("got changed files %v, wanted %v", changed, []string{fileName})
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("change of %s not detected", fileName)
+	}
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2026 The SonicRed contributors.
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileState holds the properties of a file used to detect changes.
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+// equal checks if two file states describe the same file content.
+func (f fileState) equal(other fileState) bool {
+	return f.exists == other.exists && f.size == other.size && f.modTime.Equal(other.modTime)
+}
+
+// statFile gets the current state of the given file. Files that cannot be accessed are reported as non-existing.
+func statFile(name string) fileState {
+	info, err := os.Stat(name)
+
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// WatchFiles polls the given files in the specified interval and calls onChange with the names of the files
+// that were modified, created or removed since the last check. It blocks until the context is cancelled.
+// Polling is used instead of file system notifications, as it also works reliably for files that are replaced
+// by symlink swaps, like in Kubernetes' ConfigMap and Secret volumes.
+func WatchFiles(ctx context.Context, interval time.Duration, files []string, onChange func([]string)) {
+	if interval <= 0 || len(files) == 0 {
+		return
+	}
+
+	states := make(map[string]fileState, len(files))
+
+	for _, f := range files {
+		states[f] = statFile(f)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var changed []string
+
+			for _, f := range files {
+				if current := statFile(f); !current.equal(states[f]) {
+					states[f] = current
+					changed = append(changed, f)
+				}
+			}
+
+			if len(changed) > 0 {
+				onChange(changed)
+			}
+		}
+	}
+}